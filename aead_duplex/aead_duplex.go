@@ -0,0 +1,281 @@
+package aead_duplex
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+	"hash"
+	"io"
+	"sync"
+	"time"
+)
+
+const saltLen = 32
+
+// DefaultPbkdf2Iter is the iteration count of PBKDF2-SHA256 used without --pbkdf2
+const DefaultPbkdf2Iter = 100000
+const keyLen = 32
+
+// NOTE: A fin in Close() waits for a blocked Write at most this duration
+const closeFinTimeout = 3 * time.Second
+
+// NOTE: max length of plaintext in one record
+const maxChunkLen = 16 * 1024
+
+const (
+	dataType byte = iota
+	finType
+)
+
+// header: type (1 byte) + length of sealed body (4 bytes)
+const headerLen = 5
+
+var AuthenticationFailedError = errors.New("message authentication failed: the stream may have been tampered with")
+var SameSaltError = errors.New("peer sent the same salt: the stream may have been reflected")
+var TooLongRecordError = errors.New("too long record")
+var SequenceOverflowError = errors.New("sequence number overflow")
+
+type Cipher struct {
+	Name    string
+	NewAead func(key []byte) (cipher.AEAD, error)
+}
+
+var Aes256Gcm = &Cipher{
+	Name: "AES-256-GCM",
+	NewAead: func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	},
+}
+
+var Chacha20Poly1305 = &Cipher{
+	Name:    "ChaCha20-Poly1305",
+	NewAead: chacha20poly1305.New,
+}
+
+type aeadDuplex struct {
+	baseWriter      io.WriteCloser
+	baseReader      io.Reader
+	closeBaseReader func() error
+
+	writeMutex *sync.Mutex
+	sealer     cipher.AEAD
+	sendSeq    uint64
+	finSent    bool
+
+	opener     cipher.AEAD
+	receiveSeq uint64
+	// decrypted but not yet read
+	plain   []byte
+	readErr error
+}
+
+// Duplex exchanges salts with the peer and derives keys of both directions from the passphrase by PBKDF2
+func Duplex(baseWriter io.WriteCloser, baseReader io.ReadCloser, passphrase []byte, pbkdf2Iter int, h func() hash.Hash, c *Cipher) (*aeadDuplex, error) {
+	// Generate salt
+	salt1, err := util.GenerateRandomBytes(saltLen)
+	if err != nil {
+		return nil, err
+	}
+	// Send the salt
+	if _, err := baseWriter.Write(salt1); err != nil {
+		return nil, err
+	}
+	// Read salt from peer
+	salt2 := make([]byte, saltLen)
+	if _, err := io.ReadFull(baseReader, salt2); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(salt1, salt2) {
+		return nil, SameSaltError
+	}
+	// NOTE: Both sides use the same order of salts to derive the same secret
+	var pbkdf2Salt []byte
+	if bytes.Compare(salt1, salt2) < 0 {
+		pbkdf2Salt = append(append([]byte{}, salt1...), salt2...)
+	} else {
+		pbkdf2Salt = append(append([]byte{}, salt2...), salt1...)
+	}
+	secret := pbkdf2.Key(passphrase, pbkdf2Salt, pbkdf2Iter, keyLen, h)
+	sendKey, err := DeriveKey(secret, c, salt1, salt2)
+	if err != nil {
+		return nil, err
+	}
+	receiveKey, err := DeriveKey(secret, c, salt2, salt1)
+	if err != nil {
+		return nil, err
+	}
+	return DuplexWithKeys(baseWriter, baseReader, sendKey, receiveKey, c)
+}
+
+// DeriveKey derives a key of one direction from the shared secret and the salts of the sender and the receiver
+func DeriveKey(secret []byte, c *Cipher, senderSalt []byte, receiverSalt []byte) ([]byte, error) {
+	info := append([]byte("piping-tunnel aead "+c.Name+" "), senderSalt...)
+	info = append(info, receiverSalt...)
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DuplexWithKeys makes a duplex from the already derived keys
+func DuplexWithKeys(baseWriter io.WriteCloser, baseReader io.ReadCloser, sendKey []byte, receiveKey []byte, c *Cipher) (*aeadDuplex, error) {
+	sealer, err := c.NewAead(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := c.NewAead(receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadDuplex{
+		baseWriter:      baseWriter,
+		baseReader:      baseReader,
+		closeBaseReader: baseReader.Close,
+		writeMutex:      new(sync.Mutex),
+		sealer:          sealer,
+		opener:          opener,
+	}, nil
+}
+
+func makeNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+// NOTE: writeMutex should be locked
+func (d *aeadDuplex) writeRecord(recordType byte, p []byte) error {
+	if d.sendSeq == ^uint64(0) {
+		return SequenceOverflowError
+	}
+	record := make([]byte, headerLen, headerLen+len(p)+d.sealer.Overhead())
+	record[0] = recordType
+	binary.BigEndian.PutUint32(record[1:headerLen], uint32(len(p)+d.sealer.Overhead()))
+	// NOTE: The header is authenticated as additional data
+	record = d.sealer.Seal(record, makeNonce(d.sealer, d.sendSeq), p, record[:headerLen])
+	d.sendSeq++
+	_, err := d.baseWriter.Write(record)
+	return err
+}
+
+func (d *aeadDuplex) Write(p []byte) (int, error) {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+	if d.finSent {
+		return 0, io.ErrClosedPipe
+	}
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxChunkLen {
+			chunk = chunk[:maxChunkLen]
+		}
+		if err := d.writeRecord(dataType, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (d *aeadDuplex) readRecord() error {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(d.baseReader, header); err != nil {
+		// NOTE: EOF without fin means that the stream was truncated
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxChunkLen+uint32(d.opener.Overhead()) {
+		return TooLongRecordError
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.baseReader, sealed); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if d.receiveSeq == ^uint64(0) {
+		return SequenceOverflowError
+	}
+	plain, err := d.opener.Open(sealed[:0], makeNonce(d.opener, d.receiveSeq), sealed, header)
+	if err != nil {
+		return AuthenticationFailedError
+	}
+	d.receiveSeq++
+	switch header[0] {
+	case dataType:
+		d.plain = plain
+		return nil
+	case finType:
+		return io.EOF
+	default:
+		return errors.Errorf("unexpected record type: %d", header[0])
+	}
+}
+
+func (d *aeadDuplex) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.readErr != nil {
+			return 0, d.readErr
+		}
+		// NOTE: Errors are sticky not to accept records after tampering
+		d.readErr = d.readRecord()
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// NOTE: writeMutex should be locked
+func (d *aeadDuplex) sendFin() error {
+	if d.finSent {
+		return nil
+	}
+	d.finSent = true
+	return d.writeRecord(finType, nil)
+}
+
+// CloseWrite sends an authenticated fin record and half-closes the base writer
+func (d *aeadDuplex) CloseWrite() error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+	if err := d.sendFin(); err != nil {
+		return err
+	}
+	return util.CloseWrite(d.baseWriter)
+}
+
+func (d *aeadDuplex) Close() error {
+	finCh := make(chan error, 1)
+	go func() {
+		d.writeMutex.Lock()
+		defer d.writeMutex.Unlock()
+		finCh <- d.sendFin()
+	}()
+	var finErr error
+	select {
+	case finErr = <-finCh:
+	// NOTE: Closing the base writer unblocks a writer holding the lock, where the peer finds the stream truncated
+	case <-time.After(closeFinTimeout):
+	}
+	wErr := d.baseWriter.Close()
+	rErr := d.closeBaseReader()
+	return util.CombineErrors(util.CombineErrors(finErr, wErr), rErr)
+}
@@ -0,0 +1,196 @@
+package aead_duplex
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func sealAll(t *testing.T, c *Cipher, key []byte, messages ...string) []byte {
+	var buf bytes.Buffer
+	d, err := DuplexWithKeys(nopWriteCloser{&buf}, io.NopCloser(bytes.NewReader(nil)), key, key, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range messages {
+		if _, err := d.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func openAll(t *testing.T, c *Cipher, key []byte, sealed []byte) ([]byte, error) {
+	d, err := DuplexWithKeys(nopWriteCloser{io.Discard}, io.NopCloser(bytes.NewReader(sealed)), key, key, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return io.ReadAll(d)
+}
+
+func TestDuplex(t *testing.T) {
+	for _, c := range []*Cipher{Aes256Gcm, Chacha20Poly1305} {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			r1, w1, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r2, w2, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			type result struct {
+				d   *aeadDuplex
+				err error
+			}
+			ch := make(chan result)
+			go func() {
+				d, err := Duplex(w2, r1, []byte("mypass"), DefaultPbkdf2Iter, sha256.New, c)
+				ch <- result{d, err}
+			}()
+			d1, err := Duplex(w1, r2, []byte("mypass"), DefaultPbkdf2Iter, sha256.New, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := <-ch
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			d2 := res.d
+			defer d1.Close()
+			defer d2.Close()
+
+			// Larger than one record
+			message := bytes.Repeat([]byte("hello, world\n"), 2000)
+			go func() {
+				d1.Write(message)
+				d1.CloseWrite()
+			}()
+			body, err := io.ReadAll(d2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(body, message) {
+				t.Fatalf("unexpected body length: %d", len(body))
+			}
+		})
+	}
+}
+
+func TestDifferentPassphrase(t *testing.T) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		d, err := Duplex(w2, r1, []byte("pass2"), DefaultPbkdf2Iter, sha256.New, Aes256Gcm)
+		if err == nil {
+			d.Write([]byte("hello"))
+		}
+	}()
+	d1, err := Duplex(w1, r2, []byte("pass1"), DefaultPbkdf2Iter, sha256.New, Aes256Gcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d1.Read(make([]byte, 5))
+	if err != AuthenticationFailedError {
+		t.Fatalf("expected authentication error but found: %v", err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, keyLen)
+	sealed := sealAll(t, Chacha20Poly1305, key, "hello", "world")
+	for i := range sealed {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+		_, err := openAll(t, Chacha20Poly1305, key, tampered)
+		if err == nil {
+			t.Fatalf("tampering at %d was not detected", i)
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, keyLen)
+	sealed := sealAll(t, Aes256Gcm, key, "hello", "world")
+	// Drop the fin record
+	body, err := openAll(t, Aes256Gcm, key, sealed[:len(sealed)-headerLen-overhead(t, Aes256Gcm)])
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected unexpected EOF but found: %v", err)
+	}
+	if string(body) != "helloworld" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestReordering(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, keyLen)
+	sealed := sealAll(t, Aes256Gcm, key, "hello", "world")
+	recordLen := headerLen + len("hello") + overhead(t, Aes256Gcm)
+	reordered := append(append(append([]byte{}, sealed[recordLen:2*recordLen]...), sealed[:recordLen]...), sealed[2*recordLen:]...)
+	if _, err := openAll(t, Aes256Gcm, key, reordered); err != AuthenticationFailedError {
+		t.Fatalf("expected authentication error but found: %v", err)
+	}
+}
+
+func overhead(t *testing.T, c *Cipher) int {
+	aead, err := c.NewAead(make([]byte, keyLen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead.Overhead()
+}
+
+func TestCloseWhileWriting(t *testing.T) {
+	// NOTE: Nobody reads the pipe, so writing blocks
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	key := bytes.Repeat([]byte{1}, keyLen)
+	d, err := DuplexWithKeys(w, io.NopCloser(bytes.NewReader(nil)), key, key, Aes256Gcm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeErrCh := make(chan error)
+	go func() {
+		_, err := d.Write(make([]byte, 1024*1024))
+		writeErrCh <- err
+	}()
+	// Wait for the writer to hold the lock
+	time.Sleep(100 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close() is blocked by Write()")
+	}
+	if err := <-writeErrCh; err == nil {
+		t.Fatal("Write() should fail after Close()")
+	}
+}
@@ -16,6 +16,7 @@ const keyLen = 32
 type aesCtrDuplex struct {
 	encryptWriter   io.WriteCloser
 	decryptedReader io.Reader
+	baseWriter      io.Writer
 	closeBaseReader func() error
 }
 
@@ -74,7 +75,7 @@ func Duplex(baseWriter io.WriteCloser, baseReader io.ReadCloser, passphrase []by
 		R: baseReader,
 	}
 
-	return &aesCtrDuplex{encryptWriter: encryptWriter, decryptedReader: decryptedReader, closeBaseReader: baseReader.Close}, nil
+	return &aesCtrDuplex{encryptWriter: encryptWriter, decryptedReader: decryptedReader, baseWriter: baseWriter, closeBaseReader: baseReader.Close}, nil
 }
 
 func (d *aesCtrDuplex) Write(p []byte) (int, error) {
@@ -85,6 +86,11 @@ func (d *aesCtrDuplex) Read(p []byte) (int, error) {
 	return d.decryptedReader.Read(p)
 }
 
+// NOTE: CTR mode has no trailer, so the base writer can be half-closed directly
+func (d *aesCtrDuplex) CloseWrite() error {
+	return util.CloseWrite(d.baseWriter)
+}
+
 func (d *aesCtrDuplex) Close() error {
 	wErr := d.encryptWriter.Close()
 	rErr := d.closeBaseReader()
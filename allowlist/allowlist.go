@@ -0,0 +1,226 @@
+package allowlist
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type rule struct {
+	// NOTE: ipNet is nil when the rule is for host names
+	ipNet       *net.IPNet
+	hostPattern string
+	minPort     int
+	maxPort     int
+}
+
+type List struct {
+	rules    []rule
+	lookupIP func(host string) ([]net.IP, error)
+}
+
+// Parse parses entries in the form of "<CIDR|IP|HOST>[:<PORT>[-<PORT>]]"
+// (e.g. "10.0.0.0/8", "[fd00::1]:22", "*.internal:5432", "db:5000-5999")
+// NOTE: "*.example.com" matches subdomains of example.com, and "*" matches any host
+func Parse(entries []string) (*List, error) {
+	l := &List{lookupIP: net.LookupIP}
+	for _, entry := range entries {
+		r, err := parseRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		l.rules = append(l.rules, r)
+	}
+	return l, nil
+}
+
+func parseRule(entry string) (rule, error) {
+	host, ports, err := splitEntry(entry)
+	if err != nil {
+		return rule{}, err
+	}
+	r := rule{minPort: 1, maxPort: 65535}
+	if ports != "" {
+		if r.minPort, r.maxPort, err = parsePortRange(ports); err != nil {
+			return rule{}, errors.Errorf("invalid port of allowlist entry '%s'", entry)
+		}
+	}
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return rule{}, errors.Errorf("invalid CIDR of allowlist entry '%s'", entry)
+		}
+		r.ipNet = ipNet
+		return r, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		r.ipNet = singleIPNet(ip)
+		return r, nil
+	}
+	if host == "" || strings.ContainsAny(host, "[]") || !validWildcard(host) {
+		return rule{}, errors.Errorf("invalid host of allowlist entry '%s'", entry)
+	}
+	r.hostPattern = normalizeHost(host)
+	return r, nil
+}
+
+// splitEntry splits an entry into the host and the ports
+func splitEntry(entry string) (string, string, error) {
+	if strings.HasPrefix(entry, "[") {
+		end := strings.Index(entry, "]")
+		if end == -1 {
+			return "", "", errors.Errorf("invalid allowlist entry '%s'", entry)
+		}
+		rest := entry[end+1:]
+		if rest == "" {
+			return entry[1:end], "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", errors.Errorf("invalid allowlist entry '%s'", entry)
+		}
+		return entry[1:end], rest[1:], nil
+	}
+	// NOTE: An IPv6 address without brackets has no port
+	if strings.Count(entry, ":") != 1 {
+		return entry, "", nil
+	}
+	i := strings.LastIndex(entry, ":")
+	return entry[:i], entry[i+1:], nil
+}
+
+func parsePortRange(ports string) (int, int, error) {
+	splitted := strings.SplitN(ports, "-", 2)
+	minPort, err := parsePort(splitted[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	maxPort := minPort
+	if len(splitted) == 2 {
+		if maxPort, err = parsePort(splitted[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if minPort > maxPort {
+		return 0, 0, errors.Errorf("invalid port range '%s'", ports)
+	}
+	return minPort, maxPort, nil
+}
+
+func parsePort(str string) (int, error) {
+	port, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || 65535 < port {
+		return 0, errors.Errorf("port out of range '%s'", str)
+	}
+	return port, nil
+}
+
+func singleIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// NOTE: A wildcard is only allowed as "*" or at the beginning such as "*.example.com"
+func validWildcard(host string) bool {
+	if host == "*" {
+		return true
+	}
+	if strings.HasPrefix(host, "*.") {
+		host = host[2:]
+	}
+	return host != "" && !strings.Contains(host, "*")
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (r *rule) permitsPort(port int) bool {
+	return r.minPort <= port && port <= r.maxPort
+}
+
+func (r *rule) permitsHost(host string) bool {
+	if r.hostPattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(r.hostPattern, "*.") {
+		return strings.HasSuffix(host, r.hostPattern[1:])
+	}
+	return host == r.hostPattern
+}
+
+func (l *List) permitsHost(host string, port int) bool {
+	for _, r := range l.rules {
+		if r.ipNet == nil && r.permitsHost(host) && r.permitsPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *List) permitsIP(ip net.IP, port int) bool {
+	for _, r := range l.rules {
+		if r.ipNet != nil && r.ipNet.Contains(ip) && r.permitsPort(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether the destination is in the list, where host may be empty and ip may be nil
+// NOTE: Unlike Check(), the host name is not resolved
+func (l *List) Matches(host string, ip net.IP, port int) bool {
+	if host != "" && l.permitsHost(normalizeHost(host), port) {
+		return true
+	}
+	if ip != nil {
+		return l.permitsIP(ip, port) || l.permitsHost("*", port)
+	}
+	return false
+}
+
+// Check returns the address to dial if address is allowed
+// NOTE: A host name allowed only by CIDRs is resolved here, and the checked IP should be dialed not to be changed by DNS
+func (l *List) Check(address string) (string, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	port, err := parsePort(portStr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if l.permitsIP(ip, port) || l.permitsHost("*", port) {
+			return address, nil
+		}
+		return "", errors.Errorf("'%s' is not allowed", address)
+	}
+	if l.permitsHost(normalizeHost(host), port) {
+		return address, nil
+	}
+	ips, err := l.lookupIP(host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if l.permitsIP(ip, port) {
+			return net.JoinHostPort(ip.String(), portStr), nil
+		}
+	}
+	return "", errors.Errorf("'%s' is not allowed", address)
+}
+
+// Dial connects to address if address is allowed
+func (l *List) Dial(address string) (net.Conn, error) {
+	checkedAddress, err := l.Check(address)
+	if err != nil {
+		return nil, err
+	}
+	return net.Dial("tcp", checkedAddress)
+}
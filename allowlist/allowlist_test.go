@@ -0,0 +1,97 @@
+package allowlist
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	l, err := Parse([]string{"10.0.0.0/8:22", "127.0.0.1", "[fd00::1]:443", "*.internal:5432", "db:5000-5999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.lookupIP = func(host string) ([]net.IP, error) {
+		if host == "ssh.example.com" {
+			return []net.IP{net.ParseIP("192.168.0.1"), net.ParseIP("10.1.2.3")}, nil
+		}
+		return []net.IP{net.ParseIP("203.0.113.1")}, nil
+	}
+	for _, c := range []struct {
+		address  string
+		expected string
+	}{
+		{address: "10.1.2.3:22", expected: "10.1.2.3:22"},
+		{address: "127.0.0.1:8080", expected: "127.0.0.1:8080"},
+		{address: "[fd00::1]:443", expected: "[fd00::1]:443"},
+		{address: "db.internal:5432", expected: "db.internal:5432"},
+		{address: "DB.Internal.:5432", expected: "DB.Internal.:5432"},
+		{address: "db:5555", expected: "db:5555"},
+		// The resolved IP allowed by the CIDR is dialed
+		{address: "ssh.example.com:22", expected: "10.1.2.3:22"},
+	} {
+		actual, err := l.Check(c.address)
+		if err != nil {
+			t.Fatalf("%s: %v", c.address, err)
+		}
+		if actual != c.expected {
+			t.Fatalf("%s: expected %s but %s", c.address, c.expected, actual)
+		}
+	}
+	for _, address := range []string{
+		"10.1.2.3:23",
+		"127.0.0.2:8080",
+		"[fd00::1]:80",
+		"internal:5432",
+		"db.internal:22",
+		"db:6000",
+		"example.com:22",
+		"invalid",
+	} {
+		if _, err := l.Check(address); err == nil {
+			t.Fatalf("%s should not be allowed", address)
+		}
+	}
+}
+
+func TestCheckWildcard(t *testing.T) {
+	l, err := Parse([]string{"*:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"example.com:443", "192.168.0.1:443", "[::1]:443"} {
+		if _, err := l.Check(address); err != nil {
+			t.Fatalf("%s: %v", address, err)
+		}
+	}
+	if _, err := l.Check("example.com:80"); err == nil {
+		t.Fatal("should not be allowed")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, entry := range []string{"", "10.0.0.0/33", "host:0", "host:abc", "host:90-80", "a*.example.com", "[::1", "[::1]22"} {
+		if _, err := Parse([]string{entry}); err == nil {
+			t.Fatalf("'%s' should be invalid", entry)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	l, err := Parse([]string{"169.254.0.0/16", "*.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Matches("", net.ParseIP("169.254.169.254"), 80) {
+		t.Fatal("IP should match")
+	}
+	// Either the host name or the resolved IP matches
+	if !l.Matches("metadata.example.com", net.ParseIP("169.254.169.254"), 80) {
+		t.Fatal("resolved IP should match")
+	}
+	if !l.Matches("db.internal", net.ParseIP("10.0.0.1"), 5432) {
+		t.Fatal("host name should match")
+	}
+	if l.Matches("example.com", net.ParseIP("93.184.216.34"), 80) {
+		t.Fatal("should not match")
+	}
+}
@@ -0,0 +1,79 @@
+package allowlist
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// Rules limits destinations by allow and deny lists
+// NOTE: Deny rules take precedence, and any destination is allowed when there is no allow rule
+type Rules struct {
+	allow *List
+	deny  *List
+}
+
+// ParseRules parses entries of allow and deny rules in the format of Parse() (nil permits all)
+func ParseRules(allowEntries []string, denyEntries []string) (*Rules, error) {
+	if len(allowEntries) == 0 && len(denyEntries) == 0 {
+		return nil, nil
+	}
+	rules := &Rules{}
+	var err error
+	if len(allowEntries) != 0 {
+		if rules.allow, err = Parse(allowEntries); err != nil {
+			return nil, err
+		}
+	}
+	if rules.deny, err = Parse(denyEntries); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ReadRulesFile reads lines of "allow <ENTRY>" or "deny <ENTRY>", where "#" starts a comment
+func ReadRulesFile(r io.Reader) ([]string, []string, error) {
+	var allowEntries []string
+	var denyEntries []string
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, nil, errors.Errorf("invalid rule in line %d: e.g. allow 10.0.0.0/8", lineNo)
+		}
+		switch fields[0] {
+		case "allow":
+			allowEntries = append(allowEntries, fields[1])
+		case "deny":
+			denyEntries = append(denyEntries, fields[1])
+		default:
+			return nil, nil, errors.Errorf("unknown action '%s' in line %d", fields[0], lineNo)
+		}
+	}
+	return allowEntries, denyEntries, scanner.Err()
+}
+
+// Permits reports whether the destination is permitted, where host may be empty and ip may be nil
+func (r *Rules) Permits(host string, ip net.IP, port int) bool {
+	if r == nil {
+		return true
+	}
+	if r.deny.Matches(host, ip, port) {
+		return false
+	}
+	if r.allow == nil {
+		return true
+	}
+	return r.allow.Matches(host, ip, port)
+}
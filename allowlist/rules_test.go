@@ -0,0 +1,38 @@
+package allowlist
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	allowEntries, denyEntries, err := ReadRulesFile(strings.NewReader("# local only\nallow 127.0.0.0/8\n\ndeny 127.0.0.1:22 # ssh\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseRules(allowEntries, denyEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules.Permits("", net.ParseIP("127.0.0.1"), 80) {
+		t.Fatal("allowed destination should be permitted")
+	}
+	if rules.Permits("", net.ParseIP("127.0.0.1"), 22) {
+		t.Fatal("deny should take precedence")
+	}
+	if rules.Permits("example.com", net.ParseIP("93.184.216.34"), 80) {
+		t.Fatal("destination out of allow should not be permitted")
+	}
+	// nil permits all
+	rules, err = ParseRules(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules.Permits("example.com", nil, 80) {
+		t.Fatal("nil should permit all")
+	}
+	if _, _, err := ReadRulesFile(strings.NewReader("permit 10.0.0.0/8\n")); err == nil {
+		t.Fatal("unknown action should be error")
+	}
+}
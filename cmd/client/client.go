@@ -1,59 +1,133 @@
 package client
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/backoff"
 	"github.com/nwtgck/go-piping-tunnel/cmd"
 	"github.com/nwtgck/go-piping-tunnel/piping_util"
-	"github.com/nwtgck/go-piping-tunnel/pmux"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/nwtgck/go-piping-tunnel/socks_proxy"
 	"github.com/nwtgck/go-piping-tunnel/util"
-	"github.com/nwtgck/go-piping-tunnel/version"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"io"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"time"
 )
 
 var flag struct {
-	clientHostPort                 int
-	clientHostUnixSocket           string
-	serverToClientBufSize          uint
-	yamux                          bool
-	pmux                           bool
-	pmuxConfig                     string
-	symmetricallyEncrypts          bool
-	symmetricallyEncryptPassphrase string
-	cipherType                     string
-	pbkdf2JsonString               string
+	cmd.ConnectionFlags
+	clientHostPort        int
+	clientHostUnixSocket  string
+	serverToClientBufSize uint
+	loop                  bool
+	udp                   bool
+	udpIdleTimeout        time.Duration
+	socksUdp              bool
+	reverseSocks          bool
+	localForwardStrs      []string
+	target                string
+	socksUserStrs         []string
+	socksUserFilePath     string
+	stdio                 bool
 }
 
+// Parsed --forward
+var localForwards []cmd.LocalForward
+
 func init() {
 	cmd.RootCmd.AddCommand(clientCmd)
 	clientCmd.Flags().IntVarP(&flag.clientHostPort, "port", "p", 0, "TCP port of client host")
 	clientCmd.Flags().StringVarP(&flag.clientHostUnixSocket, "unix-socket", "", "", "Unix socket of client host")
 	clientCmd.Flags().UintVarP(&flag.serverToClientBufSize, "sc-buf-size", "", 4096, "Buffer size of server-to-client in bytes")
-	clientCmd.Flags().BoolVarP(&flag.yamux, cmd.YamuxFlagLongName, "", false, "Multiplex connection by hashicorp/yamux")
-	clientCmd.Flags().BoolVarP(&flag.pmux, cmd.PmuxFlagLongName, "", false, "Multiplex connection by pmux (experimental)")
-	clientCmd.Flags().StringVarP(&flag.pmuxConfig, cmd.PmuxConfigFlagLongName, "", `{"hb": true}`, "pmux config in JSON (experimental)")
-	clientCmd.Flags().BoolVarP(&flag.symmetricallyEncrypts, cmd.SymmetricallyEncryptsFlagLongName, cmd.SymmetricallyEncryptsFlagShortName, false, "Encrypt symmetrically")
-	clientCmd.Flags().StringVarP(&flag.symmetricallyEncryptPassphrase, cmd.SymmetricallyEncryptPassphraseFlagLongName, "", "", "Passphrase for encryption")
-	clientCmd.Flags().StringVarP(&flag.cipherType, cmd.CipherTypeFlagLongName, "", cmd.DefaultCipherType, fmt.Sprintf("Cipher type: %s, %s, %s, %s ", piping_util.CipherTypeAesCtr, piping_util.CipherTypeOpensslAes128Ctr, piping_util.CipherTypeOpensslAes256Ctr, piping_util.CipherTypeOpenpgp))
-	// NOTE: default value of --pbkdf2 should be empty to detect key derive derivation from multiple algorithms in the future.
-	clientCmd.Flags().StringVarP(&flag.pbkdf2JsonString, cmd.Pbkdf2FlagLongName, "", "", fmt.Sprintf("e.g. %s", cmd.ExamplePbkdf2JsonStr()))
+	flag.ConnectionFlags.AddMultiplexerFlags(clientCmd.Flags())
+	flag.ConnectionFlags.AddEncryptionFlags(clientCmd.Flags())
+	clientCmd.Flags().BoolVarP(&flag.loop, cmd.LoopFlagLongName, "", false, "Accept the next connection after the connection ends (without multiplexing)")
+	clientCmd.Flags().BoolVarP(&flag.udp, cmd.UdpFlagLongName, "", false, "Listen on the UDP port and forward datagrams")
+	clientCmd.Flags().DurationVarP(&flag.udpIdleTimeout, cmd.UdpIdleTimeoutFlagLongName, "", time.Minute, "Forget a UDP flow after this idle time (0 for no timeout)")
+	clientCmd.Flags().StringArrayVarP(&flag.localForwardStrs, cmd.LocalForwardFlagLongName, cmd.LocalForwardFlagShortName, nil, "Forward the local port to the route of server host with --route (e.g. 2222:ssh)")
+	clientCmd.Flags().StringVarP(&flag.target, cmd.TargetFlagLongName, "", "", "Destination for server host to connect, allowed by --allow of server host (e.g. db.internal:5432)")
+	clientCmd.Flags().BoolVarP(&flag.reverseSocks, cmd.ReverseSocksFlagLongName, "", false, "Serve SOCKS for server host with the same flag instead of listening")
+	clientCmd.Flags().StringArrayVarP(&flag.socksUserStrs, cmd.SocksUserFlagLongName, "", nil, "Require SOCKS5 username/password authentication with --reverse-socks (e.g. alice:mypassword)")
+	clientCmd.Flags().StringVarP(&flag.socksUserFilePath, cmd.SocksUserFileFlagLongName, "", "", "File of lines of '<USER>:<PASSWORD>' for SOCKS5 authentication with --reverse-socks")
+	clientCmd.Flags().BoolVarP(&flag.socksUdp, cmd.SocksUdpFlagLongName, "", false, "Relay UDP of SOCKS UDP ASSOCIATE on a UDP port of each association (with socks command)")
+	clientCmd.Flags().BoolVarP(&flag.stdio, cmd.StdioFlagLongName, "", false, "Relay stdin and stdout instead of listening (e.g. ProxyCommand of ssh)")
 }
 
 var clientCmd = &cobra.Command{
 	Use:   "client",
 	Short: "Run client-host",
 	RunE: func(_ *cobra.Command, args []string) error {
-		// Validate cipher-type
-		if flag.symmetricallyEncrypts {
-			if err := cmd.ValidateClientCipher(flag.cipherType); err != nil {
+		if err := flag.Validate(); err != nil {
+			return err
+		}
+		if flag.udp && flag.clientHostUnixSocket != "" {
+			return errors.Errorf("--%s and --unix-socket cannot be used together", cmd.UdpFlagLongName)
+		}
+		if flag.socksUdp {
+			if !flag.Yamux && !flag.Pmux {
+				return errors.Errorf("--%s needs --%s or --%s", cmd.SocksUdpFlagLongName, cmd.YamuxFlagLongName, cmd.PmuxFlagLongName)
+			}
+			if flag.udp || flag.clientHostUnixSocket != "" {
+				return errors.Errorf("--%s cannot be used with --%s or --unix-socket", cmd.SocksUdpFlagLongName, cmd.UdpFlagLongName)
+			}
+		}
+		if flag.reverseSocks {
+			if !flag.Yamux && !flag.Pmux {
+				return errors.Errorf("--%s needs --%s or --%s", cmd.ReverseSocksFlagLongName, cmd.YamuxFlagLongName, cmd.PmuxFlagLongName)
+			}
+			if flag.udp || flag.socksUdp {
+				return errors.Errorf("--%s cannot be used with --%s or --%s", cmd.ReverseSocksFlagLongName, cmd.UdpFlagLongName, cmd.SocksUdpFlagLongName)
+			}
+		}
+		if (len(flag.socksUserStrs) != 0 || flag.socksUserFilePath != "") && !flag.reverseSocks {
+			// NOTE: socks command authenticates SOCKS clients connecting to the port of client host
+			return errors.Errorf("--%s and --%s need --%s", cmd.SocksUserFlagLongName, cmd.SocksUserFileFlagLongName, cmd.ReverseSocksFlagLongName)
+		}
+		socksCredentials, err := cmd.LoadSocksCredentials(flag.socksUserStrs, flag.socksUserFilePath)
+		if err != nil {
+			return err
+		}
+		localForwards, err = cmd.ParseLocalForwards(flag.localForwardStrs)
+		if err != nil {
+			return err
+		}
+		if len(localForwards) != 0 {
+			if !flag.Yamux && !flag.Pmux {
+				return errors.Errorf("--%s needs --%s or --%s", cmd.LocalForwardFlagLongName, cmd.YamuxFlagLongName, cmd.PmuxFlagLongName)
+			}
+			if flag.udp || flag.socksUdp || flag.reverseSocks || flag.clientHostUnixSocket != "" {
+				return errors.Errorf("--%s cannot be used with --%s, --%s, --%s or --unix-socket", cmd.LocalForwardFlagLongName, cmd.UdpFlagLongName, cmd.SocksUdpFlagLongName, cmd.ReverseSocksFlagLongName)
+			}
+		}
+		if flag.target != "" {
+			if err := cmd.ValidateTarget(flag.target); err != nil {
 				return err
 			}
+			if !flag.Yamux && !flag.Pmux {
+				return errors.Errorf("--%s needs --%s or --%s", cmd.TargetFlagLongName, cmd.YamuxFlagLongName, cmd.PmuxFlagLongName)
+			}
+			if len(localForwards) != 0 || flag.udp || flag.socksUdp || flag.reverseSocks {
+				return errors.Errorf("--%s cannot be used with --%s, --%s, --%s or --%s", cmd.TargetFlagLongName, cmd.LocalForwardFlagLongName, cmd.UdpFlagLongName, cmd.SocksUdpFlagLongName, cmd.ReverseSocksFlagLongName)
+			}
+		}
+		// NOTE: Route headers are advertised to server host, which should read them
+		flag.Routes = len(localForwards) != 0 || flag.target != ""
+		if flag.stdio {
+			if flag.clientHostPort != 0 || flag.clientHostUnixSocket != "" || flag.loop {
+				return errors.Errorf("--%s cannot be used with --port, --unix-socket or --%s", cmd.StdioFlagLongName, cmd.LoopFlagLongName)
+			}
+			if len(localForwards) != 0 || flag.udp || flag.socksUdp || flag.reverseSocks {
+				return errors.Errorf("--%s cannot be used with --%s, --%s, --%s or --%s", cmd.StdioFlagLongName, cmd.LocalForwardFlagLongName, cmd.UdpFlagLongName, cmd.SocksUdpFlagLongName, cmd.ReverseSocksFlagLongName)
+			}
+		}
+		publicKeyAuth, err := flag.PublicKeyAuth()
+		if err != nil {
+			return err
 		}
 		clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(args)
 		if err != nil {
@@ -63,11 +137,7 @@ var clientCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		httpClient := util.CreateHttpClient(cmd.Insecure, cmd.HttpWriteBufSize, cmd.HttpReadBufSize)
-		if cmd.DnsServer != "" {
-			// Set DNS resolver
-			httpClient.Transport.(*http.Transport).DialContext = util.CreateDialContext(cmd.DnsServer)
-		}
+		httpClient := cmd.NewHttpClient()
 		clientToServerUrl, err := util.UrlJoin(cmd.ServerUrl, clientToServerPath)
 		if err != nil {
 			return err
@@ -76,8 +146,33 @@ var clientCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		if flag.reverseSocks {
+			printHintForServerHost(nil, clientToServerUrl, serverToClientUrl, clientToServerPath, serverToClientPath, nil)
+			if err := flag.InputPassphraseIfNeed(); err != nil {
+				return err
+			}
+			socksServer := socks_proxy.New(&socks_proxy.Config{
+				Credentials:    socksCredentials,
+				UdpIdleTimeout: flag.udpIdleTimeout,
+			})
+			return clientHandleReverseSocks(socksServer, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+		}
 		var ln net.Listener
-		if flag.clientHostUnixSocket == "" {
+		var pc net.PacketConn
+		var listeningAddr net.Addr
+		if flag.stdio {
+			// NOTE: stdout is used for the data, so information is printed to stderr
+			cmd.InfoOutput = os.Stderr
+			cmd.ShowProgress = false
+			ln = cmd.ListenStdio(os.Stdin, os.Stdout)
+		} else if len(localForwards) != 0 {
+			ln, err = cmd.ListenLocalForwards(localForwards)
+		} else if flag.udp {
+			pc, err = net.ListenPacket("udp", fmt.Sprintf(":%d", flag.clientHostPort))
+			if err == nil {
+				listeningAddr = pc.LocalAddr()
+			}
+		} else if flag.clientHostUnixSocket == "" {
 			ln, err = net.Listen("tcp", fmt.Sprintf(":%d", flag.clientHostPort))
 		} else {
 			ln, err = net.Listen("unix", flag.clientHostUnixSocket)
@@ -85,91 +180,131 @@ var clientCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		if ln != nil {
+			listeningAddr = ln.Addr()
+		}
 		var opensslAesCtrParams *cmd.OpensslAesCtrParams = nil
-		if flag.symmetricallyEncrypts {
-			opensslAesCtrParams, err = cmd.ParseOpensslAesCtrParams(flag.cipherType, flag.pbkdf2JsonString)
+		if flag.SymmetricallyEncrypts {
+			opensslAesCtrParams, err = cmd.ParseOpensslAesCtrParams(flag.CipherType, flag.Pbkdf2JsonString)
 			if err != nil {
 				return err
 			}
 		}
 		// Print hint
-		printHintForServerHost(ln, clientToServerUrl, serverToClientUrl, clientToServerPath, serverToClientPath, opensslAesCtrParams)
+		printHintForServerHost(listeningAddr, clientToServerUrl, serverToClientUrl, clientToServerPath, serverToClientPath, opensslAesCtrParams)
 		// Make user input passphrase if it is empty
-		if flag.symmetricallyEncrypts {
-			err = cmd.MakeUserInputPassphraseIfEmpty(&flag.symmetricallyEncryptPassphrase)
-			if err != nil {
-				return err
-			}
+		if err := flag.InputPassphraseIfNeed(); err != nil {
+			return err
 		}
 		// Use multiplexer with yamux
-		if flag.yamux {
-			fmt.Println("[INFO] Multiplexing with hashicorp/yamux")
-			return clientHandleWithYamux(ln, httpClient, headers, clientToServerUrl, serverToClientUrl)
+		if flag.Yamux {
+			fmt.Fprintln(cmd.InfoOutput, "[INFO] Multiplexing with hashicorp/yamux")
+			if flag.udp {
+				return clientHandleUdpWithYamux(pc, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+			}
+			return ignoreStdioClosed(clientHandleWithYamux(ln, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth))
 		}
 		// If pmux is enabled
-		if flag.pmux {
-			fmt.Println("[INFO] Multiplexing with pmux")
-			return clientHandleWithPmux(ln, httpClient, headers, clientToServerUrl, serverToClientUrl)
+		if flag.Pmux {
+			fmt.Fprintln(cmd.InfoOutput, "[INFO] Multiplexing with pmux")
+			if flag.udp {
+				return clientHandleUdpWithPmux(pc, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+			}
+			return ignoreStdioClosed(clientHandleWithPmux(ln, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth))
 		}
-		conn, err := ln.Accept()
-		if err != nil {
-			return err
+		if flag.udp {
+			return clientHandleUdp(pc, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 		}
-		fmt.Println("[INFO] accepted")
-		// Refuse another new connection
-		ln.Close()
-		// If encryption is enabled
-		if flag.symmetricallyEncrypts {
-			var duplex io.ReadWriteCloser
-			duplex, err := piping_util.DuplexConnect(httpClient, headers, clientToServerUrl, serverToClientUrl)
+		if !flag.loop {
+			conn, err := ln.Accept()
 			if err != nil {
 				return err
 			}
-			duplex, err = cmd.MakeDuplexWithEncryptionAndProgressIfNeed(duplex, flag.symmetricallyEncrypts, flag.symmetricallyEncryptPassphrase, flag.cipherType, flag.pbkdf2JsonString)
+			fmt.Fprintln(cmd.InfoOutput, "[INFO] accepted")
+			// Refuse another new connection
+			ln.Close()
+			return clientHandle(conn, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+		}
+		b := backoff.NewExponentialBackoff()
+		for {
+			// NOTE: The listener is kept, and a new connection waits in the backlog until the current connection ends
+			conn, err := ln.Accept()
 			if err != nil {
 				return err
 			}
-			fin := make(chan error)
-			go func() {
-				// TODO: hard code
-				var buf = make([]byte, 4096)
-				_, err := io.CopyBuffer(duplex, conn, buf)
-				fin <- err
-			}()
-			go func() {
-				// TODO: hard code
-				var buf = make([]byte, 4096)
-				_, err := io.CopyBuffer(conn, duplex, buf)
-				fin <- err
-			}()
-			return util.CombineErrors(<-fin, <-fin)
+			fmt.Fprintln(cmd.InfoOutput, "[INFO] accepted")
+			err = clientHandle(conn, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+			if err != nil {
+				fmt.Fprintf(cmd.InfoOutput, "[WARN] %s\n", err)
+				// backoff
+				time.Sleep(b.NextDuration())
+				continue
+			}
+			b.Reset()
 		}
-		err = piping_util.HandleDuplex(httpClient, conn, headers, clientToServerUrl, serverToClientUrl, flag.serverToClientBufSize, nil, cmd.ShowProgress, cmd.MakeProgressMessage)
-		fmt.Println()
+	},
+}
+
+// ignoreStdioClosed treats the end of --stdio as success since only one connection is accepted
+func ignoreStdioClosed(err error) error {
+	if flag.stdio && errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func clientHandle(conn net.Conn, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	defer conn.Close()
+	// If encryption is enabled
+	// NOTE: --stdio also uses the duplex because HTTP client closes the uploading conn at the end of stdin, which closes stdout before the download
+	if flag.SymmetricallyEncrypts || publicKeyAuth != nil || flag.Resume || flag.stdio {
+		duplex, err := flag.DuplexConnect(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 		if err != nil {
 			return err
 		}
-		fmt.Println("[INFO] Finished")
-
-		return nil
-	},
+		defer duplex.Close()
+		return cmd.CopyBidirectionally(conn, duplex)
+	}
+	err := piping_util.HandleDuplex(httpClient, conn, headers, clientToServerUrl, serverToClientUrl, flag.serverToClientBufSize, nil, cmd.ShowProgress, cmd.MakeProgressMessage)
+	fmt.Fprintln(cmd.InfoOutput)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.InfoOutput, "[INFO] Finished")
+	return nil
 }
 
-func printHintForServerHost(ln net.Listener, clientToServerUrl string, serverToClientUrl string, clientToServerPath string, serverToClientPath string, opensslAesCtrParams *cmd.OpensslAesCtrParams) {
+func printHintForServerHost(listeningAddr net.Addr, clientToServerUrl string, serverToClientUrl string, clientToServerPath string, serverToClientPath string, opensslAesCtrParams *cmd.OpensslAesCtrParams) {
 	var listeningOn string
-	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+	switch addr := listeningAddr.(type) {
+	case *net.TCPAddr:
 		// (base: https://stackoverflow.com/a/43425461)
 		flag.clientHostPort = addr.Port
 		listeningOn = strconv.Itoa(addr.Port)
-	} else {
+	case *net.UDPAddr:
+		flag.clientHostPort = addr.Port
+		listeningOn = fmt.Sprintf("%d/udp", addr.Port)
+	default:
 		listeningOn = flag.clientHostUnixSocket
 	}
-	fmt.Printf("[INFO] Client host listening on %s ...\n", listeningOn)
-	if !flag.yamux && !flag.pmux {
-		if flag.symmetricallyEncrypts {
+	if flag.reverseSocks {
+		fmt.Fprintln(cmd.InfoOutput, "[INFO] Client host serving SOCKS for server host ...")
+	} else if flag.stdio {
+		fmt.Fprintln(cmd.InfoOutput, "[INFO] Client host relaying stdin and stdout ...")
+	} else if len(localForwards) == 0 {
+		// NOTE: ListenLocalForwards() prints the ports
+		fmt.Fprintf(cmd.InfoOutput, "[INFO] Client host listening on %s ...\n", listeningOn)
+	}
+	if flag.socksUdp {
+		fmt.Fprintln(cmd.InfoOutput, "[INFO] Client host relaying SOCKS UDP ASSOCIATE on a UDP port for each association ...")
+	}
+	// NOTE: --resume and --udp need piping-tunnel on both hosts
+	if !flag.Yamux && !flag.Pmux && !flag.Resume && !flag.udp {
+		if flag.SymmetricallyEncrypts || flag.IdentityPath != "" {
 			if opensslAesCtrParams != nil {
-				fmt.Println("[INFO] Hint: Server host. <PORT> should be replaced (nc + curl + openssl)")
-				fmt.Printf(
+				fmt.Fprintln(cmd.InfoOutput, "[INFO] Hint: Server host. <PORT> should be replaced (nc + curl + openssl)")
+				fmt.Fprintf(
+					cmd.InfoOutput,
 					"  read -p \"passphrase: \" -s pass && curl -sSN %s | stdbuf -i0 -o0 openssl aes-%d-ctr -d -pass \"pass:$pass\" -bufsize 1 -pbkdf2 -iter %d -md %s | nc 127.0.0.1 <YOUR PORT> | stdbuf -i0 -o0 openssl aes-%d-ctr -pass \"pass:$pass\" -bufsize 1 -pbkdf2 -iter %d -md %s | curl -sSNT - %s; unset pass\n",
 					clientToServerUrl,
 					opensslAesCtrParams.KeyBits,
@@ -182,178 +317,236 @@ func printHintForServerHost(ln net.Listener, clientToServerUrl string, serverToC
 				)
 			}
 		} else {
-			fmt.Println("[INFO] Hint: Server host (nc + curl)")
-			fmt.Printf("  curl -sSN %s | nc 127.0.0.1 <YOUR PORT> | curl -sSNT - %s\n", clientToServerUrl, serverToClientUrl)
+			fmt.Fprintln(cmd.InfoOutput, "[INFO] Hint: Server host (nc + curl)")
+			fmt.Fprintf(cmd.InfoOutput, "  curl -sSN %s | nc 127.0.0.1 <YOUR PORT> | curl -sSNT - %s\n", clientToServerUrl, serverToClientUrl)
 		}
 	}
-	fmt.Println("[INFO] Hint: Server host (piping-tunnel)")
-	flags := ""
-	if flag.symmetricallyEncrypts {
-		flags += fmt.Sprintf("-%s ", cmd.SymmetricallyEncryptsFlagShortName)
-		flags += fmt.Sprintf("--%s=%s ", cmd.CipherTypeFlagLongName, flag.cipherType)
-		switch flag.cipherType {
-		case piping_util.CipherTypeOpensslAes128Ctr:
-			fallthrough
-		case piping_util.CipherTypeOpensslAes256Ctr:
-			flags += fmt.Sprintf("--%s='%s' ", cmd.Pbkdf2FlagLongName, flag.pbkdf2JsonString)
+	fmt.Fprintln(cmd.InfoOutput, "[INFO] Hint: Server host (piping-tunnel)")
+	flags := flag.HintFlags()
+	if flag.udp {
+		flags += fmt.Sprintf("--%s ", cmd.UdpFlagLongName)
+	}
+	if flag.reverseSocks {
+		fmt.Fprintf(
+			cmd.InfoOutput,
+			"  piping-tunnel -s %s server -p 1080 --%s %s%s %s\n",
+			cmd.ServerUrl,
+			cmd.ReverseSocksFlagLongName,
+			flags,
+			clientToServerPath,
+			serverToClientPath,
+		)
+		return
+	}
+	if len(localForwards) != 0 {
+		routeFlags := ""
+		for _, forward := range localForwards {
+			routeFlags += fmt.Sprintf("--%s %s=<HOST>:<PORT> ", cmd.RouteFlagLongName, forward.Route)
 		}
+		fmt.Fprintf(
+			cmd.InfoOutput,
+			"  piping-tunnel -s %s server %s%s%s %s\n",
+			cmd.ServerUrl,
+			routeFlags,
+			flags,
+			clientToServerPath,
+			serverToClientPath,
+		)
+		return
 	}
-	if flag.yamux {
-		flags += fmt.Sprintf("--%s ", cmd.YamuxFlagLongName)
+	if flag.target != "" {
+		fmt.Fprintf(
+			cmd.InfoOutput,
+			"  piping-tunnel -s %s server --%s %s %s%s %s\n",
+			cmd.ServerUrl,
+			cmd.AllowFlagLongName,
+			flag.target,
+			flags,
+			clientToServerPath,
+			serverToClientPath,
+		)
+		return
 	}
-	if flag.pmux {
-		flags += fmt.Sprintf("--%s ", cmd.PmuxFlagLongName)
+	serverFlags := flags
+	// NOTE: socks does not have --loop
+	if flag.loop {
+		serverFlags += fmt.Sprintf("--%s ", cmd.LoopFlagLongName)
 	}
-	fmt.Printf(
+	fmt.Fprintf(
+		cmd.InfoOutput,
 		"  piping-tunnel -s %s server -p <YOUR PORT> %s%s %s\n",
 		cmd.ServerUrl,
-		flags,
+		serverFlags,
 		clientToServerPath,
 		serverToClientPath,
 	)
-	fmt.Println("    OR")
-	fmt.Printf(
+	// NOTE: socks and http-proxy do not forward UDP
+	if flag.udp {
+		return
+	}
+	fmt.Fprintln(cmd.InfoOutput, "    OR")
+	fmt.Fprintf(
+		cmd.InfoOutput,
 		"  piping-tunnel -s %s socks %s%s %s\n",
 		cmd.ServerUrl,
 		flags,
 		clientToServerPath,
 		serverToClientPath,
 	)
+	fmt.Fprintln(cmd.InfoOutput, "    OR")
+	fmt.Fprintf(
+		cmd.InfoOutput,
+		"  piping-tunnel -s %s http-proxy %s%s %s\n",
+		cmd.ServerUrl,
+		flags,
+		clientToServerPath,
+		serverToClientPath,
+	)
 }
 
-func clientHandleWithYamux(ln net.Listener, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string) error {
-	var duplex io.ReadWriteCloser
-	duplex, err := piping_util.DuplexConnectWithHandlers(
-		func(body io.Reader) (*http.Response, error) {
-			return piping_util.PipingSend(httpClient, cmd.HeadersWithYamux(headers), clientToServerUrl, body)
-		},
-		func() (*http.Response, error) {
-			res, err := piping_util.PipingGet(httpClient, headers, serverToClientUrl)
-			if err != nil {
-				return nil, err
-			}
-			contentType := res.Header.Get("Content-Type")
-			if contentType != cmd.YamuxMimeType {
-				fmt.Printf("[INFO] --%s flag may be missing in server-host\n", cmd.YamuxFlagLongName)
-			}
-			return res, nil
-		},
-	)
-	if err != nil {
-		return err
-	}
-	duplex, err = cmd.MakeDuplexWithEncryptionAndProgressIfNeed(duplex, flag.symmetricallyEncrypts, flag.symmetricallyEncryptPassphrase, flag.cipherType, flag.pbkdf2JsonString)
-	if err != nil {
-		return err
-	}
-	yamuxSession, err := yamux.Client(duplex, nil)
-	if err != nil {
-		return err
-	}
+func clientHandleWithYamux(ln net.Listener, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	// NOTE: The listener is kept open while the session is re-established
+	supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+		return flag.YamuxSession(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth, cmd.WarnYamuxContentType("server-host"), yamux.Client)
+	})
+	go supervisor.Run()
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			return err
 		}
-		yamuxStream, err := yamuxSession.Open()
-		if err != nil {
-			return err
-		}
-		fin := make(chan struct{})
-		go func() {
-			// TODO: hard code
-			var buf = make([]byte, 4096)
-			io.CopyBuffer(yamuxStream, conn, buf)
-			fin <- struct{}{}
-		}()
-		go func() {
-			// TODO: hard code
-			var buf = make([]byte, 4096)
-			io.CopyBuffer(conn, yamuxStream, buf)
-			fin <- struct{}{}
-		}()
 		go func() {
+			yamuxStream, err := supervisor.Open()
+			if err != nil {
+				cmd.Vlog.Log(
+					fmt.Sprintf("error(yamux open): %v", errors.WithStack(err)),
+					fmt.Sprintf("error(yamux open): %+v", errors.WithStack(err)),
+				)
+				conn.Close()
+				return
+			}
+			if err := writeRouteHeaderIfNeed(yamuxStream, conn); err != nil {
+				cmd.Vlog.Log(
+					fmt.Sprintf("error(route header): %v", errors.WithStack(err)),
+					fmt.Sprintf("error(route header): %+v", errors.WithStack(err)),
+				)
+				conn.Close()
+				yamuxStream.Close()
+				return
+			}
+			association, err := relaySocksHandshakeIfNeed(conn, yamuxStream, func() (io.ReadWriteCloser, error) {
+				return supervisor.Open()
+			})
+			if err != nil {
+				cmd.Vlog.Log(
+					fmt.Sprintf("error(socks handshake): %v", errors.WithStack(err)),
+					fmt.Sprintf("error(socks handshake): %+v", errors.WithStack(err)),
+				)
+				conn.Close()
+				yamuxStream.Close()
+				return
+			}
+			fin := make(chan struct{})
+			go func() {
+				// TODO: hard code
+				var buf = make([]byte, 4096)
+				io.CopyBuffer(yamuxStream, conn, buf)
+				fin <- struct{}{}
+			}()
+			go func() {
+				// TODO: hard code
+				var buf = make([]byte, 4096)
+				io.CopyBuffer(conn, yamuxStream, buf)
+				// NOTE: Notify the client of the stream closed by server host such as a failed dial
+				util.CloseWriteOrClose(conn)
+				fin <- struct{}{}
+			}()
+			done := make(chan struct{})
+			go func() {
+				select {
+				// NOTE: Streams of a dead session end without closing the connections
+				case <-yamuxStream.Session().CloseChan():
+					conn.Close()
+				case <-done:
+				}
+			}()
 			<-fin
 			<-fin
 			close(fin)
+			close(done)
 			conn.Close()
 			yamuxStream.Close()
+			if association != nil {
+				association.Close()
+			}
 		}()
 	}
 }
 
-func clientHandleWithPmux(ln net.Listener, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string) error {
-	var config cmd.ClientPmuxConfigJson
-	if json.Unmarshal([]byte(flag.pmuxConfig), &config) != nil {
-		return errors.Errorf("invalid pmux config format")
+// writeRouteHeaderIfNeed tells server host the route of a connection accepted for --forward or the destination of --target
+func writeRouteHeaderIfNeed(stream io.Writer, conn net.Conn) error {
+	if flag.target != "" {
+		return cmd.WriteRouteHeader(stream, flag.target)
 	}
-	pmuxClient, err := pmux.Client(httpClient, headers, clientToServerUrl, serverToClientUrl, config.Hb, flag.symmetricallyEncrypts, flag.symmetricallyEncryptPassphrase, flag.cipherType)
+	routedConn, ok := conn.(*cmd.RoutedConn)
+	if !ok {
+		return nil
+	}
+	return cmd.WriteRouteHeader(stream, routedConn.Route)
+}
+
+func clientHandleWithPmux(ln net.Listener, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	openPmuxStream, err := flag.PmuxOpener(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth, "server")
 	if err != nil {
-		if err == pmux.NonPmuxMimeTypeError {
-			return errors.Errorf("--%s may be missing in server", cmd.PmuxFlagLongName)
-		}
-		if err == pmux.IncompatiblePmuxVersion {
-			return errors.Errorf("%s, hint: use the same piping-tunnel version (current: %s)", err.Error(), version.Version)
-		}
-		if err == pmux.IncompatibleServerConfigError {
-			return errors.Errorf("%s, hint: use the same piping-tunnel version (current: %s)", err.Error(), version.Version)
-		}
 		return err
 	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			// NOTE: No more connections are accepted from the closed listener such as --stdio
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			cmd.Vlog.Log(
 				fmt.Sprintf("error(accept): %v", errors.WithStack(err)),
 				fmt.Sprintf("error(accept): %+v", errors.WithStack(err)),
 			)
 			continue
 		}
-		stream, err := pmuxClient.Open()
+		stream, err := openPmuxStream()
 		if err != nil {
 			cmd.Vlog.Log(
 				fmt.Sprintf("error(pmux open): %v", errors.WithStack(err)),
 				fmt.Sprintf("error(pmux open): %+v", errors.WithStack(err)),
 			)
+			conn.Close()
+			continue
+		}
+		if err := writeRouteHeaderIfNeed(stream, conn); err != nil {
+			cmd.Vlog.Log(
+				fmt.Sprintf("error(route header): %v", errors.WithStack(err)),
+				fmt.Sprintf("error(route header): %+v", errors.WithStack(err)),
+			)
+			conn.Close()
+			stream.Close()
 			continue
 		}
-		fin := make(chan struct{})
 		go func() {
-			// TODO: hard code
-			var buf = make([]byte, 4096)
-			_, err := io.CopyBuffer(conn, stream, buf)
-			fin <- struct{}{}
+			association, err := relaySocksHandshakeIfNeed(conn, stream, openPmuxStream)
 			if err != nil {
 				cmd.Vlog.Log(
-					fmt.Sprintf("error(pmux stream → conn): %v", errors.WithStack(err)),
-					fmt.Sprintf("error(pmux stream → conn): %+v", errors.WithStack(err)),
+					fmt.Sprintf("error(socks handshake): %v", errors.WithStack(err)),
+					fmt.Sprintf("error(socks handshake): %+v", errors.WithStack(err)),
 				)
+				conn.Close()
+				stream.Close()
 				return
 			}
-		}()
-
-		go func() {
-			// TODO: hard code
-			var buf = make([]byte, 4096)
-			_, err := io.CopyBuffer(stream, conn, buf)
-			fin <- struct{}{}
-			if err != nil {
-				cmd.Vlog.Log(
-					fmt.Sprintf("error(conn → pmux stream): %v", errors.WithStack(err)),
-					fmt.Sprintf("error(conn → pmux stream): %+v", errors.WithStack(err)),
-				)
-				return
+			cmd.RelayPmuxStream(conn, stream)
+			if association != nil {
+				association.Close()
 			}
 		}()
-
-		go func() {
-			<-fin
-			<-fin
-			conn.Close()
-			stream.Close()
-			close(fin)
-		}()
 	}
-	return nil
 }
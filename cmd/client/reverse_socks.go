@@ -0,0 +1,59 @@
+package client
+
+import (
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/nwtgck/go-piping-tunnel/socks_proxy"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+)
+
+func serveSocksStream(socksServer *socks_proxy.Server, conn net.Conn) {
+	err := socksServer.ServeConn(conn)
+	if err != nil {
+		cmd.Vlog.Log(
+			fmt.Sprintf("error(serve conn): %v", errors.WithStack(err)),
+			fmt.Sprintf("error(serve conn): %+v", errors.WithStack(err)),
+		)
+	}
+}
+
+// clientHandleReverseSocks serves SOCKS for streams opened by server host with --reverse-socks
+func clientHandleReverseSocks(socksServer *socks_proxy.Server, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	if flag.Yamux {
+		fmt.Println("[INFO] Multiplexing with hashicorp/yamux")
+		supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+			// NOTE: Client host is the yamux server because server host opens streams
+			return flag.YamuxSession(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth, cmd.WarnYamuxContentType("server-host"), yamux.Server)
+		})
+		go supervisor.Run()
+		for {
+			yamuxStream, err := supervisor.Accept()
+			if err != nil {
+				return err
+			}
+			go serveSocksStream(socksServer, yamuxStream)
+		}
+	}
+	fmt.Println("[INFO] Multiplexing with pmux")
+	acceptPmuxStream, err := flag.PmuxAccepter(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+	if err != nil {
+		return err
+	}
+	for {
+		stream, err := acceptPmuxStream()
+		if err != nil {
+			cmd.Vlog.Log(
+				fmt.Sprintf("error(pmux accept): %v", errors.WithStack(err)),
+				fmt.Sprintf("error(pmux accept): %+v", errors.WithStack(err)),
+			)
+			continue
+		}
+		go serveSocksStream(socksServer, util.NewDuplexConn(stream))
+	}
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/backoff"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/nwtgck/go-piping-tunnel/socks_proxy"
+	"github.com/nwtgck/go-piping-tunnel/udp_tunnel"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// NOTE: UDP has no end of connection, so the tunnel is always opened again
+func relayUdpLoop(pc net.PacketConn, open func() (io.ReadWriteCloser, error)) error {
+	b := backoff.NewExponentialBackoff()
+	for {
+		duplex, err := open()
+		if err != nil {
+			fmt.Printf("[WARN] %s\n", err)
+			// backoff
+			time.Sleep(b.NextDuration())
+			continue
+		}
+		b.Reset()
+		fmt.Println("[INFO] UDP tunnel connected")
+		err = udp_tunnel.Client(pc, duplex, flag.udpIdleTimeout)
+		fmt.Printf("[WARN] UDP tunnel disconnected: %s\n", err)
+	}
+}
+
+// relaySocksHandshakeIfNeed relays the SOCKS5 handshake for --socks-udp, where the returned association is closed after the connection
+func relaySocksHandshakeIfNeed(conn net.Conn, stream io.ReadWriter, open func() (io.ReadWriteCloser, error)) (io.Closer, error) {
+	if !flag.socksUdp {
+		return nil, nil
+	}
+	return socks_proxy.RelayHandshake(conn, stream, open, flag.udpIdleTimeout)
+}
+
+func clientHandleUdp(pc net.PacketConn, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	return relayUdpLoop(pc, func() (io.ReadWriteCloser, error) {
+		return flag.DuplexConnect(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+	})
+}
+
+func clientHandleUdpWithYamux(pc net.PacketConn, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+		return flag.YamuxSession(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth, cmd.WarnYamuxContentType("server-host"), yamux.Client)
+	})
+	go supervisor.Run()
+	return relayUdpLoop(pc, func() (io.ReadWriteCloser, error) {
+		return supervisor.Open()
+	})
+}
+
+func clientHandleUdpWithPmux(pc net.PacketConn, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	openPmuxStream, err := flag.PmuxOpener(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth, "server")
+	if err != nil {
+		return err
+	}
+	return relayUdpLoop(pc, openPmuxStream)
+}
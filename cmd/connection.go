@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pmux"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/nwtgck/go-piping-tunnel/version"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// ConnectionFlags are flags of encryption, resumption and multiplexing shared by commands
+type ConnectionFlags struct {
+	Yamux                          bool
+	Pmux                           bool
+	PmuxConfig                     string
+	SymmetricallyEncrypts          bool
+	SymmetricallyEncryptPassphrase string
+	CipherType                     string
+	Pbkdf2JsonString               string
+	IdentityPath                   string
+	AuthorizedKeysPath             string
+	PeerKeyPath                    string
+	Resume                         bool
+	// Routes is set by the command, not a flag, when streams start with route headers
+	Routes bool
+}
+
+// AddEncryptionFlags adds flags of encryption, public-key authentication and --resume
+func (f *ConnectionFlags) AddEncryptionFlags(flags *pflag.FlagSet) {
+	flags.BoolVarP(&f.SymmetricallyEncrypts, SymmetricallyEncryptsFlagLongName, SymmetricallyEncryptsFlagShortName, false, "Encrypt symmetrically")
+	flags.StringVarP(&f.SymmetricallyEncryptPassphrase, SymmetricallyEncryptPassphraseFlagLongName, "", "", "Passphrase for encryption")
+	flags.StringVarP(&f.CipherType, CipherTypeFlagLongName, "", DefaultCipherType, fmt.Sprintf("Cipher type: %s, %s, %s, %s, %s, %s, %s, %s ", piping_util.CipherTypeAesCtr, piping_util.CipherTypeOpensslAes128Ctr, piping_util.CipherTypeOpensslAes256Ctr, piping_util.CipherTypeOpenpgp, piping_util.CipherTypeAes256Gcm, piping_util.CipherTypeChacha20Poly1305, piping_util.CipherTypeCpaceAes256Gcm, piping_util.CipherTypeCpaceChacha20Poly1305))
+	// NOTE: default value of --pbkdf2 should be empty to detect key derive derivation from multiple algorithms in the future.
+	flags.StringVarP(&f.Pbkdf2JsonString, Pbkdf2FlagLongName, "", "", fmt.Sprintf("e.g. %s", ExamplePbkdf2JsonStr()))
+	flags.StringVarP(&f.IdentityPath, IdentityFlagLongName, "", "", "Private key file for public-key authentication such as ~/.ssh/id_ed25519")
+	flags.StringVarP(&f.AuthorizedKeysPath, AuthorizedKeysFlagLongName, "", "", "File of public keys allowed to connect, in the format of authorized_keys")
+	flags.StringVarP(&f.PeerKeyPath, PeerKeyFlagLongName, "", "", "Public key file of the peer such as id_ed25519.pub")
+	flags.BoolVarP(&f.Resume, ResumeFlagLongName, "", false, "Resume the connection on new requests after HTTP requests break (both hosts need this flag)")
+}
+
+// AddMultiplexerFlags adds --yamux, --pmux and --pmux-config
+func (f *ConnectionFlags) AddMultiplexerFlags(flags *pflag.FlagSet) {
+	flags.BoolVarP(&f.Yamux, YamuxFlagLongName, "", false, "Multiplex connection by hashicorp/yamux")
+	flags.BoolVarP(&f.Pmux, PmuxFlagLongName, "", false, "Multiplex connection by pmux (experimental)")
+	flags.StringVarP(&f.PmuxConfig, PmuxConfigFlagLongName, "", `{"hb": true}`, "pmux config in JSON (experimental), where \"compressions\" with encryption may leak secrets by the sizes of data (CRIME/BREACH)")
+}
+
+// Validate validates the cipher type and the combination of the flags
+func (f *ConnectionFlags) Validate() error {
+	if f.SymmetricallyEncrypts {
+		if err := ValidateClientCipher(f.CipherType); err != nil {
+			return err
+		}
+	}
+	if f.SymmetricallyEncrypts && f.IdentityPath != "" {
+		return errors.Errorf("--%s and --%s cannot be used together", SymmetricallyEncryptsFlagLongName, IdentityFlagLongName)
+	}
+	return nil
+}
+
+// ValidateAuthenticatedEncryption validates that the connection is authenticated and tamper-proof
+// NOTE: AES-CTR and OpenPGP with a passphrase do not detect modified or injected data
+func (f *ConnectionFlags) ValidateAuthenticatedEncryption() error {
+	if f.IdentityPath != "" {
+		return nil
+	}
+	if !f.SymmetricallyEncrypts {
+		return errors.Errorf("--%s or --%s is required", SymmetricallyEncryptsFlagLongName, IdentityFlagLongName)
+	}
+	switch f.CipherType {
+	case piping_util.CipherTypeAes256Gcm, piping_util.CipherTypeChacha20Poly1305, piping_util.CipherTypeCpaceAes256Gcm, piping_util.CipherTypeCpaceChacha20Poly1305:
+		return nil
+	}
+	return errors.Errorf("--%s=%s does not detect tampering, use %s, %s, %s, %s or --%s", CipherTypeFlagLongName, f.CipherType, piping_util.CipherTypeAes256Gcm, piping_util.CipherTypeChacha20Poly1305, piping_util.CipherTypeCpaceAes256Gcm, piping_util.CipherTypeCpaceChacha20Poly1305, IdentityFlagLongName)
+}
+
+// ValidateMultiplexer validates that a multiplexer is specified
+func (f *ConnectionFlags) ValidateMultiplexer() error {
+	if !f.Yamux && !f.Pmux {
+		return errors.Errorf("--%s or --%s must be specified", YamuxFlagLongName, PmuxFlagLongName)
+	}
+	return nil
+}
+
+// PublicKeyAuth returns nil when public-key authentication is not used
+func (f *ConnectionFlags) PublicKeyAuth() (*pubkey_duplex.Config, error) {
+	return ParsePublicKeyAuth(f.IdentityPath, f.AuthorizedKeysPath, f.PeerKeyPath)
+}
+
+// InputPassphraseIfNeed makes user input the passphrase if it is empty in symmetric encryption
+func (f *ConnectionFlags) InputPassphraseIfNeed() error {
+	if !f.SymmetricallyEncrypts {
+		return nil
+	}
+	return MakeUserInputPassphraseIfEmpty(&f.SymmetricallyEncryptPassphrase)
+}
+
+// HintFlags returns the flags which the peer needs in command hints
+func (f *ConnectionFlags) HintFlags() string {
+	flags := ""
+	if f.SymmetricallyEncrypts {
+		flags += fmt.Sprintf("-%s ", SymmetricallyEncryptsFlagShortName)
+		flags += fmt.Sprintf("--%s=%s ", CipherTypeFlagLongName, f.CipherType)
+		switch f.CipherType {
+		case piping_util.CipherTypeOpensslAes128Ctr:
+			fallthrough
+		case piping_util.CipherTypeOpensslAes256Ctr:
+			flags += fmt.Sprintf("--%s='%s' ", Pbkdf2FlagLongName, f.Pbkdf2JsonString)
+		case piping_util.CipherTypeAes256Gcm, piping_util.CipherTypeChacha20Poly1305:
+			// NOTE: --pbkdf2 is optional for AEAD ciphers
+			if f.Pbkdf2JsonString != "" {
+				flags += fmt.Sprintf("--%s='%s' ", Pbkdf2FlagLongName, f.Pbkdf2JsonString)
+			}
+		}
+	}
+	if f.IdentityPath != "" {
+		flags += fmt.Sprintf("--%s=<PRIVATE KEY> --%s=<PUBLIC KEY OF THIS HOST> ", IdentityFlagLongName, PeerKeyFlagLongName)
+	}
+	if f.Resume {
+		flags += fmt.Sprintf("--%s ", ResumeFlagLongName)
+	}
+	if f.Yamux {
+		flags += fmt.Sprintf("--%s ", YamuxFlagLongName)
+	}
+	if f.Pmux {
+		flags += fmt.Sprintf("--%s ", PmuxFlagLongName)
+	}
+	return flags
+}
+
+// NewHttpClient creates an HTTP client for Piping Server by the global flags
+func NewHttpClient() *http.Client {
+	httpClient := util.CreateHttpClient(Insecure, HttpWriteBufSize, HttpReadBufSize)
+	if DnsServer != "" {
+		// Set DNS resolver
+		httpClient.Transport.(*http.Transport).DialContext = util.CreateDialContext(DnsServer)
+	}
+	return httpClient
+}
+
+// DuplexConnect connects the duplex without multiplexing, encrypted and resumed by the flags
+func (f *ConnectionFlags) DuplexConnect(httpClient *http.Client, headers []piping_util.KeyValue, uploadUrl string, downloadUrl string, publicKeyAuth *pubkey_duplex.Config) (io.ReadWriteCloser, error) {
+	pipingDuplex, err := MakeDuplexWithResumeIfNeed(f.Resume, uploadUrl, downloadUrl, func(uploadUrl string, downloadUrl string) (io.ReadWriteCloser, error) {
+		return piping_util.DuplexConnect(httpClient, headers, uploadUrl, downloadUrl)
+	})
+	if err != nil {
+		return nil, err
+	}
+	duplex, err := MakeDuplexWithEncryptionAndProgressIfNeed(pipingDuplex, f.SymmetricallyEncrypts, f.SymmetricallyEncryptPassphrase, f.CipherType, f.Pbkdf2JsonString, publicKeyAuth)
+	if err != nil {
+		pipingDuplex.Close()
+		return nil, err
+	}
+	return duplex, nil
+}
+
+// YamuxSession establishes a session, where checkContentType checks Content-Type of the peer and newSession is yamux.Client or yamux.Server as the role of this host
+func (f *ConnectionFlags) YamuxSession(httpClient *http.Client, headers []piping_util.KeyValue, uploadUrl string, downloadUrl string, publicKeyAuth *pubkey_duplex.Config, checkContentType func(contentType string) error, newSession func(io.ReadWriteCloser, *yamux.Config) (*yamux.Session, error)) (*yamux.Session, error) {
+	pipingDuplex, err := MakeDuplexWithResumeIfNeed(f.Resume, uploadUrl, downloadUrl, func(uploadUrl string, downloadUrl string) (io.ReadWriteCloser, error) {
+		return piping_util.DuplexConnectWithHandlers(
+			func(body io.Reader) (*http.Response, error) {
+				return piping_util.PipingSend(httpClient, HeadersWithYamux(headers, f.Routes), uploadUrl, body)
+			},
+			func() (*http.Response, error) {
+				res, err := piping_util.PipingGet(httpClient, headers, downloadUrl)
+				if err != nil {
+					return nil, err
+				}
+				contentType := res.Header.Get("Content-Type")
+				if err := checkContentType(contentType); err != nil {
+					res.Body.Close()
+					return nil, err
+				}
+				if err := checkYamuxRoutes(f.Routes, contentType); err != nil {
+					res.Body.Close()
+					return nil, err
+				}
+				return res, nil
+			},
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	duplex, err := MakeDuplexWithEncryptionAndProgressIfNeed(pipingDuplex, f.SymmetricallyEncrypts, f.SymmetricallyEncryptPassphrase, f.CipherType, f.Pbkdf2JsonString, publicKeyAuth)
+	if err != nil {
+		// NOTE: Closing releases the paths for the next session
+		pipingDuplex.Close()
+		return nil, err
+	}
+	return newSession(duplex, nil)
+}
+
+// WarnYamuxContentType warns that --yamux may be missing in the peer such as "server-host"
+func WarnYamuxContentType(peer string) func(contentType string) error {
+	return func(contentType string) error {
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != YamuxMimeType {
+			fmt.Fprintf(InfoOutput, "[WARN] --%s flag may be missing in %s\n", YamuxFlagLongName, peer)
+		}
+		return nil
+	}
+}
+
+// RequireYamuxContentType rejects the peer without --yamux
+func RequireYamuxContentType(contentType string) error {
+	// NOTE: application/octet-stream is for compatibility
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != YamuxMimeType && mediaType != "application/octet-stream" {
+		return errors.Errorf("invalid content-type: %s", contentType)
+	}
+	return nil
+}
+
+// checkYamuxRoutes fails when only one side uses route headers, which are advertised in Content-Type of yamux
+// NOTE: Older versions do not advertise routes, which do not support route headers
+func checkYamuxRoutes(routes bool, contentType string) error {
+	_, params, _ := mime.ParseMediaType(contentType)
+	peerRoutes := params[yamuxRoutesParam] == "1"
+	if routes == peerRoutes {
+		return nil
+	}
+	return errors.Errorf("route headers are used only in one side (this host: %t, peer: %t), hint: --%s or --%s in server host needs --%s or --%s in client host", routes, peerRoutes, RouteFlagLongName, AllowFlagLongName, LocalForwardFlagLongName, TargetFlagLongName)
+}
+
+// pmuxConfig builds the config of pmux by --pmux-config and the flags
+func (f *ConnectionFlags) pmuxConfig(httpClient *http.Client, headers []piping_util.KeyValue, uploadUrl string, downloadUrl string, publicKeyAuth *pubkey_duplex.Config) (*pmux.Config, error) {
+	var configJson PmuxConfigJson
+	if json.Unmarshal([]byte(f.PmuxConfig), &configJson) != nil {
+		return nil, errors.Errorf("invalid pmux config format")
+	}
+	capabilities, err := configJson.Capabilities()
+	if err != nil {
+		return nil, err
+	}
+	capabilities.Routes = f.Routes
+	// NOTE: Sizes of compressed data tell an eavesdropper how much secrets and data controlled by an attacker have in common
+	if len(capabilities.Compressions) != 0 && (f.SymmetricallyEncrypts || publicKeyAuth != nil) {
+		fmt.Fprintf(InfoOutput, "[WARN] \"compressions\" of --%s with encryption may leak secrets by the sizes of data (CRIME/BREACH), compress only data without secrets\n", PmuxConfigFlagLongName)
+	}
+	config := &pmux.Config{
+		HttpClient:        httpClient,
+		Headers:           headers,
+		BaseUploadUrl:     uploadUrl,
+		BaseDownloadUrl:   downloadUrl,
+		EnableHb:          configJson.Hb,
+		EnableResume:      f.Resume,
+		Encrypts:          f.SymmetricallyEncrypts,
+		Passphrase:        f.SymmetricallyEncryptPassphrase,
+		CipherType:        f.CipherType,
+		PublicKeyAuth:     publicKeyAuth,
+		Capabilities:      capabilities,
+		AcceptConcurrency: configJson.AcceptConcurrency(),
+		NumSessions:       configJson.NumSessions(),
+		StreamPoolSize:    configJson.Pool,
+	}
+	if f.SymmetricallyEncrypts {
+		params, err := ParseOpensslAesCtrParams(f.CipherType, f.Pbkdf2JsonString)
+		if err != nil {
+			return nil, err
+		}
+		if params != nil {
+			config.Pbkdf2 = &pmux.Pbkdf2{Iter: params.Pbkdf2.Iter, Hash: params.Pbkdf2.Hash, HashName: params.Pbkdf2.HashNameForCommandHint}
+		}
+		// NOTE: pmux uses the default of AEAD ciphers without --pbkdf2
+		isAead := f.CipherType == piping_util.CipherTypeAes256Gcm || f.CipherType == piping_util.CipherTypeChacha20Poly1305
+		if isAead && f.Pbkdf2JsonString != "" {
+			pbkdf2, err := ParsePbkdf2(f.Pbkdf2JsonString)
+			if err != nil {
+				return nil, err
+			}
+			config.Pbkdf2 = &pmux.Pbkdf2{Iter: pbkdf2.Iter, Hash: pbkdf2.Hash, HashName: pbkdf2.HashNameForCommandHint}
+		}
+	}
+	return config, nil
+}
+
+// PmuxAccepter returns Accept() of a new pmux server
+func (f *ConnectionFlags) PmuxAccepter(httpClient *http.Client, headers []piping_util.KeyValue, uploadUrl string, downloadUrl string, publicKeyAuth *pubkey_duplex.Config) (func() (io.ReadWriteCloser, error), error) {
+	config, err := f.pmuxConfig(httpClient, headers, uploadUrl, downloadUrl, publicKeyAuth)
+	if err != nil {
+		return nil, err
+	}
+	return pmux.Server(config).Accept, nil
+}
+
+// PmuxOpener returns Open() of a new pmux client, where peer such as "server" is used in the hint of errors
+func (f *ConnectionFlags) PmuxOpener(httpClient *http.Client, headers []piping_util.KeyValue, uploadUrl string, downloadUrl string, publicKeyAuth *pubkey_duplex.Config, peer string) (func() (io.ReadWriteCloser, error), error) {
+	config, err := f.pmuxConfig(httpClient, headers, uploadUrl, downloadUrl, publicKeyAuth)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE: Streams over sessions are opened without waiting for the server, so the pool is only a fallback for servers without sessions
+	if config.StreamPoolSize > 0 && config.NumSessions > 0 {
+		fmt.Fprintf(InfoOutput, "[WARN] \"pool\" of --%s is used only with \"sessions\": 0 or a server without sessions\n", PmuxConfigFlagLongName)
+	}
+	pmuxClient, err := pmux.Client(config)
+	if err != nil {
+		if err == pmux.NonPmuxMimeTypeError {
+			return nil, errors.Errorf("--%s may be missing in %s", PmuxFlagLongName, peer)
+		}
+		if errors.Is(err, pmux.IncompatiblePmuxVersion) || err == pmux.IncompatibleServerConfigError {
+			return nil, errors.Errorf("%s, hint: use the same piping-tunnel version (current: %s)", err.Error(), version.Version)
+		}
+		return nil, err
+	}
+	return pmuxClient.Open, nil
+}
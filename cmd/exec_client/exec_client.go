@@ -0,0 +1,129 @@
+package exec_client
+
+import (
+	"github.com/mattn/go-isatty"
+	"github.com/mattn/go-tty"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/exec_tunnel"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+const TtyFlagLongName = "tty"
+const TtyFlagShortName = "t"
+
+var flag struct {
+	cmd.ConnectionFlags
+	tty bool
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(execCmd)
+	cmd.RootCmd.AddCommand(shellCmd)
+	execCmd.Flags().BoolVarP(&flag.tty, TtyFlagLongName, TtyFlagShortName, false, "Run the command with PTY")
+	flag.ConnectionFlags.AddEncryptionFlags(execCmd.Flags())
+	flag.ConnectionFlags.AddEncryptionFlags(shellCmd.Flags())
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] <PATH> [PATH] -- <COMMAND> [ARG...]",
+	Short: "Run a command on server host of exec-server",
+	RunE: func(c *cobra.Command, args []string) error {
+		dashIdx := c.ArgsLenAtDash()
+		if dashIdx < 0 || dashIdx == len(args) {
+			return errors.Errorf("command should be specified after --")
+		}
+		return run(args[:dashIdx], args[dashIdx:], flag.tty)
+	},
+}
+
+var shellCmd = &cobra.Command{
+	Use:   "shell [flags] <PATH> [PATH]",
+	Short: "Run an interactive shell on server host of exec-server",
+	RunE: func(_ *cobra.Command, args []string) error {
+		// NOTE: Like ssh, PTY is used only when stdin is a terminal
+		return run(args, nil, isatty.IsTerminal(os.Stdin.Fd()))
+	},
+}
+
+func run(pathArgs []string, command []string, usesPty bool) error {
+	// NOTE: stdout is used for the output of the command
+	cmd.InfoOutput = os.Stderr
+	cmd.ShowProgress = false
+	if err := flag.Validate(); err != nil {
+		return err
+	}
+	// NOTE: Commands and their input should not be tampered with
+	if err := flag.ValidateAuthenticatedEncryption(); err != nil {
+		return err
+	}
+	publicKeyAuth, err := flag.PublicKeyAuth()
+	if err != nil {
+		return err
+	}
+	clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(pathArgs)
+	if err != nil {
+		return err
+	}
+	headers, err := piping_util.ParseKeyValueStrings(cmd.HeaderKeyValueStrs)
+	if err != nil {
+		return err
+	}
+	httpClient := cmd.NewHttpClient()
+	clientToServerUrl, err := util.UrlJoin(cmd.ServerUrl, clientToServerPath)
+	if err != nil {
+		return err
+	}
+	serverToClientUrl, err := util.UrlJoin(cmd.ServerUrl, serverToClientPath)
+	if err != nil {
+		return err
+	}
+	// Make user input passphrase if it is empty
+	if err := flag.InputPassphraseIfNeed(); err != nil {
+		return err
+	}
+	duplex, err := flag.DuplexConnect(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+	if err != nil {
+		return err
+	}
+	exitCode, err := runRequest(duplex, &exec_tunnel.Request{Command: command, Pty: usesPty})
+	duplex.Close()
+	if err != nil {
+		return err
+	}
+	os.Exit(exitCode)
+	return nil
+}
+
+// runRequest runs the request with stdio, where the terminal is raw while PTY is used
+func runRequest(duplex io.ReadWriter, req *exec_tunnel.Request) (int, error) {
+	if !req.Pty {
+		return exec_tunnel.Run(duplex, req, os.Stdin, os.Stdout, os.Stderr, nil)
+	}
+	req.Term = os.Getenv("TERM")
+	t, err := tty.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer t.Close()
+	restore, err := t.Raw()
+	if err != nil {
+		return 0, err
+	}
+	defer restore()
+	if width, height, err := t.Size(); err == nil {
+		req.Rows = uint16(height)
+		req.Cols = uint16(width)
+	}
+	resizeCh := make(chan exec_tunnel.WindowSize)
+	go func() {
+		for size := range t.SIGWINCH() {
+			resizeCh <- exec_tunnel.WindowSize{Rows: uint16(size.H), Cols: uint16(size.W)}
+		}
+	}()
+	return exec_tunnel.Run(duplex, req, os.Stdin, os.Stdout, os.Stderr, resizeCh)
+}
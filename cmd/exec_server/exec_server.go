@@ -0,0 +1,114 @@
+package exec_server
+
+import (
+	"fmt"
+	"github.com/nwtgck/go-piping-tunnel/backoff"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/exec_tunnel"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+var flag struct {
+	cmd.ConnectionFlags
+	shell string
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(execServerCmd)
+	execServerCmd.Flags().StringVarP(&flag.shell, "shell", "", "", "Shell running commands (default: $SHELL or /bin/sh)")
+	flag.ConnectionFlags.AddEncryptionFlags(execServerCmd.Flags())
+}
+
+var execServerCmd = &cobra.Command{
+	Use:   "exec-server",
+	Short: "Run commands requested by exec or shell of client host",
+	RunE: func(_ *cobra.Command, args []string) error {
+		if err := flag.Validate(); err != nil {
+			return err
+		}
+		// NOTE: Anyone knowing the paths could run commands without authenticated encryption
+		if err := flag.ValidateAuthenticatedEncryption(); err != nil {
+			return errors.Wrap(err, "exec-server")
+		}
+		if flag.shell == "" {
+			flag.shell = os.Getenv("SHELL")
+		}
+		if flag.shell == "" {
+			flag.shell = "/bin/sh"
+		}
+		publicKeyAuth, err := flag.PublicKeyAuth()
+		if err != nil {
+			return err
+		}
+		clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(args)
+		if err != nil {
+			return err
+		}
+		headers, err := piping_util.ParseKeyValueStrings(cmd.HeaderKeyValueStrs)
+		if err != nil {
+			return err
+		}
+		httpClient := cmd.NewHttpClient()
+		serverToClientUrl, err := util.UrlJoin(cmd.ServerUrl, serverToClientPath)
+		if err != nil {
+			return err
+		}
+		clientToServerUrl, err := util.UrlJoin(cmd.ServerUrl, clientToServerPath)
+		if err != nil {
+			return err
+		}
+		// Print hint
+		execServerPrintHintForClientHost(clientToServerPath, serverToClientPath)
+		// Make user input passphrase if it is empty
+		if err := flag.InputPassphraseIfNeed(); err != nil {
+			return err
+		}
+		// NOTE: Sessions are served one by one because a session uses the paths
+		b := backoff.NewExponentialBackoff()
+		for {
+			duplex, err := flag.DuplexConnect(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth)
+			if err != nil {
+				fmt.Printf("[WARN] %s\n", err)
+				// backoff
+				time.Sleep(b.NextDuration())
+				continue
+			}
+			b.Reset()
+			fmt.Println("[INFO] Session started")
+			err = exec_tunnel.Serve(duplex, flag.shell)
+			duplex.Close()
+			if err != nil {
+				cmd.Vlog.Log(
+					fmt.Sprintf("error(exec): %v", errors.WithStack(err)),
+					fmt.Sprintf("error(exec): %+v", errors.WithStack(err)),
+				)
+			}
+			fmt.Println("[INFO] Session finished")
+		}
+	},
+}
+
+func execServerPrintHintForClientHost(clientToServerPath string, serverToClientPath string) {
+	flags := flag.HintFlags()
+	fmt.Println("[INFO] Hint: Client host (piping-tunnel)")
+	fmt.Printf(
+		"  piping-tunnel -s %s shell %s%s %s\n",
+		cmd.ServerUrl,
+		flags,
+		clientToServerPath,
+		serverToClientPath,
+	)
+	fmt.Println("    OR")
+	fmt.Printf(
+		"  piping-tunnel -s %s exec %s%s %s -- <COMMAND>\n",
+		cmd.ServerUrl,
+		flags,
+		clientToServerPath,
+		serverToClientPath,
+	)
+}
@@ -0,0 +1,142 @@
+package http_proxy
+
+import (
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/http_proxy"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"net"
+	"net/http"
+)
+
+var flag struct {
+	cmd.ConnectionFlags
+	cmd.DestinationRuleFlags
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(httpProxyCmd)
+	flag.ConnectionFlags.AddMultiplexerFlags(httpProxyCmd.Flags())
+	flag.ConnectionFlags.AddEncryptionFlags(httpProxyCmd.Flags())
+	flag.DestinationRuleFlags.AddDestinationRuleFlags(httpProxyCmd.Flags())
+}
+
+var httpProxyCmd = &cobra.Command{
+	Use:   "http-proxy",
+	Short: "Run HTTP proxy server",
+	RunE: func(_ *cobra.Command, args []string) error {
+		if err := flag.Validate(); err != nil {
+			return err
+		}
+		rules, err := flag.DestinationRules()
+		if err != nil {
+			return err
+		}
+		publicKeyAuth, err := flag.PublicKeyAuth()
+		if err != nil {
+			return err
+		}
+		clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(args)
+		if err != nil {
+			return err
+		}
+		headers, err := piping_util.ParseKeyValueStrings(cmd.HeaderKeyValueStrs)
+		if err != nil {
+			return err
+		}
+		httpClient := cmd.NewHttpClient()
+		serverToClientUrl, err := util.UrlJoin(cmd.ServerUrl, serverToClientPath)
+		if err != nil {
+			return err
+		}
+		clientToServerUrl, err := util.UrlJoin(cmd.ServerUrl, clientToServerPath)
+		if err != nil {
+			return err
+		}
+		// Print hint
+		httpProxyPrintHintForClientHost(clientToServerPath, serverToClientPath)
+		// Make user input passphrase if it is empty
+		if err := flag.InputPassphraseIfNeed(); err != nil {
+			return err
+		}
+
+		// If not using multiplexer
+		if err := flag.ValidateMultiplexer(); err != nil {
+			return err
+		}
+
+		proxyServer := http_proxy.NewWithRules(rules)
+
+		// If yamux is enabled
+		if flag.Yamux {
+			fmt.Println("[INFO] Multiplexing with hashicorp/yamux")
+			return httpProxyHandleWithYamux(proxyServer, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+		}
+
+		// If pmux is enabled
+		fmt.Println("[INFO] Multiplexing with pmux")
+		return httpProxyHandleWithPmux(proxyServer, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+	},
+}
+
+func serveStream(proxyServer *http_proxy.Server, conn net.Conn) {
+	err := proxyServer.ServeConn(conn)
+	if err != nil {
+		cmd.Vlog.Log(
+			fmt.Sprintf("error(serve conn): %v", errors.WithStack(err)),
+			fmt.Sprintf("error(serve conn): %+v", errors.WithStack(err)),
+		)
+	}
+}
+
+// NOTE: multiplexing should be enabled, so there is no socat-curl hint
+func httpProxyPrintHintForClientHost(clientToServerPath string, serverToClientPath string) {
+	flags := flag.HintFlags()
+	fmt.Println("[INFO] Hint: Client host (piping-tunnel)")
+	fmt.Printf(
+		"  piping-tunnel -s %s client -p 8080 %s%s %s\n",
+		cmd.ServerUrl,
+		flags,
+		clientToServerPath,
+		serverToClientPath,
+	)
+	fmt.Println("[INFO] Hint: Proxy settings in client host")
+	fmt.Println("  export HTTP_PROXY=http://localhost:8080 HTTPS_PROXY=http://localhost:8080")
+}
+
+func httpProxyHandleWithYamux(proxyServer *http_proxy.Server, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+		return flag.YamuxSession(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth, cmd.RequireYamuxContentType, yamux.Server)
+	})
+	go supervisor.Run()
+	for {
+		yamuxStream, err := supervisor.Accept()
+		if err != nil {
+			return err
+		}
+		go serveStream(proxyServer, yamuxStream)
+	}
+}
+
+func httpProxyHandleWithPmux(proxyServer *http_proxy.Server, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	acceptPmuxStream, err := flag.PmuxAccepter(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth)
+	if err != nil {
+		return err
+	}
+	for {
+		stream, err := acceptPmuxStream()
+		if err != nil {
+			cmd.Vlog.Log(
+				fmt.Sprintf("error(pmux accept): %v", errors.WithStack(err)),
+				fmt.Sprintf("error(pmux accept): %+v", errors.WithStack(err)),
+			)
+			continue
+		}
+		go serveStream(proxyServer, util.NewDuplexConn(stream))
+	}
+}
@@ -57,10 +57,47 @@ Multiplexing:
   piping-tunnel server -p 22 --yamux aaa bbb
   piping-tunnel client -p 1022 --yamux aaa bbb
 
+Multiple ports on one tunnel:
+  piping-tunnel server --route ssh=localhost:22 --route web=localhost:80 --yamux aaa bbb
+  piping-tunnel client -L 1022:ssh -L 8080:web --yamux aaa bbb
+
+Destination chosen by client host:
+  piping-tunnel server --allow 10.0.0.0/8 --allow '*.internal:5432' --yamux aaa bbb
+  piping-tunnel client -p 5432 --target db.internal:5432 --yamux aaa bbb
+
 SOCKS proxy like VPN:
   piping-tunnel socks --yamux aaa bbb
   piping-tunnel client -p 1080 --yamux aaa bbb
 
+SOCKS proxy limiting destinations:
+  piping-tunnel socks --allow 10.0.0.0/8 --deny 169.254.169.254 --yamux aaa bbb
+  piping-tunnel client -p 1080 --yamux aaa bbb
+
+Reverse SOCKS proxy (through the network of client host):
+  piping-tunnel server -p 1080 --reverse-socks --yamux aaa bbb
+  piping-tunnel client --reverse-socks --yamux aaa bbb
+
+HTTP proxy:
+  piping-tunnel http-proxy --yamux aaa bbb
+  piping-tunnel client -p 8080 --yamux aaa bbb
+
+VPN (Linux):
+  piping-tunnel vpn --address 10.8.0.1/24 --yamux aaa bbb
+  piping-tunnel vpn --client --address 10.8.0.2/24 --yamux aaa bbb
+
+ProxyCommand of ssh (client host):
+  piping-tunnel server -p 22 aaa bbb
+  ssh -o ProxyCommand='piping-tunnel client --stdio aaa bbb' user@dummy
+
+Remote shell and command:
+  piping-tunnel exec-server -c --cipher-type=aes-256-gcm aaa bbb
+  piping-tunnel shell -c --cipher-type=aes-256-gcm aaa bbb
+  piping-tunnel exec -c --cipher-type=aes-256-gcm aaa bbb -- uname -a
+
+File transfer:
+  piping-tunnel receive -o ./dest aaa bbb
+  piping-tunnel send aaa bbb -- ./mydir ./file.txt
+
 Environment variable:
   $%s for default Piping Server
 `, ServerUrlEnvName),
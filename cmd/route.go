@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	LocalForwardFlagLongName  = "forward"
+	LocalForwardFlagShortName = "L"
+	RouteFlagLongName         = "route"
+	TargetFlagLongName        = "target"
+)
+
+// NOTE: A route name or a target of --target is sent in one byte of its length and the name at the beginning of each stream
+const maxRouteNameLen = 255
+
+type LocalForward struct {
+	Port  int
+	Route string
+}
+
+// ParseLocalForwards parses values of --forward in the form of "<PORT>:<ROUTE>"
+func ParseLocalForwards(strs []string) ([]LocalForward, error) {
+	var forwards []LocalForward
+	for _, str := range strs {
+		splitted := strings.SplitN(str, ":", 2)
+		if len(splitted) != 2 {
+			return nil, errors.Errorf("invalid --%s format '%s': e.g. 2222:ssh", LocalForwardFlagLongName, str)
+		}
+		port, err := strconv.Atoi(splitted[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid port of --%s '%s'", LocalForwardFlagLongName, str)
+		}
+		if err := validateRouteName(splitted[1]); err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, LocalForward{Port: port, Route: splitted[1]})
+	}
+	return forwards, nil
+}
+
+// ParseRoutes parses values of --route in the form of "<ROUTE>=<HOST>:<PORT>"
+func ParseRoutes(strs []string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, str := range strs {
+		splitted := strings.SplitN(str, "=", 2)
+		if len(splitted) != 2 {
+			return nil, errors.Errorf("invalid --%s format '%s': e.g. ssh=localhost:22", RouteFlagLongName, str)
+		}
+		if err := validateRouteName(splitted[0]); err != nil {
+			return nil, err
+		}
+		if _, _, err := net.SplitHostPort(splitted[1]); err != nil {
+			return nil, errors.Errorf("invalid address of --%s '%s'", RouteFlagLongName, str)
+		}
+		if _, ok := routes[splitted[0]]; ok {
+			return nil, errors.Errorf("duplicate route '%s'", splitted[0])
+		}
+		routes[splitted[0]] = splitted[1]
+	}
+	return routes, nil
+}
+
+func validateRouteName(name string) error {
+	if name == "" || len(name) > maxRouteNameLen {
+		return errors.Errorf("invalid route name '%s'", name)
+	}
+	return nil
+}
+
+// ValidateTarget validates a value of --target in the form of "<HOST>:<PORT>"
+func ValidateTarget(target string) error {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return errors.Errorf("invalid --%s '%s': e.g. db.internal:5432", TargetFlagLongName, target)
+	}
+	if len(target) > maxRouteNameLen {
+		return errors.Errorf("too long --%s '%s'", TargetFlagLongName, target)
+	}
+	return nil
+}
+
+// yamuxRoutesParam is the parameter of Content-Type of yamux advertising that streams start with route headers
+const yamuxRoutesParam = "routes"
+
+func WriteRouteHeader(w io.Writer, route string) error {
+	_, err := w.Write(append([]byte{byte(len(route))}, route...))
+	return err
+}
+
+func ReadRouteHeader(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return "", err
+	}
+	route := make([]byte, length[0])
+	if _, err := io.ReadFull(r, route); err != nil {
+		return "", err
+	}
+	return string(route), nil
+}
+
+// RoutedConn is a connection accepted for a route of server host
+type RoutedConn struct {
+	net.Conn
+	Route string
+}
+
+// NOTE: CloseWrite() of TCP connection is not promoted from net.Conn
+func (c *RoutedConn) CloseWrite() error {
+	return util.CloseWriteOrClose(c.Conn)
+}
+
+type routeListener struct {
+	listeners []net.Listener
+	connCh    chan net.Conn
+	errCh     chan error
+	closeOnce *sync.Once
+}
+
+// ListenLocalForwards listens on the ports of forwards, and the listener accepts *RoutedConn
+func ListenLocalForwards(forwards []LocalForward) (net.Listener, error) {
+	l := &routeListener{connCh: make(chan net.Conn), errCh: make(chan error, len(forwards)), closeOnce: new(sync.Once)}
+	for _, forward := range forwards {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", forward.Port))
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.listeners = append(l.listeners, ln)
+		fmt.Fprintf(InfoOutput, "[INFO] Client host listening on %d for route '%s' ...\n", ln.Addr().(*net.TCPAddr).Port, forward.Route)
+	}
+	for i, ln := range l.listeners {
+		ln, route := ln, forwards[i].Route
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					l.errCh <- err
+					return
+				}
+				l.connCh <- &RoutedConn{Conn: conn, Route: route}
+			}
+		}()
+	}
+	return l, nil
+}
+
+func (l *routeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case err := <-l.errCh:
+		return nil, err
+	}
+}
+
+func (l *routeListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		for _, ln := range l.listeners {
+			err = util.CombineErrors(err, ln.Close())
+		}
+	})
+	return err
+}
+
+func (l *routeListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
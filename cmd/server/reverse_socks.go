@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+)
+
+// serverHandleReverseSocks listens locally and opens a stream for each connection, which client host serves as SOCKS
+func serverHandleReverseSocks(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	var ln net.Listener
+	var err error
+	if flag.serverHostUnixSocket == "" {
+		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", flag.serverHostPort))
+	} else {
+		ln, err = net.Listen("unix", flag.serverHostUnixSocket)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[INFO] Server host listening on %s as SOCKS proxy ...\n", ln.Addr())
+	var openStream func() (io.ReadWriteCloser, error)
+	if flag.Yamux {
+		fmt.Println("[INFO] Multiplexing with hashicorp/yamux")
+		supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+			// NOTE: Server host is the yamux client because it opens streams
+			return flag.YamuxSession(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth, cmd.WarnYamuxContentType("client-host"), yamux.Client)
+		})
+		go supervisor.Run()
+		openStream = func() (io.ReadWriteCloser, error) {
+			return supervisor.Open()
+		}
+	} else {
+		fmt.Println("[INFO] Multiplexing with pmux")
+		openPmuxStream, err := flag.PmuxOpener(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth, "client")
+		if err != nil {
+			return err
+		}
+		openStream = openPmuxStream
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			stream, err := openStream()
+			if err != nil {
+				cmd.Vlog.Log(
+					fmt.Sprintf("error(open): %v", errors.WithStack(err)),
+					fmt.Sprintf("error(open): %+v", errors.WithStack(err)),
+				)
+				conn.Close()
+				return
+			}
+			defer stream.Close()
+			defer conn.Close()
+			if err := cmd.CopyBidirectionally(conn, stream); err != nil {
+				cmd.Vlog.Log(
+					fmt.Sprintf("error(reverse SOCKS stream): %v", errors.WithStack(err)),
+					fmt.Sprintf("error(reverse SOCKS stream): %+v", errors.WithStack(err)),
+				)
+			}
+		}()
+	}
+}
@@ -1,62 +1,109 @@
 package server
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/allowlist"
 	"github.com/nwtgck/go-piping-tunnel/backoff"
 	"github.com/nwtgck/go-piping-tunnel/cmd"
 	"github.com/nwtgck/go-piping-tunnel/piping_util"
-	"github.com/nwtgck/go-piping-tunnel/pmux"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
 	"github.com/nwtgck/go-piping-tunnel/util"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"io"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
 	"time"
 )
 
 var flag struct {
-	targetHost                     string
-	serverHostPort                 int
-	serverHostUnixSocket           string
-	clientToServerBufSize          uint
-	yamux                          bool
-	pmux                           bool
-	pmuxConfig                     string
-	symmetricallyEncrypts          bool
-	symmetricallyEncryptPassphrase string
-	cipherType                     string
-	pbkdf2JsonString               string
+	cmd.ConnectionFlags
+	targetHost            string
+	serverHostPort        int
+	serverHostUnixSocket  string
+	clientToServerBufSize uint
+	loop                  bool
+	udp                   bool
+	udpIdleTimeout        time.Duration
+	reverseSocks          bool
+	routeStrs             []string
+	allowStrs             []string
 }
 
+// Parsed --route
+var routes map[string]string
+
+// Parsed --allow
+var allowList *allowlist.List
+
 func init() {
 	cmd.RootCmd.AddCommand(serverCmd)
 	serverCmd.Flags().StringVarP(&flag.targetHost, "host", "", "localhost", "Target host")
 	serverCmd.Flags().IntVarP(&flag.serverHostPort, "port", "p", 0, "TCP port of server host")
 	serverCmd.Flags().StringVarP(&flag.serverHostUnixSocket, "unix-socket", "", "", "Unix socket of server host")
 	serverCmd.Flags().UintVarP(&flag.clientToServerBufSize, "cs-buf-size", "", 4096, "Buffer size of client-to-server in bytes")
-	serverCmd.Flags().BoolVarP(&flag.yamux, cmd.YamuxFlagLongName, "", false, "Multiplex connection by hashicorp/yamux")
-	serverCmd.Flags().BoolVarP(&flag.pmux, cmd.PmuxFlagLongName, "", false, "Multiplex connection by pmux (experimental)")
-	serverCmd.Flags().StringVarP(&flag.pmuxConfig, cmd.PmuxConfigFlagLongName, "", `{"hb": true}`, "pmux config in JSON (experimental)")
-	serverCmd.Flags().BoolVarP(&flag.symmetricallyEncrypts, cmd.SymmetricallyEncryptsFlagLongName, cmd.SymmetricallyEncryptsFlagShortName, false, "Encrypt symmetrically")
-	serverCmd.Flags().StringVarP(&flag.symmetricallyEncryptPassphrase, cmd.SymmetricallyEncryptPassphraseFlagLongName, "", "", "Passphrase for encryption")
-	serverCmd.Flags().StringVarP(&flag.cipherType, cmd.CipherTypeFlagLongName, "", cmd.DefaultCipherType, fmt.Sprintf("Cipher type: %s, %s, %s, %s ", piping_util.CipherTypeAesCtr, piping_util.CipherTypeOpensslAes128Ctr, piping_util.CipherTypeOpensslAes256Ctr, piping_util.CipherTypeOpenpgp))
-	// NOTE: default value of --pbkdf2 should be empty to detect key derive derivation from multiple algorithms in the future.
-	serverCmd.Flags().StringVarP(&flag.pbkdf2JsonString, cmd.Pbkdf2FlagLongName, "", "", fmt.Sprintf("e.g. %s", cmd.ExamplePbkdf2JsonStr()))
+	flag.ConnectionFlags.AddMultiplexerFlags(serverCmd.Flags())
+	flag.ConnectionFlags.AddEncryptionFlags(serverCmd.Flags())
+	serverCmd.Flags().BoolVarP(&flag.loop, cmd.LoopFlagLongName, "", false, "Wait for the next connection after the connection ends (without multiplexing)")
+	serverCmd.Flags().BoolVarP(&flag.udp, cmd.UdpFlagLongName, "", false, "Forward UDP datagrams to the UDP port of server host")
+	serverCmd.Flags().StringArrayVarP(&flag.routeStrs, cmd.RouteFlagLongName, "", nil, "Route for --forward of client host and its target (e.g. ssh=localhost:22)")
+	serverCmd.Flags().StringArrayVarP(&flag.allowStrs, cmd.AllowFlagLongName, "", nil, "Destination allowed for --target of client host (e.g. 10.0.0.0/8, *.internal:5432, db:5000-5999)")
+	serverCmd.Flags().BoolVarP(&flag.reverseSocks, cmd.ReverseSocksFlagLongName, "", false, "Listen on the port as SOCKS proxy served by client host with the same flag")
+	serverCmd.Flags().DurationVarP(&flag.udpIdleTimeout, cmd.UdpIdleTimeoutFlagLongName, "", time.Minute, "Forget a UDP flow after this idle time (0 for no timeout)")
 }
 
 var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Run server-host",
 	RunE: func(_ *cobra.Command, args []string) error {
-		// Validate cipher-type
-		if flag.symmetricallyEncrypts {
-			if err := cmd.ValidateClientCipher(flag.cipherType); err != nil {
+		if err := flag.Validate(); err != nil {
+			return err
+		}
+		if flag.udp && flag.serverHostUnixSocket != "" {
+			return errors.Errorf("--%s and --unix-socket cannot be used together", cmd.UdpFlagLongName)
+		}
+		if flag.reverseSocks {
+			if !flag.Yamux && !flag.Pmux {
+				return errors.Errorf("--%s needs --%s or --%s", cmd.ReverseSocksFlagLongName, cmd.YamuxFlagLongName, cmd.PmuxFlagLongName)
+			}
+			if flag.udp {
+				return errors.Errorf("--%s and --%s cannot be used together", cmd.ReverseSocksFlagLongName, cmd.UdpFlagLongName)
+			}
+		}
+		var err error
+		routes, err = cmd.ParseRoutes(flag.routeStrs)
+		if err != nil {
+			return err
+		}
+		if len(routes) != 0 {
+			if !flag.Yamux && !flag.Pmux {
+				return errors.Errorf("--%s needs --%s or --%s", cmd.RouteFlagLongName, cmd.YamuxFlagLongName, cmd.PmuxFlagLongName)
+			}
+			if flag.udp || flag.reverseSocks {
+				return errors.Errorf("--%s cannot be used with --%s or --%s", cmd.RouteFlagLongName, cmd.UdpFlagLongName, cmd.ReverseSocksFlagLongName)
+			}
+		}
+		if len(flag.allowStrs) != 0 {
+			if !flag.Yamux && !flag.Pmux {
+				return errors.Errorf("--%s needs --%s or --%s", cmd.AllowFlagLongName, cmd.YamuxFlagLongName, cmd.PmuxFlagLongName)
+			}
+			if flag.udp || flag.reverseSocks {
+				return errors.Errorf("--%s cannot be used with --%s or --%s", cmd.AllowFlagLongName, cmd.UdpFlagLongName, cmd.ReverseSocksFlagLongName)
+			}
+			allowList, err = allowlist.Parse(flag.allowStrs)
+			if err != nil {
 				return err
 			}
 		}
+		// NOTE: Route headers are advertised to client host, which should send them
+		flag.Routes = len(routes) != 0 || allowList != nil
+		publicKeyAuth, err := flag.PublicKeyAuth()
+		if err != nil {
+			return err
+		}
 		clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(args)
 		if err != nil {
 			return err
@@ -65,11 +112,7 @@ var serverCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		httpClient := util.CreateHttpClient(cmd.Insecure, cmd.HttpWriteBufSize, cmd.HttpReadBufSize)
-		if cmd.DnsServer != "" {
-			// Set DNS resolver
-			httpClient.Transport.(*http.Transport).DialContext = util.CreateDialContext(cmd.DnsServer)
-		}
+		httpClient := cmd.NewHttpClient()
 		serverToClientUrl, err := util.UrlJoin(cmd.ServerUrl, serverToClientPath)
 		if err != nil {
 			return err
@@ -79,8 +122,8 @@ var serverCmd = &cobra.Command{
 			return err
 		}
 		var opensslAesCtrParams *cmd.OpensslAesCtrParams = nil
-		if flag.symmetricallyEncrypts {
-			opensslAesCtrParams, err = cmd.ParseOpensslAesCtrParams(flag.cipherType, flag.pbkdf2JsonString)
+		if flag.SymmetricallyEncrypts {
+			opensslAesCtrParams, err = cmd.ParseOpensslAesCtrParams(flag.CipherType, flag.Pbkdf2JsonString)
 			if err != nil {
 				return err
 			}
@@ -88,77 +131,124 @@ var serverCmd = &cobra.Command{
 		// Print hint
 		printHintForClientHost(clientToServerUrl, serverToClientUrl, clientToServerPath, serverToClientPath, opensslAesCtrParams)
 		// Make user input passphrase if it is empty
-		if flag.symmetricallyEncrypts {
-			err = cmd.MakeUserInputPassphraseIfEmpty(&flag.symmetricallyEncryptPassphrase)
-			if err != nil {
-				return err
-			}
+		if err := flag.InputPassphraseIfNeed(); err != nil {
+			return err
+		}
+		if flag.reverseSocks {
+			return serverHandleReverseSocks(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 		}
 		// Use multiplexer with yamux
-		if flag.yamux {
+		if flag.Yamux {
 			fmt.Println("[INFO] Multiplexing with hashicorp/yamux")
-			return serverHandleWithYamux(httpClient, headers, clientToServerUrl, serverToClientUrl)
+			if flag.udp {
+				return serverHandleUdpWithYamux(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+			}
+			return serverHandleWithYamux(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 		}
 
 		// If pmux is enabled
-		if flag.pmux {
+		if flag.Pmux {
 			fmt.Println("[INFO] Multiplexing with pmux")
-			return serverHandleWithPmux(httpClient, headers, clientToServerUrl, serverToClientUrl)
+			if flag.udp {
+				return serverHandleUdpWithPmux(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+			}
+			return serverHandleWithPmux(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 		}
 
-		conn, err := serverHostDial()
-		if err != nil {
-			return err
+		if flag.udp {
+			return serverHandleUdp(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 		}
-		defer conn.Close()
-		// If encryption is enabled
-		if flag.symmetricallyEncrypts {
-			var duplex io.ReadWriteCloser
-			duplex, err := piping_util.DuplexConnect(httpClient, headers, serverToClientUrl, clientToServerUrl)
-			if err != nil {
-				return err
-			}
-			duplex, err = cmd.MakeDuplexWithEncryptionAndProgressIfNeed(duplex, flag.symmetricallyEncrypts, flag.symmetricallyEncryptPassphrase, flag.cipherType, flag.pbkdf2JsonString)
+		if !flag.loop {
+			return serverHandle(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
+		}
+		b := backoff.NewExponentialBackoff()
+		for {
+			err := serverHandle(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 			if err != nil {
-				return err
+				fmt.Printf("[WARN] %s\n", err)
+				// backoff
+				time.Sleep(b.NextDuration())
+				continue
 			}
-			fin := make(chan error)
-			go func() {
-				// TODO: hard code
-				var buf = make([]byte, 4096)
-				_, err := io.CopyBuffer(duplex, conn, buf)
-				fin <- err
-			}()
-			go func() {
-				// TODO: hard code
-				var buf = make([]byte, 4096)
-				_, err := io.CopyBuffer(conn, duplex, buf)
-				fin <- err
-			}()
-			return util.CombineErrors(<-fin, <-fin)
+			b.Reset()
 		}
-		err = piping_util.HandleDuplex(httpClient, conn, headers, serverToClientUrl, clientToServerUrl, flag.clientToServerBufSize, nil, cmd.ShowProgress, cmd.MakeProgressMessage)
-		fmt.Println()
+	},
+}
+
+func serverHandle(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	conn, err := serverHostDial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// If encryption is enabled
+	if flag.SymmetricallyEncrypts || publicKeyAuth != nil || flag.Resume {
+		duplex, err := flag.DuplexConnect(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth)
 		if err != nil {
 			return err
 		}
-		fmt.Println("[INFO] Finished")
-
-		return nil
-	},
+		defer duplex.Close()
+		return cmd.CopyBidirectionally(conn, duplex)
+	}
+	err = piping_util.HandleDuplex(httpClient, conn, headers, serverToClientUrl, clientToServerUrl, flag.clientToServerBufSize, nil, cmd.ShowProgress, cmd.MakeProgressMessage)
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+	fmt.Println("[INFO] Finished")
+	return nil
 }
 
 func serverHostDial() (net.Conn, error) {
 	if flag.serverHostUnixSocket == "" {
-		return net.Dial("tcp", fmt.Sprintf("%s:%d", flag.targetHost, flag.serverHostPort))
+		return net.Dial("tcp", net.JoinHostPort(flag.targetHost, strconv.Itoa(flag.serverHostPort)))
 	} else {
 		return net.Dial("unix", flag.serverHostUnixSocket)
 	}
 }
 
+func sortedRouteNames() []string {
+	var names []string
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serverStreamTarget returns the dial function for the route of the stream with --route or the destination allowed by --allow
+func serverStreamTarget(stream io.Reader) (func() (net.Conn, error), error) {
+	if len(routes) == 0 && allowList == nil {
+		// NOTE: The fixed target is retried until it is up
+		return func() (net.Conn, error) {
+			return dialLoop(serverHostDial), nil
+		}, nil
+	}
+	route, err := cmd.ReadRouteHeader(stream)
+	if err != nil {
+		return nil, err
+	}
+	if address, ok := routes[route]; ok {
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", address)
+		}, nil
+	}
+	if allowList == nil {
+		return nil, errors.Errorf("unknown route '%s'", route)
+	}
+	address, err := allowList.Check(route)
+	if err != nil {
+		return nil, err
+	}
+	return func() (net.Conn, error) {
+		return net.Dial("tcp", address)
+	}, nil
+}
+
 func printHintForClientHost(clientToServerUrl string, serverToClientUrl string, clientToServerPath string, serverToClientPath string, opensslAesCtrParams *cmd.OpensslAesCtrParams) {
-	if !flag.yamux && !flag.pmux {
-		if flag.symmetricallyEncrypts {
+	// NOTE: --resume and --udp need piping-tunnel on both hosts
+	if !flag.Yamux && !flag.Pmux && !flag.Resume && !flag.udp {
+		if flag.SymmetricallyEncrypts || flag.IdentityPath != "" {
 			if opensslAesCtrParams != nil {
 				fmt.Println("[INFO] Hint: Client host. Port 31376 may be replaced (socat + curl + openssl)")
 				fmt.Printf(
@@ -179,98 +269,107 @@ func printHintForClientHost(clientToServerUrl string, serverToClientUrl string,
 			fmt.Printf("  curl -NsS %s | socat TCP-LISTEN:31376 - | curl -NsST - %s\n", serverToClientUrl, clientToServerUrl)
 		}
 	}
-	flags := ""
-	if flag.symmetricallyEncrypts {
-		flags += fmt.Sprintf("-%s ", cmd.SymmetricallyEncryptsFlagShortName)
-		flags += fmt.Sprintf("--%s=%s ", cmd.CipherTypeFlagLongName, flag.cipherType)
-		switch flag.cipherType {
-		case piping_util.CipherTypeOpensslAes128Ctr:
-			fallthrough
-		case piping_util.CipherTypeOpensslAes256Ctr:
-			flags += fmt.Sprintf("--%s='%s' ", cmd.Pbkdf2FlagLongName, flag.pbkdf2JsonString)
-		}
+	flags := flag.HintFlags()
+	if flag.udp {
+		flags += fmt.Sprintf("--%s ", cmd.UdpFlagLongName)
+	}
+	if flag.loop {
+		flags += fmt.Sprintf("--%s ", cmd.LoopFlagLongName)
 	}
-	if flag.yamux {
-		flags += fmt.Sprintf("--%s ", cmd.YamuxFlagLongName)
+	// NOTE: Client host does not listen in reverse SOCKS
+	portFlag := "-p 31376 "
+	if flag.reverseSocks {
+		portFlag = ""
+		flags += fmt.Sprintf("--%s ", cmd.ReverseSocksFlagLongName)
 	}
-	if flag.pmux {
-		flags += fmt.Sprintf("--%s ", cmd.PmuxFlagLongName)
+	if len(routes) != 0 {
+		portFlag = ""
+		for _, route := range sortedRouteNames() {
+			portFlag += fmt.Sprintf("-%s <PORT>:%s ", cmd.LocalForwardFlagShortName, route)
+		}
+	} else if allowList != nil {
+		portFlag += fmt.Sprintf("--%s <HOST>:<PORT> ", cmd.TargetFlagLongName)
 	}
 	fmt.Println("[INFO] Hint: Client host (piping-tunnel)")
 	fmt.Printf(
-		"  piping-tunnel -s %s client -p 31376 %s%s %s\n",
+		"  piping-tunnel -s %s client %s%s%s %s\n",
 		cmd.ServerUrl,
+		portFlag,
 		flags,
 		clientToServerPath,
 		serverToClientPath,
 	)
 }
 
-func serverHandleWithYamux(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string) error {
-	var duplex io.ReadWriteCloser
-	duplex, err := piping_util.DuplexConnectWithHandlers(
-		func(body io.Reader) (*http.Response, error) {
-			return piping_util.PipingSend(httpClient, cmd.HeadersWithYamux(headers), serverToClientUrl, body)
-		},
-		func() (*http.Response, error) {
-			res, err := piping_util.PipingGet(httpClient, headers, clientToServerUrl)
-			if err != nil {
-				return nil, err
-			}
-			contentType := res.Header.Get("Content-Type")
-			if contentType != cmd.YamuxMimeType {
-				fmt.Printf("[WARN] --%s flag may be missing in client-host\n", cmd.YamuxFlagLongName)
-			}
-			return res, nil
-		},
-	)
-	if err != nil {
-		return err
+func serverHandleWithYamux(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+		return flag.YamuxSession(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth, cmd.WarnYamuxContentType("client-host"), yamux.Server)
+	})
+	go supervisor.Run()
+	for {
+		yamuxStream, err := supervisor.Accept()
+		if err != nil {
+			return err
+		}
+		// NOTE: Reading the route and dialing the target do not block accepting other streams
+		go serverHandleYamuxStream(yamuxStream)
 	}
-	duplex, err = cmd.MakeDuplexWithEncryptionAndProgressIfNeed(duplex, flag.symmetricallyEncrypts, flag.symmetricallyEncryptPassphrase, flag.cipherType, flag.pbkdf2JsonString)
+}
+
+// serverHandleYamuxStream connects the stream to the target
+func serverHandleYamuxStream(yamuxStream *yamux.Stream) {
+	dial, err := serverStreamTarget(yamuxStream)
 	if err != nil {
-		return err
+		cmd.Vlog.Log(
+			fmt.Sprintf("error(route): %v", errors.WithStack(err)),
+			fmt.Sprintf("error(route): %+v", errors.WithStack(err)),
+		)
+		yamuxStream.Close()
+		return
 	}
-	yamuxSession, err := yamux.Server(duplex, nil)
+	conn, err := dial()
 	if err != nil {
-		return err
+		cmd.Vlog.Log(
+			fmt.Sprintf("error(dial): %v", errors.WithStack(err)),
+			fmt.Sprintf("error(dial): %+v", errors.WithStack(err)),
+		)
+		yamuxStream.Close()
+		return
 	}
-	for {
-		yamuxStream, err := yamuxSession.Accept()
-		if err != nil {
-			return err
-		}
-		conn, err := serverHostDial()
-		if err != nil {
-			return err
-		}
-		fin := make(chan struct{})
-		go func() {
-			// TODO: hard code
-			var buf = make([]byte, 4096)
-			io.CopyBuffer(yamuxStream, conn, buf)
-			fin <- struct{}{}
-		}()
-		go func() {
-			// TODO: hard code
-			var buf = make([]byte, 4096)
-			io.CopyBuffer(conn, yamuxStream, buf)
-			fin <- struct{}{}
-		}()
-		go func() {
-			<-fin
-			<-fin
-			close(fin)
+	fin := make(chan struct{})
+	go func() {
+		// TODO: hard code
+		var buf = make([]byte, 4096)
+		io.CopyBuffer(yamuxStream, conn, buf)
+		fin <- struct{}{}
+	}()
+	go func() {
+		// TODO: hard code
+		var buf = make([]byte, 4096)
+		io.CopyBuffer(conn, yamuxStream, buf)
+		fin <- struct{}{}
+	}()
+	done := make(chan struct{})
+	go func() {
+		select {
+		// NOTE: Streams of a dead session end without closing the connections
+		case <-yamuxStream.Session().CloseChan():
 			conn.Close()
-			yamuxStream.Close()
-		}()
-	}
+		case <-done:
+		}
+	}()
+	<-fin
+	<-fin
+	close(fin)
+	close(done)
+	conn.Close()
+	yamuxStream.Close()
 }
 
-func dialLoop() net.Conn {
+func dialLoop(dial func() (net.Conn, error)) net.Conn {
 	b := backoff.NewExponentialBackoff()
 	for {
-		conn, err := serverHostDial()
+		conn, err := dial()
 		if err != nil {
 			// backoff
 			time.Sleep(b.NextDuration())
@@ -280,14 +379,13 @@ func dialLoop() net.Conn {
 	}
 }
 
-func serverHandleWithPmux(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string) error {
-	var config cmd.ServerPmuxConfigJson
-	if json.Unmarshal([]byte(flag.pmuxConfig), &config) != nil {
-		return errors.Errorf("invalid pmux config format")
+func serverHandleWithPmux(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	acceptPmuxStream, err := flag.PmuxAccepter(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth)
+	if err != nil {
+		return err
 	}
-	pmuxServer := pmux.Server(httpClient, headers, serverToClientUrl, clientToServerUrl, config.Hb, flag.symmetricallyEncrypts, flag.symmetricallyEncryptPassphrase, flag.cipherType)
 	for {
-		stream, err := pmuxServer.Accept()
+		stream, err := acceptPmuxStream()
 		if err != nil {
 			cmd.Vlog.Log(
 				fmt.Sprintf("error(pmux accept): %v", errors.WithStack(err)),
@@ -295,33 +393,30 @@ func serverHandleWithPmux(httpClient *http.Client, headers []piping_util.KeyValu
 			)
 			continue
 		}
-		conn := dialLoop()
-		go func() {
-			// TODO: hard code
-			var buf = make([]byte, 4096)
-			_, err := io.CopyBuffer(conn, stream, buf)
-			if err != nil {
-				cmd.Vlog.Log(
-					fmt.Sprintf("error(pmux stream → conn): %v", errors.WithStack(err)),
-					fmt.Sprintf("error(pmux stream → conn): %+v", errors.WithStack(err)),
-				)
-				conn.Close()
-				return
-			}
-		}()
+		// NOTE: Reading the route and dialing the target do not block accepting other streams
+		go serverHandlePmuxStream(stream)
+	}
+}
 
-		go func() {
-			// TODO: hard code
-			var buf = make([]byte, 4096)
-			_, err := io.CopyBuffer(stream, conn, buf)
-			if err != nil {
-				cmd.Vlog.Log(
-					fmt.Sprintf("error(conn → pmux stream): %v", errors.WithStack(err)),
-					fmt.Sprintf("error(conn → pmux stream): %+v", errors.WithStack(err)),
-				)
-				conn.Close()
-				return
-			}
-		}()
+// serverHandlePmuxStream connects the stream to the target
+func serverHandlePmuxStream(stream io.ReadWriteCloser) {
+	dial, err := serverStreamTarget(stream)
+	if err != nil {
+		cmd.Vlog.Log(
+			fmt.Sprintf("error(route): %v", errors.WithStack(err)),
+			fmt.Sprintf("error(route): %+v", errors.WithStack(err)),
+		)
+		stream.Close()
+		return
+	}
+	conn, err := dial()
+	if err != nil {
+		cmd.Vlog.Log(
+			fmt.Sprintf("error(dial): %v", errors.WithStack(err)),
+			fmt.Sprintf("error(dial): %+v", errors.WithStack(err)),
+		)
+		stream.Close()
+		return
 	}
+	cmd.RelayPmuxStream(conn, stream)
 }
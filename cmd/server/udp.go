@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/backoff"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/nwtgck/go-piping-tunnel/udp_tunnel"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func serverHostDialUdp() (net.Conn, error) {
+	return net.Dial("udp", net.JoinHostPort(flag.targetHost, strconv.Itoa(flag.serverHostPort)))
+}
+
+func serveUdpStream(stream io.ReadWriteCloser) {
+	err := udp_tunnel.Server(stream, serverHostDialUdp, flag.udpIdleTimeout)
+	stream.Close()
+	cmd.Vlog.Log(
+		fmt.Sprintf("error(udp stream): %v", errors.WithStack(err)),
+		fmt.Sprintf("error(udp stream): %+v", errors.WithStack(err)),
+	)
+}
+
+// NOTE: UDP has no end of connection, so the tunnel is always connected again
+func serverHandleUdp(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	b := backoff.NewExponentialBackoff()
+	for {
+		duplex, err := flag.DuplexConnect(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth)
+		if err != nil {
+			fmt.Printf("[WARN] %s\n", err)
+			// backoff
+			time.Sleep(b.NextDuration())
+			continue
+		}
+		b.Reset()
+		fmt.Println("[INFO] UDP tunnel connected")
+		err = udp_tunnel.Server(duplex, serverHostDialUdp, flag.udpIdleTimeout)
+		duplex.Close()
+		fmt.Printf("[WARN] UDP tunnel disconnected: %s\n", err)
+	}
+}
+
+func serverHandleUdpWithYamux(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+		return flag.YamuxSession(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth, cmd.WarnYamuxContentType("client-host"), yamux.Server)
+	})
+	go supervisor.Run()
+	for {
+		yamuxStream, err := supervisor.Accept()
+		if err != nil {
+			return err
+		}
+		go serveUdpStream(yamuxStream)
+	}
+}
+
+func serverHandleUdpWithPmux(httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	acceptPmuxStream, err := flag.PmuxAccepter(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth)
+	if err != nil {
+		return err
+	}
+	for {
+		stream, err := acceptPmuxStream()
+		if err != nil {
+			cmd.Vlog.Log(
+				fmt.Sprintf("error(pmux accept): %v", errors.WithStack(err)),
+				fmt.Sprintf("error(pmux accept): %+v", errors.WithStack(err)),
+			)
+			continue
+		}
+		go serveUdpStream(stream)
+	}
+}
@@ -7,17 +7,26 @@ import (
 	_ "crypto/sha512"
 	"encoding/json"
 	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/aead_duplex"
 	"github.com/nwtgck/go-piping-tunnel/aes_ctr_duplex"
+	"github.com/nwtgck/go-piping-tunnel/backoff"
+	"github.com/nwtgck/go-piping-tunnel/cpace_duplex"
 	"github.com/nwtgck/go-piping-tunnel/io_progress"
 	"github.com/nwtgck/go-piping-tunnel/openpgp_duplex"
 	"github.com/nwtgck/go-piping-tunnel/openssl_aes_ctr_duplex"
 	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pmux"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
 	"github.com/nwtgck/go-piping-tunnel/util"
 	"github.com/nwtgck/go-piping-tunnel/verbose_logger"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
 	"hash"
 	"io"
+	"mime"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -32,16 +41,71 @@ const (
 	SymmetricallyEncryptPassphraseFlagLongName = "pass"
 	CipherTypeFlagLongName                     = "cipher-type"
 	Pbkdf2FlagLongName                         = "pbkdf2"
+	IdentityFlagLongName                       = "identity"
+	AuthorizedKeysFlagLongName                 = "authorized-keys"
+	PeerKeyFlagLongName                        = "peer-key"
+	LoopFlagLongName                           = "loop"
+	ResumeFlagLongName                         = "resume"
+	UdpFlagLongName                            = "udp"
+	UdpIdleTimeoutFlagLongName                 = "udp-idle-timeout"
+	SocksUdpFlagLongName                       = "socks-udp"
+	ReverseSocksFlagLongName                   = "reverse-socks"
+	AllowFlagLongName                          = "allow"
+	DenyFlagLongName                           = "deny"
+	RulesFileFlagLongName                      = "rules-file"
+	SocksUserFlagLongName                      = "socks-user"
+	SocksUserFileFlagLongName                  = "socks-user-file"
 )
 
 const YamuxMimeType = "application/yamux"
 
-type ServerPmuxConfigJson struct {
+// InfoOutput is where information of the tunnel is printed, which is stderr when stdout is used for data
+var InfoOutput io.Writer = os.Stdout
+
+// PmuxConfigJson is --pmux-config, where hosts use fields of the role in pmux such as Accepts in the accepting host
+type PmuxConfigJson struct {
 	Hb bool `json:"hb"`
+	// Number of sessions multiplexing streams, where 0 connects sub-paths for each stream like older versions
+	Sessions *int `json:"sessions"`
+	// Number of streams connected in advance when streams are not multiplexed over sessions
+	Pool int `json:"pool"`
+	// Number of sub-paths connected concurrently when accepting streams
+	Accepts *int `json:"accepts"`
+	// Compression algorithms of streams in the order of preference
+	Compressions []string `json:"compressions"`
+	// Window of each stream in a session in bytes
+	Window uint32 `json:"window"`
 }
 
-type ClientPmuxConfigJson struct {
-	Hb bool `json:"hb"`
+func (c *PmuxConfigJson) NumSessions() int {
+	return pmuxNumSessions(c.Sessions)
+}
+
+func (c *PmuxConfigJson) AcceptConcurrency() int {
+	return pmuxAcceptConcurrency(c.Accepts)
+}
+
+func (c *PmuxConfigJson) Capabilities() (pmux.Capabilities, error) {
+	return pmuxCapabilities(c.Compressions, c.Window)
+}
+
+func pmuxCapabilities(compressions []string, window uint32) (pmux.Capabilities, error) {
+	capabilities := pmux.Capabilities{Compressions: compressions, WindowSize: window}
+	return capabilities, capabilities.Validate()
+}
+
+func pmuxNumSessions(sessions *int) int {
+	if sessions == nil {
+		return pmux.DefaultNumSessions
+	}
+	return *sessions
+}
+
+func pmuxAcceptConcurrency(accepts *int) int {
+	if accepts == nil {
+		return pmux.DefaultAcceptConcurrency
+	}
+	return *accepts
 }
 
 type pbkdf2ConfigJson struct {
@@ -76,6 +140,14 @@ func ValidateClientCipher(str string) error {
 		return nil
 	case piping_util.CipherTypeOpenpgp:
 		return nil
+	case piping_util.CipherTypeAes256Gcm:
+		return nil
+	case piping_util.CipherTypeChacha20Poly1305:
+		return nil
+	case piping_util.CipherTypeCpaceAes256Gcm:
+		return nil
+	case piping_util.CipherTypeCpaceChacha20Poly1305:
+		return nil
 	default:
 		return errors.Errorf("invalid cipher type: %s", str)
 	}
@@ -106,6 +178,14 @@ func ParsePbkdf2(str string) (*Pbkdf2Config, error) {
 	return &Pbkdf2Config{Iter: configJson.Iter, Hash: h, HashNameForCommandHint: configJson.Hash}, nil
 }
 
+// ParseAeadPbkdf2 parses --pbkdf2 of AEAD ciphers, where empty is the default of aead_duplex
+func ParseAeadPbkdf2(str string) (*Pbkdf2Config, error) {
+	if str == "" {
+		return &Pbkdf2Config{Iter: aead_duplex.DefaultPbkdf2Iter, Hash: crypto.SHA256.New, HashNameForCommandHint: "sha256"}, nil
+	}
+	return ParsePbkdf2(str)
+}
+
 func ParseOpensslAesCtrParams(cipherType string, pbkdf2ConfigJsonStr string) (*OpensslAesCtrParams, error) {
 	var keyBits uint16
 	switch cipherType {
@@ -127,6 +207,36 @@ func ParseOpensslAesCtrParams(cipherType string, pbkdf2ConfigJsonStr string) (*O
 	return nil, nil
 }
 
+// ParsePublicKeyAuth returns nil when public-key authentication is not used
+func ParsePublicKeyAuth(identityPath string, authorizedKeysPath string, peerKeyPath string) (*pubkey_duplex.Config, error) {
+	if identityPath == "" {
+		if authorizedKeysPath != "" || peerKeyPath != "" {
+			return nil, errors.Errorf("--%s is required with --%s or --%s", IdentityFlagLongName, AuthorizedKeysFlagLongName, PeerKeyFlagLongName)
+		}
+		return nil, nil
+	}
+	if authorizedKeysPath == "" && peerKeyPath == "" {
+		return nil, errors.Errorf("--%s or --%s is required with --%s", AuthorizedKeysFlagLongName, PeerKeyFlagLongName, IdentityFlagLongName)
+	}
+	signer, err := pubkey_duplex.ReadIdentity(identityPath)
+	if err != nil {
+		return nil, err
+	}
+	var authorizedKeys []ssh.PublicKey
+	for _, path := range []string{authorizedKeysPath, peerKeyPath} {
+		if path == "" {
+			continue
+		}
+		keys, err := pubkey_duplex.ReadAuthorizedKeys(path)
+		if err != nil {
+			return nil, err
+		}
+		authorizedKeys = append(authorizedKeys, keys...)
+	}
+	fmt.Fprintf(InfoOutput, "[INFO] Identity: %s\n", ssh.FingerprintSHA256(signer.PublicKey()))
+	return &pubkey_duplex.Config{Signer: signer, AuthorizedKeys: authorizedKeys}, nil
+}
+
 func ExamplePbkdf2JsonStr() string {
 	b, err := json.Marshal(&pbkdf2ConfigJson{Iter: 100000, Hash: "sha256"})
 	if err != nil {
@@ -174,8 +284,21 @@ func MakeUserInputPassphraseIfEmpty(passphrase *string) (err error) {
 	return nil
 }
 
-func MakeDuplexWithEncryptionAndProgressIfNeed(duplex io.ReadWriteCloser, encrypts bool, passphrase string, cipherType string, pbkdf2JsonStr string) (io.ReadWriteCloser, error) {
+func MakeDuplexWithEncryptionAndProgressIfNeed(duplex io.ReadWriteCloser, encrypts bool, passphrase string, cipherType string, pbkdf2JsonStr string, publicKeyAuth *pubkey_duplex.Config) (io.ReadWriteCloser, error) {
 	var err error
+	// If public-key authentication is enabled
+	if publicKeyAuth != nil {
+		config := *publicKeyAuth
+		var peerKey ssh.PublicKey
+		config.OnPeerAuthenticated = func(k ssh.PublicKey) {
+			peerKey = k
+		}
+		duplex, err = pubkey_duplex.Duplex(duplex, duplex, &config)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(InfoOutput, "[INFO] End-to-end encryption with public-key authentication (peer: %s)\n", ssh.FingerprintSHA256(peerKey))
+	}
 	// If encryption is enabled
 	if encrypts {
 		var cipherName string
@@ -201,13 +324,38 @@ func MakeDuplexWithEncryptionAndProgressIfNeed(duplex io.ReadWriteCloser, encryp
 		case piping_util.CipherTypeOpenpgp:
 			duplex, err = openpgp_duplex.SymmetricallyEncryptDuplexWithOpenPGP(duplex, duplex, []byte(passphrase))
 			cipherName = "OpenPGP"
+		case piping_util.CipherTypeAes256Gcm:
+			var pbkdf2 *Pbkdf2Config
+			pbkdf2, err = ParseAeadPbkdf2(pbkdf2JsonStr)
+			if err != nil {
+				return nil, err
+			}
+			duplex, err = aead_duplex.Duplex(duplex, duplex, []byte(passphrase), pbkdf2.Iter, pbkdf2.Hash, aead_duplex.Aes256Gcm)
+			cipherName = aead_duplex.Aes256Gcm.Name
+		case piping_util.CipherTypeChacha20Poly1305:
+			var pbkdf2 *Pbkdf2Config
+			pbkdf2, err = ParseAeadPbkdf2(pbkdf2JsonStr)
+			if err != nil {
+				return nil, err
+			}
+			duplex, err = aead_duplex.Duplex(duplex, duplex, []byte(passphrase), pbkdf2.Iter, pbkdf2.Hash, aead_duplex.Chacha20Poly1305)
+			cipherName = aead_duplex.Chacha20Poly1305.Name
+		case piping_util.CipherTypeCpaceAes256Gcm:
+			duplex, err = cpace_duplex.Duplex(duplex, duplex, []byte(passphrase), aead_duplex.Aes256Gcm)
+			cipherName = "CPace + " + aead_duplex.Aes256Gcm.Name
+		case piping_util.CipherTypeCpaceChacha20Poly1305:
+			duplex, err = cpace_duplex.Duplex(duplex, duplex, []byte(passphrase), aead_duplex.Chacha20Poly1305)
+			cipherName = "CPace + " + aead_duplex.Chacha20Poly1305.Name
 		default:
 			return nil, errors.Errorf("unexpected cipher type: %s", cipherType)
 		}
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf("[INFO] End-to-end encryption with %s\n", cipherName)
+		fmt.Fprintf(InfoOutput, "[INFO] End-to-end encryption with %s\n", cipherName)
+	}
+	if encrypts || publicKeyAuth != nil {
+		duplex = &authenticationFailureReporter{ReadWriteCloser: duplex, name: "connection", once: new(sync.Once)}
 	}
 	if ShowProgress {
 		duplex = io_progress.NewIOProgress(duplex, duplex, os.Stderr, MakeProgressMessage)
@@ -215,6 +363,184 @@ func MakeDuplexWithEncryptionAndProgressIfNeed(duplex io.ReadWriteCloser, encryp
 	return duplex, nil
 }
 
-func HeadersWithYamux(headers []piping_util.KeyValue) []piping_util.KeyValue {
-	return append(headers, piping_util.KeyValue{Key: "Content-Type", Value: YamuxMimeType})
+// MakeDuplexWithResumeIfNeed connects by connect(), and the connection is resumed on sub-paths after HTTP requests break when resumes is true
+func MakeDuplexWithResumeIfNeed(resumes bool, uploadUrl string, downloadUrl string, connect func(uploadUrl string, downloadUrl string) (io.ReadWriteCloser, error)) (io.ReadWriteCloser, error) {
+	if !resumes {
+		return connect(uploadUrl, downloadUrl)
+	}
+	duplex, err := piping_util.ResumableDuplexConnect(uploadUrl, downloadUrl, connect)
+	if err != nil {
+		return nil, err
+	}
+	return duplex, nil
+}
+
+// authenticationFailureReporter reports tampering even without verbose logging
+type authenticationFailureReporter struct {
+	io.ReadWriteCloser
+	// Name in the report such as "connection"
+	name string
+	once *sync.Once
+}
+
+func (r *authenticationFailureReporter) Read(p []byte) (int, error) {
+	n, err := r.ReadWriteCloser.Read(p)
+	if err == aead_duplex.AuthenticationFailedError {
+		r.once.Do(func() {
+			fmt.Fprintf(InfoOutput, "[ERROR] %s: %s\n", r.name, err)
+		})
+	}
+	return n, err
+}
+
+func (r *authenticationFailureReporter) CloseWrite() error {
+	return util.CloseWriteOrClose(r.ReadWriteCloser)
+}
+
+// CopyBidirectionally copies between conn and duplex until both directions finish
+// NOTE: EOF of one direction is notified to the other side by half-close, and an error closes both
+func CopyBidirectionally(conn io.ReadWriteCloser, duplex io.ReadWriteCloser) error {
+	fin := make(chan error)
+	go func() {
+		// TODO: hard code
+		var buf = make([]byte, 4096)
+		_, err := io.CopyBuffer(duplex, conn, buf)
+		if err != nil {
+			conn.Close()
+			duplex.Close()
+		} else {
+			err = util.CloseWriteOrClose(duplex)
+		}
+		fin <- err
+	}()
+	go func() {
+		// TODO: hard code
+		var buf = make([]byte, 4096)
+		_, err := io.CopyBuffer(conn, duplex, buf)
+		if err != nil {
+			conn.Close()
+			duplex.Close()
+		} else {
+			err = util.CloseWriteOrClose(conn)
+		}
+		fin <- err
+	}()
+	return util.CombineErrors(<-fin, <-fin)
+}
+
+// RelayPmuxStream relays conn and a pmux stream until both directions finish, and closes both
+func RelayPmuxStream(conn io.ReadWriteCloser, stream io.ReadWriteCloser) {
+	// NOTE: Tampering is reported even without verbose logging
+	reporter := &authenticationFailureReporter{ReadWriteCloser: stream, name: "pmux stream", once: new(sync.Once)}
+	if err := CopyBidirectionally(conn, reporter); err != nil {
+		Vlog.Log(
+			fmt.Sprintf("error(pmux stream): %v", errors.WithStack(err)),
+			fmt.Sprintf("error(pmux stream): %+v", errors.WithStack(err)),
+		)
+	}
+	conn.Close()
+	stream.Close()
+}
+
+// HeadersWithYamux adds Content-Type of yamux, which advertises route headers of streams when routes is true
+func HeadersWithYamux(headers []piping_util.KeyValue, routes bool) []piping_util.KeyValue {
+	contentType := YamuxMimeType
+	if routes {
+		contentType = mime.FormatMediaType(YamuxMimeType, map[string]string{yamuxRoutesParam: "1"})
+	}
+	return append(headers, piping_util.KeyValue{Key: "Content-Type", Value: contentType})
+}
+
+// YamuxSupervisor keeps a yamux session by re-establishing it after the session dies
+// NOTE: A session dies when the keepalive fails or an HTTP body of Piping Server ends (e.g. a proxy closes idle connections)
+type YamuxSupervisor struct {
+	establish func() (*yamux.Session, error)
+	cond      *sync.Cond
+	session   *yamux.Session
+}
+
+func NewYamuxSupervisor(establish func() (*yamux.Session, error)) *YamuxSupervisor {
+	return &YamuxSupervisor{
+		establish: establish,
+		cond:      sync.NewCond(new(sync.Mutex)),
+	}
+}
+
+// Run establishes a session and re-establishes it after the session dies. It never returns.
+func (s *YamuxSupervisor) Run() {
+	b := backoff.NewExponentialBackoff()
+	for {
+		session, err := s.establish()
+		if err != nil {
+			Vlog.Log(
+				fmt.Sprintf("error(yamux session): %v", errors.WithStack(err)),
+				fmt.Sprintf("error(yamux session): %+v", errors.WithStack(err)),
+			)
+			fmt.Fprintf(InfoOutput, "[WARN] failed to establish yamux session: %s\n", err)
+			// backoff
+			time.Sleep(b.NextDuration())
+			continue
+		}
+		establishedAt := time.Now()
+		s.setSession(session)
+		<-session.CloseChan()
+		s.setSession(nil)
+		fmt.Fprintln(InfoOutput, "[WARN] yamux session closed, re-establishing...")
+		// NOTE: A long-lived session resets the backoff, and a session dying immediately is retried with backoff
+		// TODO: hard code
+		if time.Since(establishedAt) > 1*time.Minute {
+			b.Reset()
+		}
+		// backoff
+		time.Sleep(b.NextDuration())
+	}
+}
+
+func (s *YamuxSupervisor) setSession(session *yamux.Session) {
+	s.cond.L.Lock()
+	s.session = session
+	s.cond.L.Unlock()
+	s.cond.Broadcast()
+}
+
+// waitSession waits for a session other than the dead one
+func (s *YamuxSupervisor) waitSession(dead *yamux.Session) *yamux.Session {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	for s.session == nil || s.session == dead {
+		s.cond.Wait()
+	}
+	return s.session
+}
+
+// Open opens a stream, waiting for the session to be re-established when it is dead
+func (s *YamuxSupervisor) Open() (*yamux.Stream, error) {
+	var dead *yamux.Session
+	for {
+		session := s.waitSession(dead)
+		stream, err := session.OpenStream()
+		if err == nil {
+			return stream, nil
+		}
+		if !session.IsClosed() {
+			return nil, err
+		}
+		dead = session
+	}
+}
+
+// Accept accepts a stream, waiting for the session to be re-established when it is dead
+func (s *YamuxSupervisor) Accept() (*yamux.Stream, error) {
+	var dead *yamux.Session
+	for {
+		session := s.waitSession(dead)
+		stream, err := session.AcceptStream()
+		if err == nil {
+			return stream, nil
+		}
+		if !session.IsClosed() {
+			return nil, err
+		}
+		dead = session
+	}
 }
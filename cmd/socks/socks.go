@@ -1,51 +1,56 @@
 package socks
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/yamux"
 	"github.com/nwtgck/go-piping-tunnel/cmd"
 	"github.com/nwtgck/go-piping-tunnel/piping_util"
-	"github.com/nwtgck/go-piping-tunnel/pmux"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/nwtgck/go-piping-tunnel/socks_proxy"
 	"github.com/nwtgck/go-piping-tunnel/util"
-	"github.com/nwtgck/go-socks"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
-	"io"
+	"net"
 	"net/http"
+	"time"
 )
 
 var flag struct {
-	yamux                          bool
-	pmux                           bool
-	pmuxConfig                     string
-	symmetricallyEncrypts          bool
-	symmetricallyEncryptPassphrase string
-	cipherType                     string
-	pbkdf2JsonString               string
+	cmd.ConnectionFlags
+	cmd.DestinationRuleFlags
+	udpIdleTimeout    time.Duration
+	socksUserStrs     []string
+	socksUserFilePath string
 }
 
 func init() {
 	cmd.RootCmd.AddCommand(socksCmd)
-	socksCmd.Flags().BoolVarP(&flag.yamux, "yamux", "", false, "Multiplex connection by hashicorp/yamux")
-	socksCmd.Flags().BoolVarP(&flag.pmux, cmd.PmuxFlagLongName, "", false, "Multiplex connection by pmux (experimental)")
-	socksCmd.Flags().StringVarP(&flag.pmuxConfig, cmd.PmuxConfigFlagLongName, "", `{"hb": true}`, "pmux config in JSON (experimental)")
-	socksCmd.Flags().BoolVarP(&flag.symmetricallyEncrypts, cmd.SymmetricallyEncryptsFlagLongName, cmd.SymmetricallyEncryptsFlagShortName, false, "Encrypt symmetrically")
-	socksCmd.Flags().StringVarP(&flag.symmetricallyEncryptPassphrase, cmd.SymmetricallyEncryptPassphraseFlagLongName, "", "", "Passphrase for encryption")
-	socksCmd.Flags().StringVarP(&flag.cipherType, cmd.CipherTypeFlagLongName, "", cmd.DefaultCipherType, fmt.Sprintf("Cipher type: %s, %s, %s, %s ", piping_util.CipherTypeAesCtr, piping_util.CipherTypeOpensslAes128Ctr, piping_util.CipherTypeOpensslAes256Ctr, piping_util.CipherTypeOpenpgp))
-	// NOTE: default value of --pbkdf2 should be empty to detect key derive derivation from multiple algorithms in the future.
-	socksCmd.Flags().StringVarP(&flag.pbkdf2JsonString, cmd.Pbkdf2FlagLongName, "", "", fmt.Sprintf("e.g. %s", cmd.ExamplePbkdf2JsonStr()))
+	flag.ConnectionFlags.AddMultiplexerFlags(socksCmd.Flags())
+	flag.ConnectionFlags.AddEncryptionFlags(socksCmd.Flags())
+	flag.DestinationRuleFlags.AddDestinationRuleFlags(socksCmd.Flags())
+	socksCmd.Flags().StringArrayVarP(&flag.socksUserStrs, cmd.SocksUserFlagLongName, "", nil, "Require SOCKS5 username/password authentication (e.g. alice:mypassword)")
+	socksCmd.Flags().StringVarP(&flag.socksUserFilePath, cmd.SocksUserFileFlagLongName, "", "", "File of lines of '<USER>:<PASSWORD>' for SOCKS5 authentication")
+	socksCmd.Flags().DurationVarP(&flag.udpIdleTimeout, cmd.UdpIdleTimeoutFlagLongName, "", time.Minute, "Forget a UDP flow of SOCKS UDP ASSOCIATE after this idle time (0 for no timeout)")
 }
 
 var socksCmd = &cobra.Command{
 	Use:   "socks",
 	Short: "Run SOCKS server",
 	RunE: func(_ *cobra.Command, args []string) error {
-		// Validate cipher-type
-		if flag.symmetricallyEncrypts {
-			if err := cmd.ValidateClientCipher(flag.cipherType); err != nil {
-				return err
-			}
+		if err := flag.Validate(); err != nil {
+			return err
+		}
+		rules, err := flag.DestinationRules()
+		if err != nil {
+			return err
+		}
+		credentials, err := cmd.LoadSocksCredentials(flag.socksUserStrs, flag.socksUserFilePath)
+		if err != nil {
+			return err
+		}
+		publicKeyAuth, err := flag.PublicKeyAuth()
+		if err != nil {
+			return err
 		}
 		clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(args)
 		if err != nil {
@@ -55,11 +60,7 @@ var socksCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		httpClient := util.CreateHttpClient(cmd.Insecure, cmd.HttpWriteBufSize, cmd.HttpReadBufSize)
-		if cmd.DnsServer != "" {
-			// Set DNS resolver
-			httpClient.Transport.(*http.Transport).DialContext = util.CreateDialContext(cmd.DnsServer)
-		}
+		httpClient := cmd.NewHttpClient()
 		serverToClientUrl, err := util.UrlJoin(cmd.ServerUrl, serverToClientPath)
 		if err != nil {
 			return err
@@ -71,52 +72,46 @@ var socksCmd = &cobra.Command{
 		// Print hint
 		socksPrintHintForClientHost(clientToServerPath, serverToClientPath)
 		// Make user input passphrase if it is empty
-		if flag.symmetricallyEncrypts {
-			err = cmd.MakeUserInputPassphraseIfEmpty(&flag.symmetricallyEncryptPassphrase)
-			if err != nil {
-				return err
-			}
+		if err := flag.InputPassphraseIfNeed(); err != nil {
+			return err
 		}
 
 		// If not using multiplexer
-		if !flag.yamux && !flag.pmux {
-			return errors.Errorf("--%s or --%s must be specified", cmd.YamuxFlagLongName, cmd.PmuxFlagLongName)
+		if err := flag.ValidateMultiplexer(); err != nil {
+			return err
 		}
 
-		socksConf := &socks.Config{}
-		socksServer, err := socks.New(socksConf)
+		socksServer := socks_proxy.New(&socks_proxy.Config{
+			Credentials:    credentials,
+			Rules:          rules,
+			UdpIdleTimeout: flag.udpIdleTimeout,
+		})
 
 		// If yamux is enabled
-		if flag.yamux {
+		if flag.Yamux {
 			fmt.Println("[INFO] Multiplexing with hashicorp/yamux")
-			return socksHandleWithYamux(socksServer, httpClient, headers, clientToServerUrl, serverToClientUrl)
+			return socksHandleWithYamux(socksServer, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 		}
 
 		// If pmux is enabled
 		fmt.Println("[INFO] Multiplexing with pmux")
-		return socksHandleWithPmux(socksServer, httpClient, headers, clientToServerUrl, serverToClientUrl)
+		return socksHandleWithPmux(socksServer, httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth)
 	},
 }
 
+func serveStream(socksServer *socks_proxy.Server, conn net.Conn) {
+	err := socksServer.ServeConn(conn)
+	if err != nil {
+		cmd.Vlog.Log(
+			fmt.Sprintf("error(serve conn): %v", errors.WithStack(err)),
+			fmt.Sprintf("error(serve conn): %+v", errors.WithStack(err)),
+		)
+	}
+}
+
 // NOTE: multiplexing should be enabled, so there is no socat-curl hint
 func socksPrintHintForClientHost(clientToServerPath string, serverToClientPath string) {
-	flags := ""
-	if flag.symmetricallyEncrypts {
-		flags += fmt.Sprintf("-%s ", cmd.SymmetricallyEncryptsFlagShortName)
-		flags += fmt.Sprintf("--%s=%s ", cmd.CipherTypeFlagLongName, flag.cipherType)
-		switch flag.cipherType {
-		case piping_util.CipherTypeOpensslAes128Ctr:
-			fallthrough
-		case piping_util.CipherTypeOpensslAes256Ctr:
-			flags += fmt.Sprintf("--%s='%s' ", cmd.Pbkdf2FlagLongName, flag.pbkdf2JsonString)
-		}
-	}
-	if flag.yamux {
-		flags += fmt.Sprintf("--%s ", cmd.YamuxFlagLongName)
-	}
-	if flag.pmux {
-		flags += fmt.Sprintf("--%s ", cmd.PmuxFlagLongName)
-	}
+	flags := flag.HintFlags()
 	fmt.Println("[INFO] Hint: Client host (piping-tunnel)")
 	fmt.Printf(
 		"  piping-tunnel -s %s client -p 1080 %s%s %s\n",
@@ -127,61 +122,34 @@ func socksPrintHintForClientHost(clientToServerPath string, serverToClientPath s
 	)
 }
 
-func socksHandleWithYamux(socksServer *socks.Server, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string) error {
-	var duplex io.ReadWriteCloser
-	duplex, err := piping_util.DuplexConnectWithHandlers(
-		func(body io.Reader) (*http.Response, error) {
-			return piping_util.PipingSend(httpClient, cmd.HeadersWithYamux(headers), serverToClientUrl, body)
-		},
-		func() (*http.Response, error) {
-			res, err := piping_util.PipingGet(httpClient, headers, clientToServerUrl)
-			if err != nil {
-				return nil, err
-			}
-			contentType := res.Header.Get("Content-Type")
-			// NOTE: application/octet-stream is for compatibility
-			if contentType != cmd.YamuxMimeType && contentType != "application/octet-stream" {
-				return nil, errors.Errorf("invalid content-type: %s", contentType)
-			}
-			return res, nil
-		},
-	)
-	duplex, err = cmd.MakeDuplexWithEncryptionAndProgressIfNeed(duplex, flag.symmetricallyEncrypts, flag.symmetricallyEncryptPassphrase, flag.cipherType, flag.pbkdf2JsonString)
-	if err != nil {
-		return err
-	}
-	yamuxSession, err := yamux.Server(duplex, nil)
-	if err != nil {
-		return err
-	}
+func socksHandleWithYamux(socksServer *socks_proxy.Server, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+		return flag.YamuxSession(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth, cmd.RequireYamuxContentType, yamux.Server)
+	})
+	go supervisor.Run()
 	for {
-		yamuxStream, err := yamuxSession.Accept()
+		yamuxStream, err := supervisor.Accept()
 		if err != nil {
 			return err
 		}
-		go socksServer.ServeConn(yamuxStream)
+		go serveStream(socksServer, yamuxStream)
 	}
 }
 
-func socksHandleWithPmux(socksServer *socks.Server, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string) error {
-	var config cmd.ServerPmuxConfigJson
-	if json.Unmarshal([]byte(flag.pmuxConfig), &config) != nil {
-		return errors.Errorf("invalid pmux config format")
+func socksHandleWithPmux(socksServer *socks_proxy.Server, httpClient *http.Client, headers []piping_util.KeyValue, clientToServerUrl string, serverToClientUrl string, publicKeyAuth *pubkey_duplex.Config) error {
+	acceptPmuxStream, err := flag.PmuxAccepter(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth)
+	if err != nil {
+		return err
 	}
-	pmuxServer := pmux.Server(httpClient, headers, serverToClientUrl, clientToServerUrl, config.Hb, flag.symmetricallyEncrypts, flag.symmetricallyEncryptPassphrase, flag.cipherType)
 	for {
-		stream, err := pmuxServer.Accept()
+		stream, err := acceptPmuxStream()
 		if err != nil {
-			return err
+			cmd.Vlog.Log(
+				fmt.Sprintf("error(pmux accept): %v", errors.WithStack(err)),
+				fmt.Sprintf("error(pmux accept): %+v", errors.WithStack(err)),
+			)
+			continue
 		}
-		go func() {
-			err := socksServer.ServeConn(util.NewDuplexConn(stream))
-			if err != nil {
-				cmd.Vlog.Log(
-					fmt.Sprintf("error(serve conn): %v", errors.WithStack(err)),
-					fmt.Sprintf("error(serve conn): %+v", errors.WithStack(err)),
-				)
-			}
-		}()
+		go serveStream(socksServer, util.NewDuplexConn(stream))
 	}
 }
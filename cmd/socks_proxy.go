@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/nwtgck/go-piping-tunnel/allowlist"
+	"github.com/nwtgck/go-piping-tunnel/socks_proxy"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"os"
+)
+
+// DestinationRuleFlags are --allow, --deny and --rules-file shared by proxy commands
+type DestinationRuleFlags struct {
+	AllowStrs     []string
+	DenyStrs      []string
+	RulesFilePath string
+}
+
+// AddDestinationRuleFlags adds --allow, --deny and --rules-file
+func (f *DestinationRuleFlags) AddDestinationRuleFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVarP(&f.AllowStrs, AllowFlagLongName, "", nil, "Destination allowed to connect (e.g. 10.0.0.0/8, *.internal:5432, example.com:80-443)")
+	flags.StringArrayVarP(&f.DenyStrs, DenyFlagLongName, "", nil, "Destination denied to connect, which takes precedence over --allow (e.g. 169.254.169.254)")
+	flags.StringVarP(&f.RulesFilePath, RulesFileFlagLongName, "", "", "File of lines of 'allow <DESTINATION>' or 'deny <DESTINATION>'")
+}
+
+// DestinationRules parses the flags (nil permits all)
+func (f *DestinationRuleFlags) DestinationRules() (*allowlist.Rules, error) {
+	return ParseDestinationRules(f.AllowStrs, f.DenyStrs, f.RulesFilePath)
+}
+
+// ParseDestinationRules parses --allow, --deny and --rules-file (nil permits all)
+func ParseDestinationRules(allowStrs []string, denyStrs []string, rulesFilePath string) (*allowlist.Rules, error) {
+	if rulesFilePath != "" {
+		file, err := os.Open(rulesFilePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		fileAllowStrs, fileDenyStrs, err := allowlist.ReadRulesFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "--%s", RulesFileFlagLongName)
+		}
+		allowStrs = append(allowStrs, fileAllowStrs...)
+		denyStrs = append(denyStrs, fileDenyStrs...)
+	}
+	return allowlist.ParseRules(allowStrs, denyStrs)
+}
+
+// LoadSocksCredentials loads --socks-user and --socks-user-file (nil for no authentication)
+func LoadSocksCredentials(userStrs []string, userFilePath string) (socks_proxy.Credentials, error) {
+	if userFilePath != "" {
+		file, err := os.Open(userFilePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		fileUserStrs, err := socks_proxy.ReadUserFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "--%s", SocksUserFileFlagLongName)
+		}
+		userStrs = append(userStrs, fileUserStrs...)
+	}
+	credentials, err := socks_proxy.ParseCredentials(userStrs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "--%s", SocksUserFlagLongName)
+	}
+	return credentials, nil
+}
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const StdioFlagLongName = "stdio"
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string {
+	return "stdio"
+}
+
+func (stdioAddr) String() string {
+	return "stdio"
+}
+
+// StdioConn is a connection of stdin and stdout such as ProxyCommand of ssh
+type StdioConn struct {
+	stdin      io.ReadCloser
+	stdout     io.WriteCloser
+	closeOnce  *sync.Once
+	closedCh   chan struct{}
+	writeMutex *sync.Mutex
+}
+
+func (c *StdioConn) Read(b []byte) (int, error) {
+	return c.stdin.Read(b)
+}
+
+func (c *StdioConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.stdout.Write(b)
+}
+
+// CloseWrite closes stdout, which notifies the parent process of EOF
+func (c *StdioConn) CloseWrite() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.stdout.Close()
+}
+
+func (c *StdioConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.CloseWrite()
+		close(c.closedCh)
+	})
+	return nil
+}
+
+func (c *StdioConn) LocalAddr() net.Addr {
+	return stdioAddr{}
+}
+
+func (c *StdioConn) RemoteAddr() net.Addr {
+	return stdioAddr{}
+}
+
+// NOTE: Deadlines are not supported because stdin and stdout may not be pollable
+func (c *StdioConn) SetDeadline(t time.Time) error {
+	return errors.New("stdio does not support deadlines")
+}
+
+func (c *StdioConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *StdioConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+// stdioListener accepts the connection of stdio only once
+type stdioListener struct {
+	conn     *StdioConn
+	acceptCh chan *StdioConn
+	closedCh chan struct{}
+	once     *sync.Once
+}
+
+// ListenStdio returns a listener accepting only one connection of stdin and stdout
+// Accept() after the first one returns net.ErrClosed when the connection or the listener is closed.
+func ListenStdio(stdin io.ReadCloser, stdout io.WriteCloser) net.Listener {
+	conn := &StdioConn{
+		stdin:      stdin,
+		stdout:     stdout,
+		closeOnce:  new(sync.Once),
+		closedCh:   make(chan struct{}),
+		writeMutex: new(sync.Mutex),
+	}
+	acceptCh := make(chan *StdioConn, 1)
+	acceptCh <- conn
+	return &stdioListener{conn: conn, acceptCh: acceptCh, closedCh: make(chan struct{}), once: new(sync.Once)}
+}
+
+func (l *stdioListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	default:
+	}
+	select {
+	case <-l.conn.closedCh:
+	case <-l.closedCh:
+	}
+	return nil, net.ErrClosed
+}
+
+// NOTE: Close() does not close the accepted connection like net.Listener
+func (l *stdioListener) Close() error {
+	l.once.Do(func() {
+		close(l.closedCh)
+	})
+	return nil
+}
+
+func (l *stdioListener) Addr() net.Addr {
+	return stdioAddr{}
+}
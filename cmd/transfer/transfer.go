@@ -0,0 +1,139 @@
+package transfer
+
+import (
+	"fmt"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/file_transfer"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+)
+
+const OutputDirFlagLongName = "output-dir"
+const OutputDirFlagShortName = "o"
+
+var flag struct {
+	cmd.ConnectionFlags
+	outputDir string
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(sendCmd)
+	cmd.RootCmd.AddCommand(receiveCmd)
+	receiveCmd.Flags().StringVarP(&flag.outputDir, OutputDirFlagLongName, OutputDirFlagShortName, ".", "Directory to save received files")
+	flag.ConnectionFlags.AddEncryptionFlags(sendCmd.Flags())
+	flag.ConnectionFlags.AddEncryptionFlags(receiveCmd.Flags())
+}
+
+var sendCmd = &cobra.Command{
+	Use:   "send [flags] <PATH> [PATH] -- <FILE|DIRECTORY>...",
+	Short: "Send files and directories to receive command with SHA-256 verification",
+	RunE: func(c *cobra.Command, args []string) error {
+		dashIdx := c.ArgsLenAtDash()
+		if dashIdx < 0 || dashIdx == len(args) {
+			return errors.Errorf("files or directories should be specified after --")
+		}
+		clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(args[:dashIdx])
+		if err != nil {
+			return err
+		}
+		duplex, err := connect(clientToServerPath, serverToClientPath, false)
+		if err != nil {
+			return err
+		}
+		defer duplex.Close()
+		err = file_transfer.Send(duplex, args[dashIdx:], func(entry *file_transfer.Entry) {
+			if entry.Offset != 0 {
+				printInfo("[INFO] Sending %s (%s, resumed from %s)\n", entry.Name, util.HumanizeBytes(float64(entry.Size)), util.HumanizeBytes(float64(entry.Offset)))
+				return
+			}
+			printInfo("[INFO] Sending %s (%s)\n", entry.Name, util.HumanizeBytes(float64(entry.Size)))
+		})
+		if err != nil {
+			return err
+		}
+		printInfo("[INFO] All files verified by receiver\n")
+		return nil
+	},
+}
+
+var receiveCmd = &cobra.Command{
+	Use:   "receive [flags] <PATH> [PATH]",
+	Short: "Receive files and directories from send command with SHA-256 verification",
+	RunE: func(_ *cobra.Command, args []string) error {
+		clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(args)
+		if err != nil {
+			return err
+		}
+		duplex, err := connect(clientToServerPath, serverToClientPath, true)
+		if err != nil {
+			return err
+		}
+		defer duplex.Close()
+		err = file_transfer.Receive(duplex, flag.outputDir, func(entry *file_transfer.Entry) {
+			printInfo("[INFO] Received %s (SHA-256: %s)\n", entry.Name, entry.Sha256)
+		})
+		if err != nil {
+			// NOTE: The next receive resumes the partially received files
+			return errors.Wrapf(err, "partially received files are kept with %s", file_transfer.PartSuffix)
+		}
+		printInfo("[INFO] All files received\n")
+		return nil
+	},
+}
+
+// printInfo prints the information on the next line of the progress
+func printInfo(format string, a ...interface{}) {
+	if cmd.ShowProgress {
+		fmt.Println()
+	}
+	fmt.Printf(format, a...)
+}
+
+// connect validates flags and makes the duplex, where the receiver uploads to serverToClientPath
+func connect(clientToServerPath string, serverToClientPath string, receives bool) (io.ReadWriteCloser, error) {
+	if err := flag.Validate(); err != nil {
+		return nil, err
+	}
+	publicKeyAuth, err := flag.PublicKeyAuth()
+	if err != nil {
+		return nil, err
+	}
+	headers, err := piping_util.ParseKeyValueStrings(cmd.HeaderKeyValueStrs)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := cmd.NewHttpClient()
+	clientToServerUrl, err := util.UrlJoin(cmd.ServerUrl, clientToServerPath)
+	if err != nil {
+		return nil, err
+	}
+	serverToClientUrl, err := util.UrlJoin(cmd.ServerUrl, serverToClientPath)
+	if err != nil {
+		return nil, err
+	}
+	// Print hint
+	printHintForPeer(clientToServerPath, serverToClientPath, receives)
+	// Make user input passphrase if it is empty
+	if err := flag.InputPassphraseIfNeed(); err != nil {
+		return nil, err
+	}
+	uploadUrl, downloadUrl := clientToServerUrl, serverToClientUrl
+	if receives {
+		uploadUrl, downloadUrl = serverToClientUrl, clientToServerUrl
+	}
+	return flag.DuplexConnect(httpClient, headers, uploadUrl, downloadUrl, publicKeyAuth)
+}
+
+func printHintForPeer(clientToServerPath string, serverToClientPath string, receives bool) {
+	flags := flag.HintFlags()
+	if receives {
+		fmt.Println("[INFO] Hint: Sending host (piping-tunnel)")
+		fmt.Printf("  piping-tunnel -s %s send %s%s %s -- <FILE|DIRECTORY>...\n", cmd.ServerUrl, flags, clientToServerPath, serverToClientPath)
+		return
+	}
+	fmt.Println("[INFO] Hint: Receiving host (piping-tunnel)")
+	fmt.Printf("  piping-tunnel -s %s receive %s%s %s\n", cmd.ServerUrl, flags, clientToServerPath, serverToClientPath)
+}
@@ -0,0 +1,192 @@
+package vpn
+
+import (
+	"fmt"
+	"github.com/hashicorp/yamux"
+	"github.com/nwtgck/go-piping-tunnel/backoff"
+	"github.com/nwtgck/go-piping-tunnel/cmd"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/tun"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"time"
+)
+
+var flag struct {
+	cmd.ConnectionFlags
+	client     bool
+	deviceName string
+	address    string
+	mtu        int
+	routes     []string
+}
+
+func init() {
+	cmd.RootCmd.AddCommand(vpnCmd)
+	vpnCmd.Flags().BoolVarP(&flag.client, "client", "", false, "Run as client host (the other host runs without this flag)")
+	vpnCmd.Flags().StringVarP(&flag.deviceName, "device", "", "", "Name of TUN device (default: assigned by the kernel such as tun0)")
+	vpnCmd.Flags().StringVarP(&flag.address, "address", "", "", "Address of this host in the VPN in CIDR notation (e.g. 10.8.0.1/24)")
+	vpnCmd.Flags().IntVarP(&flag.mtu, "mtu", "", 1400, "MTU of TUN device, which should be the same in both hosts")
+	vpnCmd.Flags().StringArrayVarP(&flag.routes, "route", "", nil, "Network routed to the other host (e.g. 192.168.10.0/24)")
+	flag.ConnectionFlags.AddMultiplexerFlags(vpnCmd.Flags())
+	flag.ConnectionFlags.AddEncryptionFlags(vpnCmd.Flags())
+}
+
+var vpnCmd = &cobra.Command{
+	Use:   "vpn",
+	Short: "Run layer-3 VPN with TUN device (Linux)",
+	RunE: func(_ *cobra.Command, args []string) error {
+		if err := flag.Validate(); err != nil {
+			return err
+		}
+		// If not using multiplexer
+		if err := flag.ValidateMultiplexer(); err != nil {
+			return err
+		}
+		if _, _, err := net.ParseCIDR(flag.address); err != nil {
+			return errors.Errorf("invalid --address '%s': e.g. 10.8.0.1/24", flag.address)
+		}
+		for _, route := range flag.routes {
+			if _, _, err := net.ParseCIDR(route); err != nil {
+				return errors.Errorf("invalid --route '%s': e.g. 192.168.10.0/24", route)
+			}
+		}
+		// NOTE: 1280 is the minimum MTU of IPv6
+		if flag.mtu < 1280 || 65535 < flag.mtu {
+			return errors.Errorf("--mtu should be between 1280 and 65535")
+		}
+		publicKeyAuth, err := flag.PublicKeyAuth()
+		if err != nil {
+			return err
+		}
+		clientToServerPath, serverToClientPath, err := cmd.GeneratePaths(args)
+		if err != nil {
+			return err
+		}
+		headers, err := piping_util.ParseKeyValueStrings(cmd.HeaderKeyValueStrs)
+		if err != nil {
+			return err
+		}
+		httpClient := cmd.NewHttpClient()
+		serverToClientUrl, err := util.UrlJoin(cmd.ServerUrl, serverToClientPath)
+		if err != nil {
+			return err
+		}
+		clientToServerUrl, err := util.UrlJoin(cmd.ServerUrl, clientToServerPath)
+		if err != nil {
+			return err
+		}
+		device, err := tun.Open(flag.deviceName)
+		if err != nil {
+			return err
+		}
+		defer device.Close()
+		if err := device.Configure(flag.address, flag.mtu, flag.routes); err != nil {
+			return err
+		}
+		fmt.Printf("[INFO] VPN device %s with %s (MTU %d)\n", device.Name(), flag.address, flag.mtu)
+		// Print hint
+		vpnPrintHintForPeer(clientToServerPath, serverToClientPath)
+		// Make user input passphrase if it is empty
+		if err := flag.InputPassphraseIfNeed(); err != nil {
+			return err
+		}
+		relay := tun.NewRelay(device, flag.mtu)
+
+		// If yamux is enabled
+		if flag.Yamux {
+			fmt.Println("[INFO] Multiplexing with hashicorp/yamux")
+			uploadUrl, downloadUrl, newSession := serverToClientUrl, clientToServerUrl, yamux.Server
+			if flag.client {
+				uploadUrl, downloadUrl, newSession = clientToServerUrl, serverToClientUrl, yamux.Client
+			}
+			supervisor := cmd.NewYamuxSupervisor(func() (*yamux.Session, error) {
+				return flag.YamuxSession(httpClient, headers, uploadUrl, downloadUrl, publicKeyAuth, cmd.WarnYamuxContentType("the other host"), newSession)
+			})
+			go supervisor.Run()
+			if flag.client {
+				return relayLoop(relay, func() (io.ReadWriteCloser, error) {
+					return supervisor.Open()
+				})
+			}
+			for {
+				yamuxStream, err := supervisor.Accept()
+				if err != nil {
+					return err
+				}
+				go serveStream(relay, yamuxStream)
+			}
+		}
+
+		// If pmux is enabled
+		fmt.Println("[INFO] Multiplexing with pmux")
+		if flag.client {
+			openPmuxStream, err := flag.PmuxOpener(httpClient, headers, clientToServerUrl, serverToClientUrl, publicKeyAuth, "the other host")
+			if err != nil {
+				return err
+			}
+			return relayLoop(relay, openPmuxStream)
+		}
+		acceptPmuxStream, err := flag.PmuxAccepter(httpClient, headers, serverToClientUrl, clientToServerUrl, publicKeyAuth)
+		if err != nil {
+			return err
+		}
+		for {
+			stream, err := acceptPmuxStream()
+			if err != nil {
+				cmd.Vlog.Log(
+					fmt.Sprintf("error(pmux accept): %v", errors.WithStack(err)),
+					fmt.Sprintf("error(pmux accept): %+v", errors.WithStack(err)),
+				)
+				continue
+			}
+			go serveStream(relay, stream)
+		}
+	},
+}
+
+func serveStream(relay *tun.Relay, stream io.ReadWriteCloser) {
+	fmt.Println("[INFO] VPN connected")
+	err := relay.Serve(stream)
+	fmt.Printf("[WARN] VPN disconnected: %s\n", err)
+}
+
+// NOTE: Packets have no end of connection, so the stream is always opened again
+func relayLoop(relay *tun.Relay, open func() (io.ReadWriteCloser, error)) error {
+	b := backoff.NewExponentialBackoff()
+	for {
+		stream, err := open()
+		if err != nil {
+			fmt.Printf("[WARN] %s\n", err)
+			// backoff
+			time.Sleep(b.NextDuration())
+			continue
+		}
+		b.Reset()
+		serveStream(relay, stream)
+	}
+}
+
+// NOTE: multiplexing should be enabled, so there is no socat-curl hint
+func vpnPrintHintForPeer(clientToServerPath string, serverToClientPath string) {
+	flags := flag.HintFlags()
+	if flag.mtu != 1400 {
+		flags += fmt.Sprintf("--mtu %d ", flag.mtu)
+	}
+	if flag.client {
+		fmt.Println("[INFO] Hint: Server host (piping-tunnel)")
+	} else {
+		fmt.Println("[INFO] Hint: Client host (piping-tunnel)")
+		flags = "--client " + flags
+	}
+	fmt.Printf(
+		"  piping-tunnel -s %s vpn --address <ADDRESS> %s%s %s\n",
+		cmd.ServerUrl,
+		flags,
+		clientToServerPath,
+		serverToClientPath,
+	)
+}
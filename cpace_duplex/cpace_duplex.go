@@ -0,0 +1,165 @@
+package cpace_duplex
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"filippo.io/edwards25519/field"
+	"github.com/nwtgck/go-piping-tunnel/aead_duplex"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// CPace over X25519 (base: https://datatracker.ietf.org/doc/draft-irtf-cfrg-cpace/)
+// NOTE: Both sides play the same role, so transcripts are ordered by bytes.Compare
+
+const dsi = "CPace255"
+const iskDsi = "CPace255_ISK"
+const confirmLen = sha256.Size
+const keyLen = 32
+
+var PassphraseMismatchError = errors.New("key confirmation failed: passphrase mismatch or the stream may have been tampered with")
+var SamePublicKeyError = errors.New("peer sent the same public key: the stream may have been reflected")
+
+const montgomeryA = 486662
+
+// Duplex runs CPace handshake with the peer and makes an AEAD duplex with the session keys
+func Duplex(baseWriter io.WriteCloser, baseReader io.ReadCloser, passphrase []byte, c *aead_duplex.Cipher) (io.ReadWriteCloser, error) {
+	ci := []byte("piping-tunnel " + c.Name)
+	generator := calculateGenerator(passphrase, ci)
+	scalar, err := util.GenerateRandomBytes(curve25519.ScalarSize)
+	if err != nil {
+		return nil, err
+	}
+	ownPublic, err := curve25519.X25519(scalar, generator)
+	if err != nil {
+		return nil, err
+	}
+	// Send the public share
+	if _, err := baseWriter.Write(ownPublic); err != nil {
+		return nil, err
+	}
+	// Read the public share of the peer
+	peerPublic := make([]byte, curve25519.PointSize)
+	if _, err := io.ReadFull(baseReader, peerPublic); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(ownPublic, peerPublic) {
+		return nil, SamePublicKeyError
+	}
+	// NOTE: X25519 returns an error for a low-order point
+	k, err := curve25519.X25519(scalar, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	isk := sha512.Sum512(lvCat([]byte(iskDsi), k, orderedCat(ownPublic, peerPublic)))
+
+	// Key confirmation
+	if _, err := baseWriter.Write(confirmationTag(isk[:], ownPublic, peerPublic)); err != nil {
+		return nil, err
+	}
+	peerTag := make([]byte, confirmLen)
+	if _, err := io.ReadFull(baseReader, peerTag); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(peerTag, confirmationTag(isk[:], peerPublic, ownPublic)) {
+		return nil, PassphraseMismatchError
+	}
+
+	sendKey, err := deriveKey(isk[:], ownPublic, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	receiveKey, err := deriveKey(isk[:], peerPublic, ownPublic)
+	if err != nil {
+		return nil, err
+	}
+	return aead_duplex.DuplexWithKeys(baseWriter, baseReader, sendKey, receiveKey, c)
+}
+
+func confirmationTag(isk []byte, senderPublic []byte, receiverPublic []byte) []byte {
+	mac := hmac.New(sha256.New, isk)
+	mac.Write([]byte("piping-tunnel cpace confirm"))
+	mac.Write(senderPublic)
+	mac.Write(receiverPublic)
+	return mac.Sum(nil)
+}
+
+func deriveKey(isk []byte, senderPublic []byte, receiverPublic []byte) ([]byte, error) {
+	info := append([]byte("piping-tunnel cpace key "), senderPublic...)
+	info = append(info, receiverPublic...)
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, isk, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// lvCat concatenates with length prefixes
+func lvCat(items ...[]byte) []byte {
+	var buf []byte
+	for _, item := range items {
+		var lenBytes [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(lenBytes[:], uint64(len(item)))
+		buf = append(buf, lenBytes[:n]...)
+		buf = append(buf, item...)
+	}
+	return buf
+}
+
+func orderedCat(a []byte, b []byte) []byte {
+	if bytes.Compare(a, b) < 0 {
+		return append(append([]byte{}, a...), b...)
+	}
+	return append(append([]byte{}, b...), a...)
+}
+
+func calculateGenerator(passphrase []byte, ci []byte) []byte {
+	// NOTE: zero padding makes the passphrase fill the first block of SHA-512
+	zpadLen := sha512.BlockSize - 1 - len(lvCat([]byte(dsi), passphrase))
+	if zpadLen < 0 {
+		zpadLen = 0
+	}
+	h := sha512.Sum512(lvCat([]byte(dsi), passphrase, make([]byte, zpadLen), ci))
+	return elligator2(h[:32])
+}
+
+// montgomeryRhs returns u^3 + A*u^2 + u
+func montgomeryRhs(u *field.Element) *field.Element {
+	// NOTE: u * (u^2 + A*u + 1)
+	rhs := new(field.Element).Square(u)
+	rhs.Add(rhs, new(field.Element).Mult32(u, montgomeryA))
+	rhs.Add(rhs, new(field.Element).One())
+	return rhs.Multiply(rhs, u)
+}
+
+// isSquare returns 1 when x is a square including 0, otherwise 0, in constant time
+func isSquare(x *field.Element) int {
+	_, wasSquare := new(field.Element).SqrtRatio(x, new(field.Element).One())
+	return wasSquare
+}
+
+// elligator2 maps 32 bytes to the u-coordinate of a point on Curve25519 in constant time (base: RFC 9380, Section 6.7.1)
+func elligator2(b []byte) []byte {
+	// NOTE: SetBytes() ignores the most significant bit and accepts non-canonical values
+	r, err := new(field.Element).SetBytes(b)
+	if err != nil {
+		panic(err)
+	}
+	a := new(field.Element).Mult32(new(field.Element).One(), montgomeryA)
+	minusA := new(field.Element).Negate(a)
+	// x1 = -A / (1 + 2r^2), where x1 = -A when the denominator is 0
+	denominator := new(field.Element).Square(r)
+	denominator.Add(denominator, denominator)
+	denominator.Add(denominator, new(field.Element).One())
+	x1 := new(field.Element).Multiply(minusA, new(field.Element).Invert(denominator))
+	x1.Select(minusA, x1, x1.Equal(new(field.Element).Zero()))
+	// x2 = -x1 - A
+	x2 := new(field.Element).Subtract(minusA, x1)
+	return new(field.Element).Select(x1, x2, isSquare(montgomeryRhs(x1))).Bytes()
+}
@@ -0,0 +1,128 @@
+package cpace_duplex
+
+import (
+	"bytes"
+	"encoding/hex"
+	"filippo.io/edwards25519/field"
+	"github.com/nwtgck/go-piping-tunnel/aead_duplex"
+	"io"
+	"os"
+	"testing"
+)
+
+type result struct {
+	duplex io.ReadWriteCloser
+	err    error
+}
+
+func handshake(t *testing.T, passphrase1 string, passphrase2 string) (result, result) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan result)
+	go func() {
+		d, err := Duplex(w2, r1, []byte(passphrase2), aead_duplex.Chacha20Poly1305)
+		ch <- result{d, err}
+	}()
+	d, err := Duplex(w1, r2, []byte(passphrase1), aead_duplex.Chacha20Poly1305)
+	res1 := result{d, err}
+	res2 := <-ch
+	t.Cleanup(func() {
+		for _, f := range []*os.File{r1, w1, r2, w2} {
+			f.Close()
+		}
+	})
+	return res1, res2
+}
+
+func TestDuplex(t *testing.T) {
+	res1, res2 := handshake(t, "1234", "1234")
+	if res1.err != nil {
+		t.Fatal(res1.err)
+	}
+	if res2.err != nil {
+		t.Fatal(res2.err)
+	}
+	go func() {
+		res1.duplex.Write([]byte("hello"))
+		res1.duplex.Close()
+	}()
+	body, err := io.ReadAll(res2.duplex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestPassphraseMismatch(t *testing.T) {
+	res1, res2 := handshake(t, "1234", "1235")
+	if res1.err != PassphraseMismatchError {
+		t.Fatalf("expected passphrase mismatch but found: %v", res1.err)
+	}
+	if res2.err != PassphraseMismatchError {
+		t.Fatalf("expected passphrase mismatch but found: %v", res2.err)
+	}
+}
+
+func TestElligator2IsOnCurve(t *testing.T) {
+	for i := 0; i < 64; i++ {
+		u, err := new(field.Element).SetBytes(elligator2(bytes.Repeat([]byte{byte(i * 7)}, 32)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isSquare(montgomeryRhs(u)) != 1 {
+			t.Fatalf("not on curve: %x", u.Bytes())
+		}
+	}
+}
+
+func TestGeneratorDependsOnPassphrase(t *testing.T) {
+	g1 := calculateGenerator([]byte("1234"), []byte("ci"))
+	g2 := calculateGenerator([]byte("1235"), []byte("ci"))
+	if bytes.Equal(g1, g2) {
+		t.Fatal("generators should be different")
+	}
+}
+
+func littleEndian(t *testing.T, bigEndianHex string) []byte {
+	b, err := hex.DecodeString(bigEndianHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+// NOTE: Vectors of edwards25519_XMD:SHA-512_ELL2_NU_ (base: RFC 9380, Appendix J.5.2), where Q is mapped from Curve25519 by u = (1 + y) / (1 - y)
+func TestElligator2Vectors(t *testing.T) {
+	for _, v := range []struct {
+		u  string
+		qy string
+	}{
+		{u: "7f3e7fb9428103ad7f52db32f9df32505d7b427d894c5093f7a0f0374a30641d", qy: "22cb4aaa555e23bd460262d2130d6a3c9207aa8bbb85060928beb263d6d42a95"},
+		{u: "09cfa30ad79bd59456594a0f5d3a76f6b71c6787b04de98be5cd201a556e253b", qy: "51b6f178eb08c4a782c820e306b82c6e273ab22e258d972cd0c511787b2a3443"},
+		{u: "475ccff99225ef90d78cc9338e9f6a6bb7b17607c0c4428937de75d33edba941", qy: "5b9ea3c265ee42256a8f724f616307ef38496ef7eba391c08f99f3bea6fa88f0"},
+		{u: "049a1c8bd51bcb2aec339f387d1ff51428b88d0763a91bcdf6929814ac95d03d", qy: "5102353883d739bdc9f8a3af650342b171217167dcce34f8db57208ec1dfdbf2"},
+		{u: "3cb0178a8137cefa5b79a3a57c858d7eeeaa787b2781be4a362a2f0750d24fa0", qy: "38fb39f1566ca118ae6c7af42810c0bb9767ae5960abb5a8ca792530bfb9447d"},
+	} {
+		y, err := new(field.Element).SetBytes(littleEndian(t, v.qy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		one := new(field.Element).One()
+		expected := new(field.Element).Add(one, y)
+		expected.Multiply(expected, new(field.Element).Invert(new(field.Element).Subtract(one, y)))
+		if actual := elligator2(littleEndian(t, v.u)); !bytes.Equal(actual, expected.Bytes()) {
+			t.Fatalf("u=%s: expected %x but found %x", v.u, expected.Bytes(), actual)
+		}
+	}
+}
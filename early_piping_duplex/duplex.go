@@ -79,6 +79,11 @@ func (pd *pipingDuplex) Write(b []byte) (n int, err error) {
 	return pd.uploadWriter.Write(b)
 }
 
+// CloseWrite finishes the upload, which notifies the peer of EOF
+func (pd *pipingDuplex) CloseWrite() error {
+	return pd.uploadWriter.Close()
+}
+
 func (pd *pipingDuplex) Close() error {
 	var wErr, rErr error
 	if pd.uploadWriter != nil {
@@ -0,0 +1,264 @@
+package exec_tunnel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// NOTE: A frame is its type (1 byte), the length of the payload (4 bytes) and the payload
+const (
+	// client-host to server-host
+	frameRequest    byte = 1
+	frameStdin      byte = 2
+	frameStdinEof   byte = 3
+	frameWindowSize byte = 4
+	// server-host to client-host
+	frameStdout byte = 5
+	frameStderr byte = 6
+	frameExit   byte = 7
+)
+
+const maxFramePayloadLen = 1 << 20
+
+// The chunk size of stdin and stdout
+const chunkLen = 32 * 1024
+
+// Exit code when the command cannot be started like shells
+const commandNotFoundExitCode = 127
+
+type Request struct {
+	// NOTE: Empty command runs the shell of server host
+	Command []string `json:"command"`
+	Pty     bool     `json:"pty"`
+	Term    string   `json:"term,omitempty"`
+	Rows    uint16   `json:"rows,omitempty"`
+	Cols    uint16   `json:"cols,omitempty"`
+}
+
+type WindowSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// frameWriter writes frames from multiple goroutines
+type frameWriter struct {
+	w     io.Writer
+	mutex *sync.Mutex
+}
+
+func (w *frameWriter) writeFrame(frameType byte, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[5:], payload)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := w.w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > maxFramePayloadLen {
+		return 0, nil, errors.Errorf("too large frame: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// streamWriter writes data as frames of the type
+type streamWriter struct {
+	fw        *frameWriter
+	frameType byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += chunkLen {
+		end := i + chunkLen
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := w.fw.writeFrame(w.frameType, p[i:end]); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+func encodeWindowSize(size WindowSize) []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload, size.Rows)
+	binary.BigEndian.PutUint16(payload[2:], size.Cols)
+	return payload
+}
+
+func decodeWindowSize(payload []byte) (WindowSize, error) {
+	if len(payload) != 4 {
+		return WindowSize{}, errors.Errorf("invalid window size")
+	}
+	return WindowSize{Rows: binary.BigEndian.Uint16(payload), Cols: binary.BigEndian.Uint16(payload[2:])}, nil
+}
+
+// Run requests the command to server host and relays stdio until the command exits
+// The exit code of the command is returned. Window sizes from resizeCh are sent when the request has PTY.
+func Run(duplex io.ReadWriter, req *Request, stdin io.Reader, stdout io.Writer, stderr io.Writer, resizeCh <-chan WindowSize) (int, error) {
+	fw := &frameWriter{w: duplex, mutex: new(sync.Mutex)}
+	reqJson, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	if err := fw.writeFrame(frameRequest, reqJson); err != nil {
+		return 0, err
+	}
+	go func() {
+		if _, err := io.Copy(&streamWriter{fw: fw, frameType: frameStdin}, stdin); err != nil {
+			return
+		}
+		fw.writeFrame(frameStdinEof, nil)
+	}()
+	if resizeCh != nil {
+		go func() {
+			for size := range resizeCh {
+				if err := fw.writeFrame(frameWindowSize, encodeWindowSize(size)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for {
+		frameType, payload, err := readFrame(duplex)
+		if err != nil {
+			if err == io.EOF {
+				return 0, errors.Errorf("connection closed before the command exits")
+			}
+			return 0, err
+		}
+		switch frameType {
+		case frameStdout:
+			if _, err := stdout.Write(payload); err != nil {
+				return 0, err
+			}
+		case frameStderr:
+			if _, err := stderr.Write(payload); err != nil {
+				return 0, err
+			}
+		case frameExit:
+			if len(payload) != 4 {
+				return 0, errors.Errorf("invalid exit code")
+			}
+			return int(int32(binary.BigEndian.Uint32(payload))), nil
+		default:
+			return 0, errors.Errorf("unexpected frame type: %d", frameType)
+		}
+	}
+}
+
+// Serve runs the command requested through duplex and relays stdio until the command exits
+// NOTE: Like ssh, the command is run by "<shell> -c" in the home directory
+func Serve(duplex io.ReadWriter, shell string) error {
+	fw := &frameWriter{w: duplex, mutex: new(sync.Mutex)}
+	frameType, payload, err := readFrame(duplex)
+	if err != nil {
+		return err
+	}
+	if frameType != frameRequest {
+		return errors.Errorf("unexpected frame type: %d", frameType)
+	}
+	var req Request
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return errors.Wrap(err, "invalid request")
+	}
+	c := exec.Command(shell)
+	if len(req.Command) != 0 {
+		c = exec.Command(shell, "-c", strings.Join(req.Command, " "))
+	} else if req.Pty {
+		c = exec.Command(shell, "-l")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		c.Dir = home
+	}
+	c.Env = os.Environ()
+	if req.Term != "" {
+		c.Env = append(c.Env, "TERM="+req.Term)
+	}
+	stdoutWriter := &streamWriter{fw: fw, frameType: frameStdout}
+	var exitCode int
+	if req.Pty {
+		exitCode, err = runWithPty(c, &req, duplex, stdoutWriter)
+	} else {
+		exitCode, err = runWithPipes(c, duplex, stdoutWriter, &streamWriter{fw: fw, frameType: frameStderr})
+	}
+	if err != nil {
+		return err
+	}
+	code := make([]byte, 4)
+	binary.BigEndian.PutUint32(code, uint32(int32(exitCode)))
+	return fw.writeFrame(frameExit, code)
+}
+
+// relayInput writes stdin frames to stdin and applies window sizes until the end of stdin
+func relayInput(duplex io.Reader, stdin io.WriteCloser, resize func(size WindowSize) error) {
+	defer stdin.Close()
+	for {
+		frameType, payload, err := readFrame(duplex)
+		if err != nil {
+			return
+		}
+		switch frameType {
+		case frameStdin:
+			if _, err := stdin.Write(payload); err != nil {
+				return
+			}
+		case frameStdinEof:
+			return
+		case frameWindowSize:
+			size, err := decodeWindowSize(payload)
+			if err == nil && resize != nil {
+				resize(size)
+			}
+		}
+	}
+}
+
+func runWithPipes(c *exec.Cmd, duplex io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	c.Stdout = stdout
+	c.Stderr = stderr
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := c.Start(); err != nil {
+		fmt.Fprintf(stderr, "piping-tunnel: %s\n", err)
+		return commandNotFoundExitCode, nil
+	}
+	go relayInput(duplex, stdin, nil)
+	return exitCodeOf(c.Wait())
+}
+
+func exitCodeOf(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// NOTE: ExitCode() is -1 when the command is killed by a signal
+		if exitErr.ExitCode() < 0 {
+			return 255, nil
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
@@ -0,0 +1,59 @@
+package exec_tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func run(t *testing.T, req *Request, stdin io.Reader) (string, string, int) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	serveErrCh := make(chan error, 1)
+	go func() {
+		serveErrCh <- Serve(conn2, "/bin/sh")
+		conn2.Close()
+	}()
+	var stdout, stderr bytes.Buffer
+	exitCode, err := Run(conn1, req, stdin, &stdout, &stderr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serveErrCh; err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), exitCode
+}
+
+func TestRun(t *testing.T) {
+	stdout, stderr, exitCode := run(t, &Request{Command: []string{"echo", "hello;", "echo", "error", ">&2;", "exit", "3"}}, strings.NewReader(""))
+	if stdout != "hello\n" {
+		t.Fatalf("unexpected stdout: %q", stdout)
+	}
+	if stderr != "error\n" {
+		t.Fatalf("unexpected stderr: %q", stderr)
+	}
+	if exitCode != 3 {
+		t.Fatalf("unexpected exit code: %d", exitCode)
+	}
+}
+
+func TestRunWithStdin(t *testing.T) {
+	input := strings.Repeat("hello, world\n", 10000)
+	stdout, _, exitCode := run(t, &Request{Command: []string{"cat"}}, strings.NewReader(input))
+	if stdout != input {
+		t.Fatalf("unexpected stdout of %d bytes", len(stdout))
+	}
+	if exitCode != 0 {
+		t.Fatalf("unexpected exit code: %d", exitCode)
+	}
+}
+
+func TestRunCommandNotFound(t *testing.T) {
+	_, _, exitCode := run(t, &Request{Command: []string{"piping-tunnel-no-such-command"}}, strings.NewReader(""))
+	if exitCode != commandNotFoundExitCode {
+		t.Fatalf("unexpected exit code: %d", exitCode)
+	}
+}
@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package exec_tunnel
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+type winsize struct {
+	rows   uint16
+	cols   uint16
+	xPixel uint16
+	yPixel uint16
+}
+
+// NOTE: File.Fd() is not used because it makes the file blocking
+func ioctl(f *os.File, request uintptr, arg uintptr) error {
+	rawConn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// nopCloser keeps the PTY open after the end of stdin
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// openPty opens a pair of PTY master and slave
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var ptyNumber uint32
+	if err := ioctl(master, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptyNumber))); err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptyNumber), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
+
+func setWindowSize(f *os.File, size WindowSize) error {
+	ws := winsize{rows: size.Rows, cols: size.Cols}
+	return ioctl(f, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+func runWithPty(c *exec.Cmd, req *Request, duplex io.Reader, stdout io.Writer) (int, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return 0, err
+	}
+	defer master.Close()
+	if req.Rows != 0 && req.Cols != 0 {
+		setWindowSize(master, WindowSize{Rows: req.Rows, Cols: req.Cols})
+	}
+	c.Stdin = slave
+	c.Stdout = slave
+	c.Stderr = slave
+	// NOTE: The PTY becomes the controlling terminal of a new session, where Ctty is the fd in the child
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	err = c.Start()
+	// NOTE: The master reads EIO after all slaves are closed
+	slave.Close()
+	if err != nil {
+		fmt.Fprintf(stdout, "piping-tunnel: %s\r\n", err)
+		return commandNotFoundExitCode, nil
+	}
+	go relayInput(duplex, nopCloser{master}, func(size WindowSize) error {
+		return setWindowSize(master, size)
+	})
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(stdout, master)
+		close(outputDone)
+	}()
+	exitCode, err := exitCodeOf(c.Wait())
+	<-outputDone
+	return exitCode, err
+}
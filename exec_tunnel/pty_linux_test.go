@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package exec_tunnel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunWithPty(t *testing.T) {
+	stdout, stderr, exitCode := run(t, &Request{Command: []string{"stty", "size;", "tty;", "echo", "error", ">&2"}, Pty: true, Rows: 40, Cols: 100}, strings.NewReader(""))
+	if !strings.HasPrefix(stdout, "40 100\r\n/dev/pts/") {
+		t.Fatalf("unexpected stdout: %q", stdout)
+	}
+	// stderr is also the PTY
+	if !strings.HasSuffix(stdout, "error\r\n") || stderr != "" {
+		t.Fatalf("unexpected output: %q, %q", stdout, stderr)
+	}
+	if exitCode != 0 {
+		t.Fatalf("unexpected exit code: %d", exitCode)
+	}
+}
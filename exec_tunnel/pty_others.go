@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package exec_tunnel
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"os/exec"
+)
+
+func runWithPty(c *exec.Cmd, req *Request, duplex io.Reader, stdout io.Writer) (int, error) {
+	return 0, errors.Errorf("PTY is only supported on Linux")
+}
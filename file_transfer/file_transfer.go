@@ -0,0 +1,352 @@
+package file_transfer
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NOTE: The sender sends the manifest, the receiver replies the offsets of partially received files,
+//       the sender sends files from the offsets in tar and the receiver replies the result of verification.
+//       Messages other than tar are JSON with the length of 4 bytes.
+
+const maxMessageLen = 64 << 20
+
+// Suffix of a partially received file, which is renamed after verification
+const PartSuffix = ".part"
+
+const (
+	paxRecordOffset = "PIPING_TUNNEL.offset"
+	paxRecordSha256 = "PIPING_TUNNEL.sha256"
+)
+
+type Entry struct {
+	// Slash-separated path relative to the output directory of the receiver
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Offset where the transfer starts in resumption
+	Offset int64 `json:"-"`
+	// SHA-256 of the whole file in hex
+	Sha256 string `json:"-"`
+}
+
+type manifest struct {
+	Files []Entry `json:"files"`
+}
+
+type offsetsReply struct {
+	Offsets map[string]int64 `json:"offsets"`
+	Error   string           `json:"error,omitempty"`
+}
+
+type resultReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+func writeMessage(w io.Writer, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	message := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(message, uint32(len(payload)))
+	copy(message[4:], payload)
+	_, err = w.Write(message)
+	return err
+}
+
+func readMessage(r io.Reader, v interface{}) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxMessageLen {
+		return errors.Errorf("too large message: %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// localPath returns the path in dir, rejecting names out of dir
+func localPath(dir string, name string) (string, error) {
+	cleaned := path.Clean(name)
+	if name == "" || path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errors.Errorf("invalid name: '%s'", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(cleaned)), nil
+}
+
+type sendingItem struct {
+	localPath string
+	name      string
+	mode      os.FileMode
+	isDir     bool
+	size      int64
+}
+
+// listItems lists directories and regular files to send
+// NOTE: Symbolic links in directories and special files are skipped, while the paths of arguments are followed.
+func listItems(paths []string) ([]sendingItem, error) {
+	var items []sendingItem
+	names := map[string]struct{}{}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		base := filepath.Base(filepath.Clean(p))
+		if _, ok := names[base]; ok {
+			return nil, errors.Errorf("duplicate name: '%s'", base)
+		}
+		names[base] = struct{}{}
+		if !info.IsDir() {
+			if !info.Mode().IsRegular() {
+				return nil, errors.Errorf("not a regular file: '%s'", p)
+			}
+			items = append(items, sendingItem{localPath: p, name: base, mode: info.Mode().Perm(), size: info.Size()})
+			continue
+		}
+		err = filepath.Walk(p, func(walkedPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(p, walkedPath)
+			if err != nil {
+				return err
+			}
+			name := path.Join(base, filepath.ToSlash(rel))
+			if info.IsDir() {
+				items = append(items, sendingItem{localPath: walkedPath, name: name, mode: info.Mode().Perm(), isDir: true})
+			} else if info.Mode().IsRegular() {
+				items = append(items, sendingItem{localPath: walkedPath, name: name, mode: info.Mode().Perm(), size: info.Size()})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// fileSha256 calculates SHA-256 of the first size bytes of the file
+func fileSha256(f *os.File, size int64) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, size); err != nil {
+		return "", errors.Wrap(err, "file changed while sending")
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Send sends files and directories to the receiver and returns an error when the receiver fails to verify them
+// onFile is called before sending each file.
+func Send(duplex io.ReadWriter, paths []string, onFile func(entry *Entry)) error {
+	items, err := listItems(paths)
+	if err != nil {
+		return err
+	}
+	var m manifest
+	for _, item := range items {
+		if !item.isDir {
+			m.Files = append(m.Files, Entry{Name: item.name, Size: item.size})
+		}
+	}
+	if err := writeMessage(duplex, &m); err != nil {
+		return err
+	}
+	var offsets offsetsReply
+	if err := readMessage(duplex, &offsets); err != nil {
+		return err
+	}
+	if offsets.Error != "" {
+		return errors.Errorf("receiver: %s", offsets.Error)
+	}
+	tw := tar.NewWriter(duplex)
+	for _, item := range items {
+		if item.isDir {
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: item.name + "/", Mode: int64(item.mode), Format: tar.FormatPAX}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := sendFile(tw, item, offsets.Offsets[item.name], onFile); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	var result resultReply
+	if err := readMessage(duplex, &result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return errors.Errorf("receiver: %s", result.Error)
+	}
+	return nil
+}
+
+func sendFile(tw *tar.Writer, item sendingItem, offset int64, onFile func(entry *Entry)) error {
+	if offset < 0 || offset > item.size {
+		return errors.Errorf("invalid offset of '%s': %d", item.name, offset)
+	}
+	f, err := os.Open(item.localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sha256Hex, err := fileSha256(f, item.size)
+	if err != nil {
+		return err
+	}
+	entry := &Entry{Name: item.name, Size: item.size, Offset: offset, Sha256: sha256Hex}
+	if onFile != nil {
+		onFile(entry)
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     item.name,
+		Mode:     int64(item.mode),
+		Size:     item.size - offset,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			paxRecordOffset: strconv.FormatInt(offset, 10),
+			paxRecordSha256: sha256Hex,
+		},
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, item.size-offset)
+	return err
+}
+
+// Receive receives files and directories into outputDir and verifies SHA-256 of each file
+// A partially received file is kept with PartSuffix and resumed in the next Receive. onFile is called after verifying each file.
+func Receive(duplex io.ReadWriter, outputDir string, onFile func(entry *Entry)) error {
+	var m manifest
+	if err := readMessage(duplex, &m); err != nil {
+		return err
+	}
+	offsets := offsetsReply{Offsets: map[string]int64{}}
+	for _, entry := range m.Files {
+		dst, err := localPath(outputDir, entry.Name)
+		if err != nil {
+			writeMessage(duplex, &offsetsReply{Error: err.Error()})
+			return err
+		}
+		// Resume when the partial file is not longer than the file
+		if info, err := os.Stat(dst + PartSuffix); err == nil && info.Mode().IsRegular() && info.Size() <= entry.Size {
+			offsets.Offsets[entry.Name] = info.Size()
+		}
+	}
+	if err := writeMessage(duplex, &offsets); err != nil {
+		return err
+	}
+	var failures []string
+	tr := tar.NewReader(duplex)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := receiveEntry(tr, header, outputDir, offsets.Offsets, onFile); err != nil {
+			// NOTE: Other files are still received not to block the sender
+			failures = append(failures, err.Error())
+		}
+	}
+	var result resultReply
+	if len(failures) != 0 {
+		result.Error = strings.Join(failures, "; ")
+	}
+	if err := writeMessage(duplex, &result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
+func receiveEntry(tr *tar.Reader, header *tar.Header, outputDir string, offsets map[string]int64, onFile func(entry *Entry)) error {
+	dst, err := localPath(outputDir, header.Name)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(header.Mode).Perm()
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(dst, mode|0700); err != nil {
+			return err
+		}
+		return os.Chmod(dst, mode|0700)
+	case tar.TypeReg:
+	default:
+		return errors.Errorf("unsupported type of '%s'", header.Name)
+	}
+	offset, err := strconv.ParseInt(header.PAXRecords[paxRecordOffset], 10, 64)
+	if err != nil || offset != offsets[header.Name] {
+		return errors.Errorf("unexpected offset of '%s'", header.Name)
+	}
+	entry := &Entry{Name: header.Name, Size: offset + header.Size, Offset: offset, Sha256: header.PAXRecords[paxRecordSha256]}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	partPath := dst + PartSuffix
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, offset); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.MultiWriter(f, h), tr); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != entry.Sha256 {
+		// NOTE: The partial file is removed not to resume with the broken data
+		f.Close()
+		os.Remove(partPath)
+		return errors.Errorf("SHA-256 mismatch of '%s'", header.Name)
+	}
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, dst); err != nil {
+		return err
+	}
+	if onFile != nil {
+		onFile(entry)
+	}
+	return nil
+}
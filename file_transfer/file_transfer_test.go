@@ -0,0 +1,130 @@
+package file_transfer
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, p string, content []byte, perm os.FileMode) {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, content, perm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertFile(t *testing.T, p string, content []byte, perm os.FileMode) {
+	actual, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, content) {
+		t.Fatalf("unexpected content of %s: %q", p, actual)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != perm {
+		t.Fatalf("unexpected permission of %s: %v", p, info.Mode().Perm())
+	}
+}
+
+// transfer sends paths to outputDir and returns the entries of the receiver
+func transfer(t *testing.T, paths []string, outputDir string) ([]Entry, error, error) {
+	senderConn, receiverConn := net.Pipe()
+	defer senderConn.Close()
+	defer receiverConn.Close()
+	sendErrCh := make(chan error, 1)
+	go func() {
+		sendErrCh <- Send(senderConn, paths, nil)
+	}()
+	var entries []Entry
+	receiveErr := Receive(receiverConn, outputDir, func(entry *Entry) {
+		entries = append(entries, *entry)
+	})
+	return entries, <-sendErrCh, receiveErr
+}
+
+func TestSendReceive(t *testing.T) {
+	srcDir := t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "mydir", "a.txt"), []byte("hello"), 0644)
+	writeFile(t, filepath.Join(srcDir, "mydir", "sub", "b.sh"), []byte("#!/bin/sh\n"), 0755)
+	if err := os.Mkdir(filepath.Join(srcDir, "mydir", "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("0123456789"), 100000)
+	writeFile(t, filepath.Join(srcDir, "large.bin"), large, 0600)
+	outputDir := t.TempDir()
+	entries, sendErr, receiveErr := transfer(t, []string{filepath.Join(srcDir, "mydir"), filepath.Join(srcDir, "large.bin")}, outputDir)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatal(sendErr, receiveErr)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	assertFile(t, filepath.Join(outputDir, "mydir", "a.txt"), []byte("hello"), 0644)
+	assertFile(t, filepath.Join(outputDir, "mydir", "sub", "b.sh"), []byte("#!/bin/sh\n"), 0755)
+	assertFile(t, filepath.Join(outputDir, "large.bin"), large, 0600)
+	if info, err := os.Stat(filepath.Join(outputDir, "mydir", "empty")); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory not received: %v", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	srcDir := t.TempDir()
+	content := bytes.Repeat([]byte("abcdefgh"), 1000)
+	writeFile(t, filepath.Join(srcDir, "file.bin"), content, 0644)
+	outputDir := t.TempDir()
+	writeFile(t, filepath.Join(outputDir, "file.bin"+PartSuffix), content[:3000], 0600)
+	entries, sendErr, receiveErr := transfer(t, []string{filepath.Join(srcDir, "file.bin")}, outputDir)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatal(sendErr, receiveErr)
+	}
+	if len(entries) != 1 || entries[0].Offset != 3000 {
+		t.Fatalf("not resumed: %v", entries)
+	}
+	assertFile(t, filepath.Join(outputDir, "file.bin"), content, 0644)
+	if _, err := os.Stat(filepath.Join(outputDir, "file.bin"+PartSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("partial file remains: %v", err)
+	}
+}
+
+func TestResumeWithBrokenPartialFile(t *testing.T) {
+	srcDir := t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "file.txt"), []byte("hello, world"), 0644)
+	outputDir := t.TempDir()
+	writeFile(t, filepath.Join(outputDir, "file.txt"+PartSuffix), []byte("HELLO"), 0600)
+	_, sendErr, receiveErr := transfer(t, []string{filepath.Join(srcDir, "file.txt")}, outputDir)
+	if sendErr == nil || receiveErr == nil {
+		t.Fatal("SHA-256 mismatch should be detected")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "file.txt"+PartSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("broken partial file should be removed: %v", err)
+	}
+	// The next transfer starts over
+	_, sendErr, receiveErr = transfer(t, []string{filepath.Join(srcDir, "file.txt")}, outputDir)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatal(sendErr, receiveErr)
+	}
+	assertFile(t, filepath.Join(outputDir, "file.txt"), []byte("hello, world"), 0644)
+}
+
+func TestLocalPath(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../a", "a/../../b", "/etc/passwd"} {
+		if _, err := localPath("out", name); err == nil {
+			t.Errorf("'%s' should be rejected", name)
+		}
+	}
+	p, err := localPath("out", "a/./b/../c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p != filepath.Join("out", "a", "c") {
+		t.Fatalf("unexpected path: %s", p)
+	}
+}
@@ -3,11 +3,13 @@ module github.com/nwtgck/go-piping-tunnel
 go 1.16
 
 require (
+	filippo.io/edwards25519 v1.1.0
 	github.com/hashicorp/yamux v0.1.1
-	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/mattn/go-isatty v0.0.20
 	github.com/mattn/go-tty v0.0.5
 	github.com/nwtgck/go-socks v0.1.0
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.8.0
+	github.com/spf13/pflag v1.0.5
 	golang.org/x/crypto v0.24.0
 )
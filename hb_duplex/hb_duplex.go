@@ -3,6 +3,7 @@ package hb_duplex
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"github.com/nwtgck/go-piping-tunnel/util"
 	"github.com/pkg/errors"
 	"io"
 	"sync"
@@ -12,12 +13,17 @@ import (
 const (
 	dataType byte = iota
 	heartbeatType
+	// NOTE: finType should be sent only when the peer supports it
+	finType
 )
 
 type hbDuplex struct {
-	inner      io.ReadWriteCloser
-	rest       uint32
-	writeMutex *sync.Mutex
+	inner       io.ReadWriteCloser
+	rest        uint32
+	finReceived bool
+	writeMutex  *sync.Mutex
+	// NOTE: heartbeat stops after closing writing
+	writeClosed bool
 }
 
 func Duplex(duplex io.ReadWriteCloser) io.ReadWriteCloser {
@@ -26,6 +32,10 @@ func Duplex(duplex io.ReadWriteCloser) io.ReadWriteCloser {
 		heartbeatInterval := 30 * time.Second
 		for {
 			d.writeMutex.Lock()
+			if d.writeClosed {
+				d.writeMutex.Unlock()
+				return
+			}
 			randomBytes := make([]byte, 1)
 			io.ReadFull(rand.Reader, randomBytes)
 			d.inner.Write([]byte{heartbeatType, randomBytes[0]})
@@ -37,6 +47,9 @@ func Duplex(duplex io.ReadWriteCloser) io.ReadWriteCloser {
 }
 
 func (d *hbDuplex) Read(p []byte) (int, error) {
+	if d.finReceived {
+		return 0, io.EOF
+	}
 	if d.rest == 0 {
 		b := make([]byte, 1)
 		_, err := io.ReadFull(d.inner, b)
@@ -62,6 +75,9 @@ func (d *hbDuplex) Read(p []byte) (int, error) {
 			// Get length of data body
 			d.rest = binary.BigEndian.Uint32(lengthBytes)
 			return d.Read(p)
+		case finType:
+			d.finReceived = true
+			return 0, io.EOF
 		default:
 			return 0, errors.Errorf("unexpecrted flag: %d", flag)
 		}
@@ -80,6 +96,9 @@ func (d *hbDuplex) Write(p []byte) (int, error) {
 	binary.BigEndian.PutUint32(lengthBytes, length)
 	d.writeMutex.Lock()
 	defer d.writeMutex.Unlock()
+	if d.writeClosed {
+		return 0, io.ErrClosedPipe
+	}
 	bytes := append([]byte{dataType}, lengthBytes...)
 	n, err := d.inner.Write(bytes)
 	if n != len(bytes) {
@@ -91,6 +110,25 @@ func (d *hbDuplex) Write(p []byte) (int, error) {
 	return d.inner.Write(p)
 }
 
+// CloseWrite sends fin to notify the peer of the end of writing
+func (d *hbDuplex) CloseWrite() error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+	if d.writeClosed {
+		return nil
+	}
+	d.writeClosed = true
+	if _, err := d.inner.Write([]byte{finType}); err != nil {
+		return err
+	}
+	return util.CloseWrite(d.inner)
+}
+
 func (d *hbDuplex) Close() error {
-	return d.inner.Close()
+	// NOTE: Closing inner first unblocks a writer holding the lock
+	err := d.inner.Close()
+	d.writeMutex.Lock()
+	d.writeClosed = true
+	d.writeMutex.Unlock()
+	return err
 }
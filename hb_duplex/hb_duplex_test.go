@@ -0,0 +1,55 @@
+package hb_duplex
+
+import (
+	"io"
+	"testing"
+)
+
+type pipeDuplex struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (d *pipeDuplex) CloseWrite() error {
+	return d.PipeWriter.Close()
+}
+
+func (d *pipeDuplex) Close() error {
+	d.PipeWriter.Close()
+	return d.PipeReader.Close()
+}
+
+func newDuplexPair() (*pipeDuplex, *pipeDuplex) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return &pipeDuplex{PipeReader: r1, PipeWriter: w2}, &pipeDuplex{PipeReader: r2, PipeWriter: w1}
+}
+
+func TestCloseWrite(t *testing.T) {
+	inner1, inner2 := newDuplexPair()
+	d1 := Duplex(inner1)
+	d2 := Duplex(inner2)
+	defer d1.Close()
+	defer d2.Close()
+
+	go func() {
+		d1.Write([]byte("hello"))
+		d1.(*hbDuplex).CloseWrite()
+	}()
+	body, err := io.ReadAll(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	// The other direction is still writable after fin
+	go d2.Write([]byte("world"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(d1, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "world" {
+		t.Fatalf("unexpected body: %s", buf)
+	}
+}
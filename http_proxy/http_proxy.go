@@ -0,0 +1,192 @@
+package http_proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/nwtgck/go-piping-tunnel/allowlist"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var DestinationNotPermittedError = errors.New("destination not permitted")
+
+// (base: https://datatracker.ietf.org/doc/html/rfc7230#section-6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type Server struct {
+	transport *http.Transport
+	rules     *allowlist.Rules
+	lookupIP  func(host string) ([]net.IP, error)
+}
+
+// New creates a server of HTTP CONNECT and forward proxy
+func New() *Server {
+	return NewWithRules(nil)
+}
+
+// NewWithRules creates a server which connects only to destinations permitted by rules (nil permits all)
+func NewWithRules(rules *allowlist.Rules) *Server {
+	s := &Server{
+		rules:    rules,
+		lookupIP: net.LookupIP,
+	}
+	s.transport = &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return s.dial(network, address)
+		},
+		// NOTE: The body is forwarded as it is without decompression
+		DisableCompression: true,
+	}
+	return s
+}
+
+// dial connects to the address after checking the rules
+// NOTE: The resolved IP is dialed so that the checked IP is the same as the connected one
+func (s *Server) dial(network string, address string) (net.Conn, error) {
+	if s.rules == nil {
+		return net.Dial(network, address)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	fqdn := ""
+	if ip == nil {
+		fqdn = host
+		ips, err := s.lookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, errors.Errorf("no IP address of %s", host)
+		}
+		ip = ips[0]
+	}
+	if !s.rules.Permits(fqdn, ip, port) {
+		return nil, errors.WithStack(DestinationNotPermittedError)
+	}
+	return net.Dial(network, net.JoinHostPort(ip.String(), portStr))
+}
+
+func writeDialErrorStatus(w io.Writer, err error) error {
+	if errors.Is(err, DestinationNotPermittedError) {
+		return writeErrorStatus(w, http.StatusForbidden)
+	}
+	return writeErrorStatus(w, http.StatusBadGateway)
+}
+
+// ServeConn serves proxy requests in conn until it ends
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if req.Method == http.MethodConnect {
+			return s.handleConnect(conn, reader, req)
+		}
+		keepsAlive, err := s.handleForward(conn, req)
+		if err != nil || !keepsAlive {
+			return err
+		}
+	}
+}
+
+func writeErrorStatus(w io.Writer, statusCode int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", statusCode, http.StatusText(statusCode))
+	return err
+}
+
+func (s *Server) handleConnect(conn net.Conn, reader *bufio.Reader, req *http.Request) error {
+	target, err := s.dial("tcp", req.Host)
+	if err != nil {
+		writeDialErrorStatus(conn, err)
+		return err
+	}
+	defer target.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return err
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		// NOTE: reader may have buffered the beginning of the tunnel
+		_, err := io.Copy(target, reader)
+		util.CloseWriteOrClose(target)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, target)
+		util.CloseWriteOrClose(conn)
+		errCh <- err
+	}()
+	err1 := <-errCh
+	err2 := <-errCh
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	for _, field := range strings.Split(header.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			header.Del(field)
+		}
+	}
+	for _, key := range hopByHopHeaders {
+		header.Del(key)
+	}
+}
+
+func (s *Server) handleForward(conn net.Conn, req *http.Request) (bool, error) {
+	if !req.URL.IsAbs() {
+		writeErrorStatus(conn, http.StatusBadRequest)
+		return false, errors.Errorf("not absolute URI: %s", req.RequestURI)
+	}
+	// NOTE: RequestURI should be empty in client requests
+	req.RequestURI = ""
+	removeHopByHopHeaders(req.Header)
+	res, err := s.transport.RoundTrip(req)
+	if err != nil {
+		writeDialErrorStatus(conn, err)
+		return false, err
+	}
+	defer res.Body.Close()
+	removeHopByHopHeaders(res.Header)
+	// NOTE: A body without length ends by closing the connection
+	keepsAlive := !req.Close && !res.Close && (res.ContentLength >= 0 || len(res.TransferEncoding) != 0)
+	if !keepsAlive {
+		res.Close = true
+	}
+	if err := res.Write(conn); err != nil {
+		return false, err
+	}
+	return keepsAlive, nil
+}
@@ -0,0 +1,144 @@
+package http_proxy
+
+import (
+	"bufio"
+	"github.com/nwtgck/go-piping-tunnel/allowlist"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForward(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Error("hop-by-hop header should be removed")
+		}
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer httpServer.Close()
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	go New().ServeConn(conn2)
+
+	reader := bufio.NewReader(conn1)
+	// The connection is kept alive
+	for _, path := range []string{"/a", "/b"} {
+		req, err := http.NewRequest("GET", httpServer.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		go req.WriteProxy(conn1)
+		res, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello "+path {
+			t.Fatalf("unexpected body: %s", body)
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	go New().ServeConn(conn2)
+
+	go io.WriteString(conn1, "CONNECT "+ln.Addr().String()+" HTTP/1.1\r\nHost: "+ln.Addr().String()+"\r\n\r\nhello")
+	reader := bufio.NewReader(conn1)
+	res, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected body: %s", buf)
+	}
+}
+
+func TestConnectBadGateway(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: The port is closed
+	ln.Close()
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	go New().ServeConn(conn2)
+
+	go io.WriteString(conn1, "CONNECT "+ln.Addr().String()+" HTTP/1.1\r\nHost: "+ln.Addr().String()+"\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn1), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+}
+
+func TestRulesForbidden(t *testing.T) {
+	rules, err := allowlist.ParseRules([]string{"127.0.0.1:80"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("denied destination should not be requested")
+	}))
+	defer httpServer.Close()
+	proxyServer := NewWithRules(rules)
+
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	go proxyServer.ServeConn(conn2)
+	host := httpServer.Listener.Addr().String()
+	go io.WriteString(conn1, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn1), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+
+	conn3, conn4 := net.Pipe()
+	defer conn3.Close()
+	go proxyServer.ServeConn(conn4)
+	req, err := http.NewRequest("GET", httpServer.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go req.WriteProxy(conn3)
+	res, err = http.ReadResponse(bufio.NewReader(conn3), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("unexpected status: %d", res.StatusCode)
+	}
+}
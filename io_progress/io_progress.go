@@ -64,6 +64,10 @@ func (progress *IOProgress) Write(p []byte) (int, error) {
 	return n, nil
 }
 
+func (progress *IOProgress) CloseWrite() error {
+	return util.CloseWrite(progress.writer)
+}
+
 func (progress *IOProgress) Close() error {
 	// Lock to process once
 	progress.closeMutex.Lock()
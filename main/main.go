@@ -4,8 +4,13 @@ import (
 	"fmt"
 	"github.com/nwtgck/go-piping-tunnel/cmd"
 	_ "github.com/nwtgck/go-piping-tunnel/cmd/client"
+	_ "github.com/nwtgck/go-piping-tunnel/cmd/exec_client"
+	_ "github.com/nwtgck/go-piping-tunnel/cmd/exec_server"
+	_ "github.com/nwtgck/go-piping-tunnel/cmd/http_proxy"
 	_ "github.com/nwtgck/go-piping-tunnel/cmd/server"
 	_ "github.com/nwtgck/go-piping-tunnel/cmd/socks"
+	_ "github.com/nwtgck/go-piping-tunnel/cmd/transfer"
+	_ "github.com/nwtgck/go-piping-tunnel/cmd/vpn"
 	"os"
 )
 
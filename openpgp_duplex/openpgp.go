@@ -8,8 +8,10 @@ import (
 
 type symmetricallyDuplex struct {
 	encryptWriter     io.WriteCloser
+	encryptWriterDone bool
 	decryptedReader   io.Reader
 	decryptedReaderCh chan interface{} // io.Reader or error
+	baseWriter        io.Writer
 	closeBaseReader   func() error
 }
 
@@ -34,6 +36,7 @@ func SymmetricallyEncryptDuplexWithOpenPGP(baseWriter io.WriteCloser, baseReader
 	return &symmetricallyDuplex{
 		encryptWriter:     encryptWriter,
 		decryptedReaderCh: decryptedReaderCh,
+		baseWriter:        baseWriter,
 		closeBaseReader:   baseReader.Close,
 	}, nil
 }
@@ -56,8 +59,25 @@ func (o *symmetricallyDuplex) Read(p []byte) (int, error) {
 	return o.decryptedReader.Read(p)
 }
 
+// CloseWrite finishes the OpenPGP message including MDC and half-closes the base writer
+func (o *symmetricallyDuplex) CloseWrite() error {
+	if err := o.closeEncryptWriter(); err != nil {
+		return err
+	}
+	return util.CloseWrite(o.baseWriter)
+}
+
+// NOTE: The OpenPGP message should be finished only once
+func (o *symmetricallyDuplex) closeEncryptWriter() error {
+	if o.encryptWriterDone {
+		return nil
+	}
+	o.encryptWriterDone = true
+	return o.encryptWriter.Close()
+}
+
 func (o *symmetricallyDuplex) Close() error {
-	wErr := o.encryptWriter.Close()
+	wErr := o.closeEncryptWriter()
 	rErr := o.closeBaseReader()
 	return util.CombineErrors(wErr, rErr)
 }
@@ -9,6 +9,7 @@ import (
 type opensslAesCtrDuplex struct {
 	encryptWriter   io.WriteCloser
 	decryptedReader io.Reader
+	baseWriter      io.Writer
 	closeBaseReader func() error
 }
 
@@ -21,7 +22,7 @@ func Duplex(baseWriter io.WriteCloser, baseReader io.ReadCloser, passphrase []by
 	if err != nil {
 		return nil, err
 	}
-	return &opensslAesCtrDuplex{encryptWriter: encryptWriter, decryptedReader: decryptedReader, closeBaseReader: baseReader.Close}, nil
+	return &opensslAesCtrDuplex{encryptWriter: encryptWriter, decryptedReader: decryptedReader, baseWriter: baseWriter, closeBaseReader: baseReader.Close}, nil
 }
 
 func (d *opensslAesCtrDuplex) Write(p []byte) (int, error) {
@@ -32,6 +33,10 @@ func (d *opensslAesCtrDuplex) Read(p []byte) (int, error) {
 	return d.decryptedReader.Read(p)
 }
 
+func (d *opensslAesCtrDuplex) CloseWrite() error {
+	return util.CloseWrite(d.baseWriter)
+}
+
 func (d *opensslAesCtrDuplex) Close() error {
 	wErr := d.encryptWriter.Close()
 	rErr := d.closeBaseReader()
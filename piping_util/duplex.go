@@ -9,6 +9,7 @@ import (
 type pipingDuplex struct {
 	downloadReaderChan <-chan interface{} // io.ReadCloser or error
 	uploadWriter       *io.PipeWriter
+	uploadResBody      io.ReadCloser
 	downloadReader     io.ReadCloser
 }
 
@@ -28,10 +29,14 @@ type getHandler = func() (*http.Response, error)
 
 func DuplexConnectWithHandlers(post postHandler, get getHandler) (*pipingDuplex, error) {
 	uploadPr, uploadPw := io.Pipe()
-	_, err := post(uploadPr)
+	postRes, err := post(uploadPr)
 	if err != nil {
 		return nil, err
 	}
+	if postRes.StatusCode != 200 {
+		postRes.Body.Close()
+		return nil, NewStatusError(postRes)
+	}
 
 	downloadReaderChan := make(chan interface{})
 	go func() {
@@ -40,12 +45,18 @@ func DuplexConnectWithHandlers(post postHandler, get getHandler) (*pipingDuplex,
 			downloadReaderChan <- err
 			return
 		}
+		if res.StatusCode != 200 {
+			res.Body.Close()
+			downloadReaderChan <- NewStatusError(res)
+			return
+		}
 		downloadReaderChan <- res.Body
 	}()
 
 	return &pipingDuplex{
 		downloadReaderChan: downloadReaderChan,
 		uploadWriter:       uploadPw,
+		uploadResBody:      postRes.Body,
 	}, nil
 }
 
@@ -67,11 +78,20 @@ func (pd *pipingDuplex) Write(b []byte) (n int, err error) {
 	return pd.uploadWriter.Write(b)
 }
 
+// CloseWrite finishes the upload, which notifies the peer of EOF
+func (pd *pipingDuplex) CloseWrite() error {
+	return pd.uploadWriter.Close()
+}
+
 func (pd *pipingDuplex) Close() error {
 	var rErr error
 	wErr := pd.uploadWriter.Close()
 	if pd.downloadReader != nil {
 		rErr = pd.downloadReader.Close()
+		// NOTE: The peer is connected, so wait for the peer to receive all the upload.
+		//       This prevents the next upload to the same path from conflicting with it.
+		io.Copy(io.Discard, pd.uploadResBody)
 	}
+	pd.uploadResBody.Close()
 	return util.CombineErrors(wErr, rErr)
 }
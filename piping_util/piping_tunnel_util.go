@@ -2,6 +2,7 @@ package piping_util
 
 import (
 	"github.com/nwtgck/go-piping-tunnel/io_progress"
+	"github.com/nwtgck/go-piping-tunnel/util"
 	"github.com/pkg/errors"
 	"io"
 	"net/http"
@@ -10,10 +11,14 @@ import (
 )
 
 const (
-	CipherTypeOpenpgp          string = "openpgp"
-	CipherTypeAesCtr                  = "aes-ctr"
-	CipherTypeOpensslAes128Ctr        = "openssl-aes-128-ctr"
-	CipherTypeOpensslAes256Ctr        = "openssl-aes-256-ctr"
+	CipherTypeOpenpgp               string = "openpgp"
+	CipherTypeAesCtr                       = "aes-ctr"
+	CipherTypeOpensslAes128Ctr             = "openssl-aes-128-ctr"
+	CipherTypeOpensslAes256Ctr             = "openssl-aes-256-ctr"
+	CipherTypeAes256Gcm                    = "aes-256-gcm"
+	CipherTypeChacha20Poly1305             = "chacha20-poly1305"
+	CipherTypeCpaceAes256Gcm               = "cpace-aes-256-gcm"
+	CipherTypeCpaceChacha20Poly1305        = "cpace-chacha20-poly1305"
 )
 
 type KeyValue struct {
@@ -43,14 +48,22 @@ func HandleDuplex(httpClient *http.Client, duplex io.ReadWriteCloser, headers []
 	if progress != nil {
 		reader = progress
 	}
-	_, err := PipingSend(httpClient, headers, uploadUrl, reader)
+	postRes, err := PipingSend(httpClient, headers, uploadUrl, reader)
 	if err != nil {
 		return err
 	}
+	defer postRes.Body.Close()
+	if postRes.StatusCode != 200 {
+		return NewStatusError(postRes)
+	}
 	res, err := PipingGet(httpClient, headers, downloadUrl)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return NewStatusError(res)
+	}
 	if arriveCh != nil {
 		arriveCh <- struct{}{}
 	}
@@ -60,5 +73,13 @@ func HandleDuplex(httpClient *http.Client, duplex io.ReadWriteCloser, headers []
 	}
 	var buf = make([]byte, downloadBufSize)
 	_, err = io.CopyBuffer(writer, res.Body, buf)
+	if err != nil {
+		return err
+	}
+	// Notify the end of download, and wait for the peer to receive all the upload
+	if err := util.CloseWrite(duplex); err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, postRes.Body)
 	return err
 }
@@ -2,10 +2,23 @@ package piping_util
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 )
 
+type StatusError struct {
+	StatusCode int
+}
+
+func NewStatusError(res *http.Response) *StatusError {
+	return &StatusError{StatusCode: res.StatusCode}
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("not status 200, found: %d", e.StatusCode)
+}
+
 func PipingSendWithContext(ctx context.Context, httpClient *http.Client, headers []KeyValue, uploadUrl string, reader io.Reader) (*http.Response, error) {
 	req, err := http.NewRequestWithContext(ctx, "POST", uploadUrl, reader)
 	if err != nil {
@@ -0,0 +1,478 @@
+package piping_util
+
+import (
+	"encoding/binary"
+	"github.com/nwtgck/go-piping-tunnel/backoff"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Resumable duplex keeps a byte stream across breaks of HTTP requests such as proxy timeouts.
+// Each connection uses sub-paths numbered by generation. After a break, both ends reconnect with the next generation,
+// exchange the number of received bytes and resend the rest from the replay buffer.
+//
+// Header (at the beginning of each generation):
+//   received bytes (8 bytes) | fin received (1 byte)
+// Frame:
+//   type (1 byte) | data: length (4 bytes) + payload, ack: received bytes (8 bytes), fin and close: empty
+
+const (
+	resumableDataType byte = iota
+	resumableAckType
+	// NOTE: fin is the end of writing, which is resent after a break like data
+	resumableFinType
+	// NOTE: close notifies the peer not to resume anymore
+	resumableCloseType
+)
+
+// TODO: hard code
+const resumableMaxReplayLen = 1024 * 1024
+const resumableAckInterval = resumableMaxReplayLen / 4
+const resumableMaxDataLen = 64 * 1024
+const resumableHeaderLen = 9
+const resumableCloseTimeout = 10 * time.Second
+
+var ResumeOffsetError = errors.New("peer requested bytes not in the replay buffer")
+var InvalidResumableFrameError = errors.New("invalid resumable frame")
+
+type resumableDuplex struct {
+	uploadUrl   string
+	downloadUrl string
+	connect     func(uploadUrl string, downloadUrl string) (io.ReadWriteCloser, error)
+	// frameMutex keeps frames from interleaving
+	frameMutex *sync.Mutex
+	// appWriteMutex keeps the order of Write()
+	appWriteMutex *sync.Mutex
+	readPr        *io.PipeReader
+	readPw        *io.PipeWriter
+	ackCh         chan struct{}
+	closeCh       chan struct{}
+
+	// NOTE: The following fields are guarded by cond.L
+	cond *sync.Cond
+	// conn is nil while reconnecting, and connReady is true after exchanging headers
+	conn      io.ReadWriteCloser
+	connReady bool
+	// replay has sent bytes which are not acknowledged
+	replay     []byte
+	acked      uint64
+	written    uint64
+	finSent    bool
+	finWritten bool
+	received   uint64
+	// ackRequested is the received bytes when an ack was requested last
+	ackRequested uint64
+	finReceived  bool
+	// NOTE: closing waits for a connection to notify the peer before closed
+	closing    bool
+	closed     bool
+	peerClosed bool
+	failedErr  error
+}
+
+// ResumableUrl returns the sub-path of the generation
+func ResumableUrl(url string, generation uint64) (string, error) {
+	return util.UrlJoin(url, strconv.FormatUint(generation, 10))
+}
+
+// ResumableDuplexConnect connects to sub-paths by connect() and reconnects to the next sub-paths after a break
+func ResumableDuplexConnect(uploadUrl string, downloadUrl string, connect func(uploadUrl string, downloadUrl string) (io.ReadWriteCloser, error)) (*resumableDuplex, error) {
+	readPr, readPw := io.Pipe()
+	d := &resumableDuplex{
+		uploadUrl:     uploadUrl,
+		downloadUrl:   downloadUrl,
+		connect:       connect,
+		frameMutex:    new(sync.Mutex),
+		appWriteMutex: new(sync.Mutex),
+		readPr:        readPr,
+		readPw:        readPw,
+		ackCh:         make(chan struct{}, 1),
+		closeCh:       make(chan struct{}),
+		cond:          sync.NewCond(new(sync.Mutex)),
+	}
+	conn, err := d.connectGeneration(0)
+	if err != nil {
+		return nil, err
+	}
+	go d.run(conn)
+	go d.ackLoop()
+	return d, nil
+}
+
+func (d *resumableDuplex) connectGeneration(generation uint64) (io.ReadWriteCloser, error) {
+	uploadUrl, err := ResumableUrl(d.uploadUrl, generation)
+	if err != nil {
+		return nil, err
+	}
+	downloadUrl, err := ResumableUrl(d.downloadUrl, generation)
+	if err != nil {
+		return nil, err
+	}
+	return d.connect(uploadUrl, downloadUrl)
+}
+
+func (d *resumableDuplex) run(conn io.ReadWriteCloser) {
+	b := backoff.NewExponentialBackoff()
+	var generation uint64
+	for {
+		err := d.serve(conn)
+		d.cond.L.Lock()
+		wasReady := d.connReady
+		d.conn = nil
+		d.connReady = false
+		finished := d.closed || d.peerClosed
+		d.cond.L.Unlock()
+		// NOTE: Closing may wait for the peer to receive the upload
+		go conn.Close()
+		if finished {
+			return
+		}
+		if err == ResumeOffsetError || err == InvalidResumableFrameError {
+			d.fail(err)
+			return
+		}
+		if wasReady {
+			b.Reset()
+		} else {
+			// backoff
+			time.Sleep(b.NextDuration())
+		}
+		generation++
+		for {
+			conn, err = d.connectGeneration(generation)
+			if err == nil {
+				break
+			}
+			if d.isClosed() {
+				return
+			}
+			// backoff
+			time.Sleep(b.NextDuration())
+		}
+	}
+}
+
+// serve exchanges headers, resends unacknowledged bytes and reads frames until the connection breaks
+func (d *resumableDuplex) serve(conn io.ReadWriteCloser) error {
+	d.cond.L.Lock()
+	if d.closed {
+		d.cond.L.Unlock()
+		return io.ErrClosedPipe
+	}
+	d.conn = conn
+	header := make([]byte, resumableHeaderLen)
+	binary.BigEndian.PutUint64(header, d.received)
+	if d.finReceived {
+		header[8] = 1
+	}
+	d.cond.L.Unlock()
+	// NOTE: Writing and reading headers simultaneously does not depend on buffering of the connection
+	writeErrCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(header)
+		writeErrCh <- err
+	}()
+	peerHeader := make([]byte, resumableHeaderLen)
+	if _, err := io.ReadFull(conn, peerHeader); err != nil {
+		return err
+	}
+	if err := <-writeErrCh; err != nil {
+		return err
+	}
+
+	d.frameMutex.Lock()
+	d.cond.L.Lock()
+	err := d.ackLocked(binary.BigEndian.Uint64(peerHeader))
+	if err == nil {
+		// Resend from the bytes the peer received
+		d.written = d.acked
+		d.finWritten = peerHeader[8] == 1
+		d.connReady = true
+	}
+	d.cond.L.Unlock()
+	d.frameMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	d.flush()
+	return d.readFrames(conn)
+}
+
+// ackLocked discards acknowledged bytes from the replay buffer
+// NOTE: cond.L should be locked
+func (d *resumableDuplex) ackLocked(offset uint64) error {
+	if offset < d.acked || offset > d.acked+uint64(len(d.replay)) {
+		return ResumeOffsetError
+	}
+	d.replay = d.replay[offset-d.acked:]
+	d.acked = offset
+	if d.written < d.acked {
+		d.written = d.acked
+	}
+	d.cond.Broadcast()
+	return nil
+}
+
+func (d *resumableDuplex) readFrames(conn io.ReadWriteCloser) error {
+	typeBytes := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, typeBytes); err != nil {
+			return err
+		}
+		switch typeBytes[0] {
+		case resumableDataType:
+			lengthBytes := make([]byte, 4)
+			if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+				return err
+			}
+			length := binary.BigEndian.Uint32(lengthBytes)
+			if length > resumableMaxDataLen {
+				return InvalidResumableFrameError
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(conn, payload); err != nil {
+				return err
+			}
+			if _, err := d.readPw.Write(payload); err != nil {
+				return err
+			}
+			d.cond.L.Lock()
+			d.received += uint64(length)
+			requestsAck := d.received-d.ackRequested >= resumableAckInterval
+			if requestsAck {
+				d.ackRequested = d.received
+			}
+			d.cond.L.Unlock()
+			if requestsAck {
+				d.requestAck()
+			}
+		case resumableAckType:
+			offsetBytes := make([]byte, 8)
+			if _, err := io.ReadFull(conn, offsetBytes); err != nil {
+				return err
+			}
+			d.cond.L.Lock()
+			err := d.ackLocked(binary.BigEndian.Uint64(offsetBytes))
+			d.cond.L.Unlock()
+			if err != nil {
+				return err
+			}
+		case resumableFinType:
+			d.cond.L.Lock()
+			d.finReceived = true
+			d.cond.L.Unlock()
+			d.readPw.Close()
+			// NOTE: The peer can release the replay buffer
+			d.requestAck()
+		case resumableCloseType:
+			d.cond.L.Lock()
+			d.peerClosed = true
+			d.cond.Broadcast()
+			d.cond.L.Unlock()
+			d.readPw.Close()
+			return nil
+		default:
+			return InvalidResumableFrameError
+		}
+	}
+}
+
+// flush writes bytes and fin which are not written to the current connection
+func (d *resumableDuplex) flush() {
+	d.frameMutex.Lock()
+	defer d.frameMutex.Unlock()
+	d.cond.L.Lock()
+	conn := d.conn
+	if conn == nil || !d.connReady {
+		d.cond.L.Unlock()
+		return
+	}
+	offset := d.written
+	data := d.replay[d.written-d.acked:]
+	writesFin := d.finSent && !d.finWritten
+	d.cond.L.Unlock()
+	for len(data) > 0 {
+		n := len(data)
+		if n > resumableMaxDataLen {
+			n = resumableMaxDataLen
+		}
+		frame := make([]byte, 5+n)
+		frame[0] = resumableDataType
+		binary.BigEndian.PutUint32(frame[1:5], uint32(n))
+		copy(frame[5:], data[:n])
+		if _, err := conn.Write(frame); err != nil {
+			// NOTE: Closing makes the reader notice the break, and the bytes are resent after reconnecting
+			go conn.Close()
+			return
+		}
+		data = data[n:]
+		offset += uint64(n)
+		d.cond.L.Lock()
+		// NOTE: An ack can arrive before here and move written forward
+		if d.written < offset {
+			d.written = offset
+		}
+		d.cond.L.Unlock()
+	}
+	if writesFin {
+		if _, err := conn.Write([]byte{resumableFinType}); err != nil {
+			go conn.Close()
+			return
+		}
+		d.cond.L.Lock()
+		d.finWritten = true
+		d.cond.L.Unlock()
+	}
+}
+
+func (d *resumableDuplex) requestAck() {
+	select {
+	case d.ackCh <- struct{}{}:
+	default:
+	}
+}
+
+// ackLoop sends acks apart from reading not to block reading by writing
+func (d *resumableDuplex) ackLoop() {
+	for {
+		select {
+		case <-d.ackCh:
+		case <-d.closeCh:
+			return
+		}
+		d.frameMutex.Lock()
+		d.cond.L.Lock()
+		conn := d.conn
+		ready := d.connReady
+		received := d.received
+		d.cond.L.Unlock()
+		if conn != nil && ready {
+			frame := make([]byte, 9)
+			frame[0] = resumableAckType
+			binary.BigEndian.PutUint64(frame[1:], received)
+			if _, err := conn.Write(frame); err != nil {
+				go conn.Close()
+			}
+		}
+		d.frameMutex.Unlock()
+	}
+}
+
+func (d *resumableDuplex) fail(err error) {
+	d.cond.L.Lock()
+	d.failedErr = err
+	d.cond.Broadcast()
+	d.cond.L.Unlock()
+	d.readPw.CloseWithError(err)
+}
+
+func (d *resumableDuplex) isClosed() bool {
+	d.cond.L.Lock()
+	defer d.cond.L.Unlock()
+	return d.closed
+}
+
+// writeErrLocked returns an error if writing is not allowed
+// NOTE: cond.L should be locked
+func (d *resumableDuplex) writeErrLocked() error {
+	if d.failedErr != nil {
+		return d.failedErr
+	}
+	if d.closing || d.peerClosed || d.finSent {
+		return io.ErrClosedPipe
+	}
+	return nil
+}
+
+func (d *resumableDuplex) Read(p []byte) (int, error) {
+	return d.readPr.Read(p)
+}
+
+func (d *resumableDuplex) Write(p []byte) (int, error) {
+	d.appWriteMutex.Lock()
+	defer d.appWriteMutex.Unlock()
+	written := 0
+	for len(p) > 0 {
+		d.cond.L.Lock()
+		// Wait for acks when the replay buffer is full
+		for len(d.replay) >= resumableMaxReplayLen && d.writeErrLocked() == nil {
+			d.cond.Wait()
+		}
+		if err := d.writeErrLocked(); err != nil {
+			d.cond.L.Unlock()
+			return written, err
+		}
+		n := len(p)
+		if n > resumableMaxReplayLen-len(d.replay) {
+			n = resumableMaxReplayLen - len(d.replay)
+		}
+		d.replay = append(d.replay, p[:n]...)
+		d.cond.L.Unlock()
+		d.flush()
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite sends fin, which is resent after a break
+func (d *resumableDuplex) CloseWrite() error {
+	d.appWriteMutex.Lock()
+	defer d.appWriteMutex.Unlock()
+	d.cond.L.Lock()
+	if d.finSent {
+		d.cond.L.Unlock()
+		return nil
+	}
+	if err := d.writeErrLocked(); err != nil {
+		d.cond.L.Unlock()
+		return err
+	}
+	d.finSent = true
+	d.cond.L.Unlock()
+	d.flush()
+	return nil
+}
+
+// Close notifies the peer not to resume anymore and closes the current connection
+// NOTE: Close waits for reconnecting to send the rest and the notification
+func (d *resumableDuplex) Close() error {
+	d.cond.L.Lock()
+	if d.closing {
+		d.cond.L.Unlock()
+		return nil
+	}
+	d.closing = true
+	timedOut := false
+	timer := time.AfterFunc(resumableCloseTimeout, func() {
+		d.cond.L.Lock()
+		timedOut = true
+		d.cond.Broadcast()
+		d.cond.L.Unlock()
+	})
+	for !d.connReady && !d.peerClosed && d.failedErr == nil && !timedOut {
+		d.cond.Wait()
+	}
+	timer.Stop()
+	d.closed = true
+	d.cond.Broadcast()
+	conn := d.conn
+	notifiesPeer := d.connReady && !d.peerClosed
+	d.cond.L.Unlock()
+	close(d.closeCh)
+	d.readPr.Close()
+	if conn == nil {
+		return nil
+	}
+	if notifiesPeer {
+		d.flush()
+		d.frameMutex.Lock()
+		conn.Write([]byte{resumableCloseType})
+		d.frameMutex.Unlock()
+	}
+	return conn.Close()
+}
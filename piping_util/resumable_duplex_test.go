@@ -0,0 +1,119 @@
+package piping_util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeHub connects both ends with net.Pipe() for each URL pair
+type pipeHub struct {
+	mutex *sync.Mutex
+	conns map[string]net.Conn
+}
+
+func newPipeHub() *pipeHub {
+	return &pipeHub{mutex: new(sync.Mutex), conns: map[string]net.Conn{}}
+}
+
+func (h *pipeHub) connect(uploadUrl string, downloadUrl string) (io.ReadWriteCloser, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if conn, ok := h.conns[uploadUrl+" "+downloadUrl]; ok {
+		return conn, nil
+	}
+	conn1, conn2 := net.Pipe()
+	h.conns[uploadUrl+" "+downloadUrl] = conn1
+	h.conns[downloadUrl+" "+uploadUrl] = conn2
+	return conn1, nil
+}
+
+// breakAll breaks all connections like proxy timeouts
+func (h *pipeHub) breakAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, conn := range h.conns {
+		conn.Close()
+	}
+}
+
+func newResumablePair(t *testing.T, hub *pipeHub) (*resumableDuplex, *resumableDuplex) {
+	resultCh := make(chan *resumableDuplex)
+	go func() {
+		d, err := ResumableDuplexConnect("https://example.com/cs", "https://example.com/sc", hub.connect)
+		if err != nil {
+			t.Error(err)
+		}
+		resultCh <- d
+	}()
+	d2, err := ResumableDuplexConnect("https://example.com/sc", "https://example.com/cs", hub.connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1 := <-resultCh
+	t.Cleanup(func() {
+		d1.Close()
+		d2.Close()
+	})
+	return d1, d2
+}
+
+func TestResumableDuplexResumesAfterBreaks(t *testing.T) {
+	hub := newPipeHub()
+	d1, d2 := newResumablePair(t, hub)
+	data := make([]byte, 3*resumableMaxReplayLen)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if _, err := d1.Write(data); err != nil {
+			t.Error(err)
+		}
+		d1.CloseWrite()
+	}()
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(20 * time.Millisecond)
+			hub.breakAll()
+		}
+	}()
+	received, err := io.ReadAll(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes, which differ from sent %d bytes", len(received), len(data))
+	}
+	// The other direction is still writable after fin
+	go d2.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(d1, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected body: %s", buf)
+	}
+}
+
+func TestResumableDuplexClose(t *testing.T) {
+	hub := newPipeHub()
+	d1, d2 := newResumablePair(t, hub)
+	go func() {
+		d1.Write([]byte("hello"))
+		d1.Close()
+	}()
+	body, err := io.ReadAll(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	if _, err := d2.Write([]byte("world")); err != io.ErrClosedPipe {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+// Package pipingtest provides an in-memory Piping Server for testing.
+package pipingtest
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	// Latency is inserted before each chunk is forwarded to a receiver
+	Latency time.Duration
+	// A transfer is broken after forwarding DropAfterBytes bytes when it is positive
+	DropAfterBytes int64
+}
+
+// Server is a Piping Server compatible implementation on httptest.Server.
+// HTTP/2 over TLS is used because a sender should receive its response while uploading.
+type Server struct {
+	*httptest.Server
+	mutex   *sync.Mutex
+	options Options
+	pipes   map[string]*pipe
+	// breakCh is closed to break ongoing transfers
+	breakCh chan struct{}
+}
+
+type pipe struct {
+	senderConnected   bool
+	receiverConnected bool
+	transferCh        chan *transfer
+}
+
+type transfer struct {
+	sender *http.Request
+	doneCh chan error
+}
+
+var droppedError = errors.New("transfer dropped by pipingtest")
+
+func NewServer() *Server {
+	return NewServerWithOptions(Options{})
+}
+
+func NewServerWithOptions(options Options) *Server {
+	s := &Server{
+		mutex:   new(sync.Mutex),
+		options: options,
+		pipes:   map[string]*pipe{},
+		breakCh: make(chan struct{}),
+	}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	s.Server.EnableHTTP2 = true
+	s.Server.StartTLS()
+	return s
+}
+
+// SetOptions changes options for transfers established after the call
+func (s *Server) SetOptions(options Options) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.options = options
+}
+
+// BreakTransfers breaks all ongoing transfers like a proxy closing idle connections
+func (s *Server) BreakTransfers() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	close(s.breakCh)
+	s.breakCh = make(chan struct{})
+}
+
+func (s *Server) getOptions() Options {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.options
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		s.handleSender(w, r)
+	case http.MethodGet:
+		s.handleReceiver(w, r)
+	default:
+		http.Error(w, fmt.Sprintf("[ERROR] Unsupported method: %s\n", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) getOrCreatePipe(path string) *pipe {
+	p, ok := s.pipes[path]
+	if !ok {
+		p = &pipe{transferCh: make(chan *transfer)}
+		s.pipes[path] = p
+	}
+	return p
+}
+
+func (s *Server) deletePipeIfUnused(path string, p *pipe) {
+	if !p.senderConnected && !p.receiverConnected && s.pipes[path] == p {
+		delete(s.pipes, path)
+	}
+}
+
+func (s *Server) handleSender(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	s.mutex.Lock()
+	p := s.getOrCreatePipe(path)
+	if p.senderConnected {
+		s.mutex.Unlock()
+		http.Error(w, fmt.Sprintf("[ERROR] Another sender has been connected on '%s'.\n", path), http.StatusBadRequest)
+		return
+	}
+	p.senderConnected = true
+	s.mutex.Unlock()
+
+	// NOTE: The response should be sent before the transfer because a sender may wait for it
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "[INFO] Waiting for 1 receiver(s)...\n")
+	w.(http.Flusher).Flush()
+
+	t := &transfer{sender: r, doneCh: make(chan error, 1)}
+	select {
+	case p.transferCh <- t:
+	case <-r.Context().Done():
+		s.mutex.Lock()
+		p.senderConnected = false
+		s.deletePipeIfUnused(path, p)
+		s.mutex.Unlock()
+		return
+	}
+	if err := <-t.doneCh; err != nil {
+		// Notify the sender of the broken transfer
+		panic(http.ErrAbortHandler)
+	}
+	fmt.Fprint(w, "[INFO] Sent successfully!\n")
+}
+
+func (s *Server) handleReceiver(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	s.mutex.Lock()
+	p := s.getOrCreatePipe(path)
+	if p.receiverConnected {
+		s.mutex.Unlock()
+		http.Error(w, fmt.Sprintf("[ERROR] The number of receivers has reached limits on '%s'.\n", path), http.StatusBadRequest)
+		return
+	}
+	p.receiverConnected = true
+	s.mutex.Unlock()
+
+	var t *transfer
+	select {
+	case t = <-p.transferCh:
+	case <-r.Context().Done():
+		s.mutex.Lock()
+		p.receiverConnected = false
+		s.deletePipeIfUnused(path, p)
+		s.mutex.Unlock()
+		return
+	}
+	s.mutex.Lock()
+	breakCh := s.breakCh
+	s.mutex.Unlock()
+	finishCh := make(chan struct{})
+	go func() {
+		select {
+		// Unblock reading from the sender when the receiver is gone
+		case <-r.Context().Done():
+			t.sender.Body.Close()
+		case <-breakCh:
+			t.sender.Body.Close()
+		case <-finishCh:
+		}
+	}()
+	err := s.transfer(w, t.sender)
+	close(finishCh)
+	t.doneCh <- err
+	s.mutex.Lock()
+	p.senderConnected = false
+	p.receiverConnected = false
+	s.deletePipeIfUnused(path, p)
+	s.mutex.Unlock()
+	if err != nil {
+		// Notify the receiver of the broken transfer
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *Server) transfer(w http.ResponseWriter, sender *http.Request) error {
+	options := s.getOptions()
+	if contentType := sender.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	var transferred int64
+	buf := make([]byte, 16*1024)
+	for {
+		n, rErr := sender.Body.Read(buf)
+		if n > 0 {
+			if options.Latency > 0 {
+				time.Sleep(options.Latency)
+			}
+			chunk := buf[:n]
+			dropped := false
+			if options.DropAfterBytes > 0 && transferred+int64(n) > options.DropAfterBytes {
+				chunk = buf[:options.DropAfterBytes-transferred]
+				dropped = true
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+			transferred += int64(len(chunk))
+			if dropped {
+				return droppedError
+			}
+		}
+		if rErr == io.EOF {
+			return nil
+		}
+		if rErr != nil {
+			return rErr
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package pipingtest
+
+import (
+	"bytes"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTransfer(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	url := server.URL + "/mypath"
+	headers := []piping_util.KeyValue{{Key: "Content-Type", Value: "application/yamux"}}
+	sendRes, err := piping_util.PipingSend(server.Client(), headers, url, strings.NewReader("hello, world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sendRes.StatusCode != 200 {
+		t.Fatalf("unexpected status: %d", sendRes.StatusCode)
+	}
+	getRes, err := piping_util.PipingGet(server.Client(), nil, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType := getRes.Header.Get("Content-Type"); contentType != "application/yamux" {
+		t.Fatalf("unexpected content-type: %s", contentType)
+	}
+	body, err := io.ReadAll(getRes.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello, world" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+	if _, err := io.ReadAll(sendRes.Body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReceiverFirst(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	url := server.URL + "/mypath"
+	bodyCh := make(chan []byte)
+	go func() {
+		getRes, err := piping_util.PipingGet(server.Client(), nil, url)
+		if err != nil {
+			bodyCh <- nil
+			return
+		}
+		body, _ := io.ReadAll(getRes.Body)
+		bodyCh <- body
+	}()
+	_, err := piping_util.PipingSend(server.Client(), nil, url, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := <-bodyCh; string(body) != "hello" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestDropAfterBytes(t *testing.T) {
+	server := NewServerWithOptions(Options{DropAfterBytes: 3})
+	defer server.Close()
+	url := server.URL + "/mypath"
+	_, err := piping_util.PipingSend(server.Client(), nil, url, bytes.NewReader([]byte("abcdefg")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	getRes, err := piping_util.PipingGet(server.Client(), nil, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(getRes.Body)
+	if err == nil {
+		t.Fatal("should be broken")
+	}
+	if string(body) != "abc" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestBreakTransfers(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	url := server.URL + "/mypath"
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	_, err := piping_util.PipingSend(server.Client(), nil, url, pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getRes, err := piping_util.PipingGet(server.Client(), nil, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(getRes.Body, buf); err != nil {
+		t.Fatal(err)
+	}
+	server.BreakTransfers()
+	if _, err := io.ReadAll(getRes.Body); err == nil {
+		t.Fatal("should be broken")
+	}
+}
@@ -0,0 +1,140 @@
+package pmux
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/nwtgck/go-piping-tunnel/aead_duplex"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
+	"github.com/pkg/errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const CompressionDeflate = "deflate"
+
+// Compressions are the compression algorithms of streams supported by pmux
+var Compressions = []string{CompressionDeflate}
+
+// Name of encryption advertised when streams are not encrypted
+const cipherNone = "none"
+
+// Name of encryption advertised when public-key authentication is used
+const cipherPublicKey = "publickey"
+
+// Capabilities are optional features of a side, where both sides use the intersection
+type Capabilities struct {
+	// Compression algorithms of streams in the order of preference, where empty disables compression
+	// NOTE: Streams are compressed before encryption, so sizes of encrypted data may leak secrets mixed with data of attackers (CRIME/BREACH)
+	Compressions []string
+	// Window of each stream in a session in bytes, where 0 is the default and the smaller window of both sides is used
+	WindowSize uint32
+	// Routes is true when streams start with route headers, which should be the same in both sides
+	Routes bool
+}
+
+func (c *Capabilities) Validate() error {
+	for _, compression := range c.Compressions {
+		if !containsString(Compressions, compression) {
+			return errors.Errorf("unsupported pmux compression: %s, expected one of %s", compression, strings.Join(Compressions, ", "))
+		}
+	}
+	if c.WindowSize != 0 && c.WindowSize < sessionMaxDataLen {
+		return errors.Errorf("too small pmux window: %d bytes, expected %d bytes or more", c.WindowSize, sessionMaxDataLen)
+	}
+	return nil
+}
+
+func (c *Capabilities) windowSize() uint32 {
+	if c.WindowSize == 0 {
+		return sessionInitialWindowSize
+	}
+	return c.WindowSize
+}
+
+// CapabilityMismatchError reports a setting which should be the same in both sides, listing what each side supports
+type CapabilityMismatchError struct {
+	Name   string
+	Server []string
+	Client []string
+}
+
+func (e *CapabilityMismatchError) Error() string {
+	return fmt.Sprintf("incompatible pmux %s: server supports [%s], client supports [%s]", e.Name, strings.Join(e.Server, ", "), strings.Join(e.Client, ", "))
+}
+
+// Pbkdf2 is the key derivation of openssl-compatible ciphers
+type Pbkdf2 struct {
+	Iter int
+	Hash func() hash.Hash
+	// HashName is advertised to the peer to detect different key derivation
+	HashName string
+}
+
+// aeadPbkdf2 returns the key derivation of AEAD ciphers, which is optional unlike openssl-compatible ciphers
+func aeadPbkdf2(pbkdf2 *Pbkdf2) (int, func() hash.Hash) {
+	if pbkdf2 == nil {
+		return aead_duplex.DefaultPbkdf2Iter, sha256.New
+	}
+	return pbkdf2.Iter, pbkdf2.Hash
+}
+
+// cipherName is the name of encryption advertised to the peer
+func cipherName(encrypts bool, cipherType string, pbkdf2 *Pbkdf2, publicKeyAuth *pubkey_duplex.Config) string {
+	if publicKeyAuth != nil {
+		return cipherPublicKey
+	}
+	if !encrypts {
+		return cipherNone
+	}
+	switch cipherType {
+	case piping_util.CipherTypeOpensslAes128Ctr, piping_util.CipherTypeOpensslAes256Ctr, piping_util.CipherTypeAes256Gcm, piping_util.CipherTypeChacha20Poly1305:
+		if pbkdf2 != nil {
+			return fmt.Sprintf(`%s (pbkdf2: {"iter":%d,"hash":"%s"})`, cipherType, pbkdf2.Iter, pbkdf2.HashName)
+		}
+	}
+	return cipherType
+}
+
+// negotiate checks the server config and returns the features used by the client
+func (c *client) negotiate(serverConfig *serverConfigJson) error {
+	if serverConfig.Hb != c.enableHb {
+		return &CapabilityMismatchError{Name: "hb", Server: []string{strconv.FormatBool(serverConfig.Hb)}, Client: []string{strconv.FormatBool(c.enableHb)}}
+	}
+	if serverConfig.Resume != c.enableResume {
+		return &CapabilityMismatchError{Name: "resume", Server: []string{strconv.FormatBool(serverConfig.Resume)}, Client: []string{strconv.FormatBool(c.enableResume)}}
+	}
+	// NOTE: Older servers do not advertise routes, which do not support route headers
+	if serverConfig.Routes != c.capabilities.Routes {
+		return &CapabilityMismatchError{Name: "routes", Server: []string{strconv.FormatBool(serverConfig.Routes)}, Client: []string{strconv.FormatBool(c.capabilities.Routes)}}
+	}
+	// NOTE: Older servers do not advertise ciphers
+	cipher := cipherName(c.encrypts, c.cipherType, c.pbkdf2, c.publicKeyAuth)
+	if serverConfig.Ciphers != nil && !containsString(serverConfig.Ciphers, cipher) {
+		return &CapabilityMismatchError{Name: "cipher", Server: serverConfig.Ciphers, Client: []string{cipher}}
+	}
+	// NOTE: Fin of version 1 server is always false
+	c.fin = serverConfig.Fin
+	// NOTE: The first compression of the client supported by the server is used
+	for _, compression := range c.capabilities.Compressions {
+		if containsString(serverConfig.Compressions, compression) {
+			c.compression = compression
+			break
+		}
+	}
+	c.windowSize = c.capabilities.windowSize()
+	if serverConfig.Window != 0 && serverConfig.Window < c.windowSize {
+		c.windowSize = serverConfig.Window
+	}
+	return nil
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package pmux
+
+import (
+	"compress/flate"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"io"
+)
+
+type deflateDuplex struct {
+	inner  io.ReadWriteCloser
+	writer *flate.Writer
+	reader io.ReadCloser
+}
+
+func compressDuplex(duplex io.ReadWriteCloser, compression string) (io.ReadWriteCloser, error) {
+	switch compression {
+	case "":
+		return duplex, nil
+	case CompressionDeflate:
+		writer, err := flate.NewWriter(duplex, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return &deflateDuplex{inner: duplex, writer: writer, reader: flate.NewReader(duplex)}, nil
+	default:
+		return nil, errors.Errorf("unsupported pmux compression: %s", compression)
+	}
+}
+
+func (d *deflateDuplex) Read(p []byte) (int, error) {
+	return d.reader.Read(p)
+}
+
+// NOTE: Each write is flushed not to delay interactive streams
+func (d *deflateDuplex) Write(p []byte) (int, error) {
+	n, err := d.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, d.writer.Flush()
+}
+
+// CloseWrite finishes compression and notifies the peer of the end of writing
+func (d *deflateDuplex) CloseWrite() error {
+	if err := d.writer.Close(); err != nil {
+		return err
+	}
+	return util.CloseWrite(d.inner)
+}
+
+func (d *deflateDuplex) Close() error {
+	d.reader.Close()
+	return d.inner.Close()
+}
@@ -1,4 +1,3 @@
-// TODO: should send fin to notify finish
 package pmux
 
 import (
@@ -7,17 +6,20 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"github.com/nwtgck/go-piping-tunnel/aead_duplex"
 	"github.com/nwtgck/go-piping-tunnel/aes_ctr_duplex"
 	"github.com/nwtgck/go-piping-tunnel/backoff"
+	"github.com/nwtgck/go-piping-tunnel/cpace_duplex"
 	"github.com/nwtgck/go-piping-tunnel/early_piping_duplex"
 	"github.com/nwtgck/go-piping-tunnel/hb_duplex"
 	"github.com/nwtgck/go-piping-tunnel/openpgp_duplex"
+	"github.com/nwtgck/go-piping-tunnel/openssl_aes_ctr_duplex"
 	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pubkey_duplex"
 	"github.com/nwtgck/go-piping-tunnel/util"
 	"github.com/pkg/errors"
 	"io"
 	"net/http"
-	"os"
 	"time"
 )
 
@@ -27,9 +29,21 @@ type server struct {
 	baseUploadUrl   string
 	baseDownloadUrl string
 	enableHb        bool
+	enableResume    bool
 	encrypts        bool
 	passphrase      string
 	cipherType      string // NOTE: encryption in pmux can be updated in the different way in the future such as negotiating algorithm
+	pbkdf2          *Pbkdf2
+	publicKeyAuth   *pubkey_duplex.Config
+	acceptCh        chan acceptResult
+	// NOTE: Each sub-path being accepted holds a slot until Accept() takes its stream
+	acceptSlots  chan struct{}
+	capabilities Capabilities
+}
+
+type acceptResult struct {
+	stream io.ReadWriteCloser
+	err    error
 }
 
 type client struct {
@@ -38,28 +52,93 @@ type client struct {
 	baseUploadUrl   string
 	baseDownloadUrl string
 	enableHb        bool
+	enableResume    bool
 	encrypts        bool
 	passphrase      string
 	cipherType      string
+	pbkdf2          *Pbkdf2
+	publicKeyAuth   *pubkey_duplex.Config
+	// NOTE: fin is enabled when the server supports it
+	fin bool
+	// Number of sessions multiplexing streams, where 0 uses sub-paths for each stream
+	numSessions int
+	// NOTE: sessions is used when the server supports sessions
+	sessions *sessionPool
+	// Number of streams connected in advance, which is used when streams are not multiplexed over sessions
+	streamPoolSize int
+	// NOTE: Each goroutine filling the stream pool sends its connected stream, or its error to a waiting Open()
+	streamPoolCh chan acceptResult
+	capabilities Capabilities
+	// Compression negotiated with the server, where empty is no compression
+	compression string
+	// Window of each stream in a session negotiated with the server
+	windowSize uint32
 }
 
 type serverConfigJson struct {
 	Hb bool `json:"hb"`
+	// NOTE: added in pmux version 2
+	Fin bool `json:"fin"`
+	// NOTE: false in older servers
+	Resume bool `json:"resume"`
+	// NOTE: true when the server accepts sessions multiplexing streams. Older clients ignore this without changing pmux version.
+	Mux bool `json:"mux"`
+	// NOTE: Capabilities below are advertised for negotiation, which are empty in older servers
+	Ciphers      []string `json:"ciphers"`
+	Compressions []string `json:"compressions"`
+	Window       uint32   `json:"window"`
+	Routes       bool     `json:"routes"`
+	// NOTE: true when the server waits for the open frame of pooled streams, where older clients do not pool streams
+	Pool bool `json:"pool"`
 }
 
 type syncJson struct {
 	SubPath string `json:"sub_path"`
+	// NOTE: added in pmux version 2. A client sends true when the stream supports fin
+	Fin bool `json:"fin"`
+	// NOTE: A client sends true when the sub-path is a session multiplexing streams
+	Mux bool `json:"mux"`
+	// NOTE: A client sends true when the stream is connected in advance, which waits for the open frame
+	Pooled bool `json:"pooled"`
+	// Compression and window negotiated by the client
+	Compression string `json:"compression"`
+	Window      uint32 `json:"window"`
+}
+
+// NOTE: Older clients without window use the default
+func (s *syncJson) windowSize() uint32 {
+	if s.Window == 0 {
+		return sessionInitialWindowSize
+	}
+	return s.Window
 }
 
-const pmuxVersion uint32 = 1
+const pmuxVersion uint32 = 2
+
+// NOTE: version 1 has no fin
+const minPmuxVersion uint32 = 1
 const pmuxMimeType = "application/pmux"
 const httpTimeout = 50 * time.Second
 
+// NOTE: Sending a sub-path fails after this number of retries
+const maxSubPathRetries = 5
+
+// streamOpenFrame is sent by the client when a pooled stream is opened
+const streamOpenFrame byte = 1
+
+// NOTE: A pooled stream is reconnected after this idle time because it may have been closed by proxies
+const streamPoolMaxIdle = 1 * time.Minute
+
+// Default number of sessions of a client
+const DefaultNumSessions = 2
+
+// Default number of sub-paths of a server connected concurrently
+const DefaultAcceptConcurrency = 8
+
 var pmuxVersionBytes [4]byte
-var IncompatiblePmuxVersion = errors.Errorf("incompatible pmux version, expected %d", pmuxVersion)
+var IncompatiblePmuxVersion = errors.Errorf("incompatible pmux version, expected %d to %d", minPmuxVersion, pmuxVersion)
 var NonPmuxMimeTypeError = errors.Errorf("invalid content-type, expected %s", pmuxMimeType)
 var IncompatibleServerConfigError = errors.Errorf("imcompatible server config")
-var DifferentHbSettingError = errors.Errorf("different hb setting from server's")
 
 func init() {
 	binary.BigEndian.PutUint32(pmuxVersionBytes[:], pmuxVersion)
@@ -69,18 +148,53 @@ func headersWithPmux(headers []piping_util.KeyValue) []piping_util.KeyValue {
 	return append(headers, piping_util.KeyValue{Key: "Content-Type", Value: pmuxMimeType})
 }
 
-func Server(httpClient *http.Client, headers []piping_util.KeyValue, baseUploadUrl string, baseDownloadUrl string, enableHb bool, encrypts bool, passphrase string, cipherType string) *server {
+// Config is a config of a server or a client, where both hosts should have the same Hb, EnableResume and encryption
+type Config struct {
+	HttpClient      *http.Client
+	Headers         []piping_util.KeyValue
+	BaseUploadUrl   string
+	BaseDownloadUrl string
+	EnableHb        bool
+	EnableResume    bool
+	Encrypts        bool
+	Passphrase      string
+	CipherType      string
+	// NOTE: nil when the cipher does not derive keys by PBKDF2
+	Pbkdf2        *Pbkdf2
+	PublicKeyAuth *pubkey_duplex.Config
+	Capabilities  Capabilities
+	// Number of sub-paths of a server connected concurrently
+	AcceptConcurrency int
+	// Number of sessions of a client multiplexing streams, where 0 uses sub-paths for each stream
+	NumSessions int
+	// Number of streams of a client connected in advance
+	StreamPoolSize int
+}
+
+// Server accepts streams of the client, where up to config.AcceptConcurrency sub-paths are connected concurrently
+func Server(config *Config) *server {
+	acceptConcurrency := config.AcceptConcurrency
+	if acceptConcurrency < 1 {
+		acceptConcurrency = 1
+	}
 	server := &server{
-		httpClient:      httpClient,
-		headers:         headers,
-		baseUploadUrl:   baseUploadUrl,
-		baseDownloadUrl: baseDownloadUrl,
-		enableHb:        enableHb,
-		encrypts:        encrypts,
-		passphrase:      passphrase,
-		cipherType:      cipherType,
+		httpClient:      config.HttpClient,
+		headers:         config.Headers,
+		baseUploadUrl:   config.BaseUploadUrl,
+		baseDownloadUrl: config.BaseDownloadUrl,
+		enableHb:        config.EnableHb,
+		enableResume:    config.EnableResume,
+		encrypts:        config.Encrypts,
+		passphrase:      config.Passphrase,
+		cipherType:      config.CipherType,
+		pbkdf2:          config.Pbkdf2,
+		publicKeyAuth:   config.PublicKeyAuth,
+		acceptCh:        make(chan acceptResult),
+		acceptSlots:     make(chan struct{}, acceptConcurrency),
+		capabilities:    config.Capabilities,
 	}
 	go server.sendVersionAndConfigLoop()
+	go server.acceptLoop()
 	return server
 }
 
@@ -98,18 +212,23 @@ func (s *server) sendVersionAndConfigLoop() {
 		ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
 		defer cancel()
 		// NOTE: In the future, config scheme can change more efficient format than JSON
-		configJsonBytes, err := json.Marshal(serverConfigJson{Hb: s.enableHb})
+		configJsonBytes, err := json.Marshal(serverConfigJson{
+			Hb:           s.enableHb,
+			Fin:          true,
+			Resume:       s.enableResume,
+			Mux:          true,
+			Ciphers:      []string{cipherName(s.encrypts, s.cipherType, s.pbkdf2, s.publicKeyAuth)},
+			Compressions: s.capabilities.Compressions,
+			Window:       s.capabilities.windowSize(),
+			Routes:       s.capabilities.Routes,
+			Pool:         true,
+		})
 		if err != nil {
 			// backoff
 			time.Sleep(b.NextDuration())
 			continue
 		}
 		postRes, err := piping_util.PipingSendWithContext(ctx, s.httpClient, headersWithPmux(s.headers), s.baseUploadUrl, bytes.NewReader(append(pmuxVersionBytes[:], configJsonBytes...)))
-		if postRes.StatusCode != 200 {
-			// backoff
-			time.Sleep(b.NextDuration())
-			continue
-		}
 		// If timeout
 		if util.IsTimeoutErr(err) {
 			// reset backoff
@@ -122,6 +241,11 @@ func (s *server) sendVersionAndConfigLoop() {
 			time.Sleep(b.NextDuration())
 			continue
 		}
+		if postRes.StatusCode != 200 {
+			// backoff
+			time.Sleep(b.NextDuration())
+			continue
+		}
 		_, err = io.Copy(io.Discard, postRes.Body)
 		if err != nil {
 			// backoff
@@ -131,88 +255,159 @@ func (s *server) sendVersionAndConfigLoop() {
 	}
 }
 
-func (s *server) getSubPath() (string, error) {
+func (s *server) getSync() (*syncJson, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), httpTimeout)
 	defer cancel()
 	getRes, err := piping_util.PipingGetWithContext(ctx, s.httpClient, s.headers, s.baseDownloadUrl)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if getRes.StatusCode != 200 {
-		return "", &getSubPathStatusError{statusCode: getRes.StatusCode}
+		return nil, &getSubPathStatusError{statusCode: getRes.StatusCode}
 	}
 	resBytes, err := io.ReadAll(getRes.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	var sync syncJson
 	err = json.Unmarshal(resBytes, &sync)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return sync.SubPath, nil
+	return &sync, nil
 }
 
+// Accept returns a stream opened by the client, from sub-paths or sessions
 func (s *server) Accept() (io.ReadWriteCloser, error) {
+	result := <-s.acceptCh
+	return result.stream, result.err
+}
+
+func (s *server) acceptLoop() {
 	b := backoff.NewExponentialBackoff()
-	var subPath string
 	for {
-		var err error
-		subPath, err = s.getSubPath()
-		if err == nil {
-			break
+		sync, err := s.getSync()
+		if err != nil {
+			// If timeout
+			if util.IsTimeoutErr(err) {
+				// reset backoff
+				b.Reset()
+				// No backoff
+				continue
+			}
+			// backoff
+			time.Sleep(b.NextDuration())
+			continue
 		}
-		// If timeout
-		if util.IsTimeoutErr(err) {
-			// reset backoff
-			b.Reset()
-			// No backoff
+		b.Reset()
+		// NOTE: Sessions do not hold slots because they are long-lived
+		if sync.Mux {
+			go s.serveSession(sync)
 			continue
 		}
-		// backoff
-		time.Sleep(b.NextDuration())
+		// NOTE: A slow sub-path does not block the others up to the concurrency
+		s.acceptSlots <- struct{}{}
+		go s.acceptSubPath(sync)
+	}
+}
+
+func (s *server) acceptSubPath(sync *syncJson) {
+	stream, err := s.connectSubPath(sync)
+	if err == nil && sync.Pooled {
+		// NOTE: A pooled stream waits to be opened without holding the slot, and the target is not connected until then
+		<-s.acceptSlots
+		if err := waitStreamOpen(stream); err != nil {
+			// NOTE: The client closes stale pooled streams without opening them
+			stream.Close()
+			return
+		}
+		s.acceptCh <- acceptResult{stream: stream}
+		return
+	}
+	defer func() { <-s.acceptSlots }()
+	if err == nil && !sync.Fin {
+		stream = &streamWithoutFin{stream}
+	}
+	s.acceptCh <- acceptResult{stream: stream, err: err}
+}
+
+// waitStreamOpen reads the open frame of a pooled stream
+func waitStreamOpen(stream io.Reader) error {
+	frame := make([]byte, 1)
+	if _, err := io.ReadFull(stream, frame); err != nil {
+		return err
 	}
-	uploadUrl, err := util.UrlJoin(s.baseUploadUrl, subPath)
+	if frame[0] != streamOpenFrame {
+		return errors.Errorf("unexpected frame of pooled stream: %d", frame[0])
+	}
+	return nil
+}
+
+// serveSession accepts streams of the session until it closes
+func (s *server) serveSession(sync *syncJson) {
+	duplex, err := s.connectSubPath(sync)
 	if err != nil {
-		return nil, err
+		s.acceptCh <- acceptResult{err: err}
+		return
+	}
+	session := newSession(duplex, sync.windowSize())
+	for {
+		stream, err := session.accept()
+		if err != nil {
+			return
+		}
+		s.acceptCh <- acceptResult{stream: stream}
+	}
+}
+
+func (s *server) connectSubPath(sync *syncJson) (io.ReadWriteCloser, error) {
+	if sync.Compression != "" && !containsString(s.capabilities.Compressions, sync.Compression) {
+		return nil, &CapabilityMismatchError{Name: "compression", Server: s.capabilities.Compressions, Client: []string{sync.Compression}}
+	}
+	if sync.Window != 0 && sync.Window < sessionMaxDataLen {
+		return nil, errors.Errorf("too small pmux window: %d bytes", sync.Window)
 	}
-	downloadUrl, err := util.UrlJoin(s.baseDownloadUrl, subPath)
+	// NOTE: The window is the memory buffered for each stream in this host
+	if sync.Mux && sync.windowSize() > s.capabilities.windowSize() {
+		return nil, errors.Errorf("too large pmux window: %d bytes, expected %d bytes or less", sync.windowSize(), s.capabilities.windowSize())
+	}
+	uploadUrl, err := util.UrlJoin(s.baseUploadUrl, sync.SubPath)
 	if err != nil {
 		return nil, err
 	}
-	var duplex io.ReadWriteCloser
-	duplex, err = early_piping_duplex.DuplexConnect(s.httpClient, s.headers, uploadUrl, downloadUrl)
+	downloadUrl, err := util.UrlJoin(s.baseDownloadUrl, sync.SubPath)
 	if err != nil {
 		return nil, err
 	}
-	if s.enableHb {
-		duplex = hb_duplex.Duplex(duplex)
+	duplex, err := connectStream(s.httpClient, s.headers, uploadUrl, downloadUrl, s.enableHb, s.enableResume)
+	if err != nil {
+		return nil, err
 	}
-	if s.encrypts {
-		switch s.cipherType {
-		case piping_util.CipherTypeAesCtr:
-			// Encrypt with AES-CTR
-			duplex, err = aes_ctr_duplex.Duplex(duplex, duplex, []byte(s.passphrase))
-		case piping_util.CipherTypeOpenpgp:
-			duplex, err = openpgp_duplex.SymmetricallyEncryptDuplexWithOpenPGP(duplex, duplex, []byte(s.passphrase))
-		// NOTE: pmux does not support openssl-compatible encryption
-		default:
-			return nil, errors.Errorf("unexpected cipher type: %s", s.cipherType)
-		}
+	duplex, err = secureDuplex(duplex, s.publicKeyAuth, s.encrypts, s.passphrase, s.cipherType, s.pbkdf2)
+	if err != nil {
+		return nil, err
 	}
-	return duplex, err
+	return compressDuplex(duplex, sync.Compression)
 }
 
-func Client(httpClient *http.Client, headers []piping_util.KeyValue, baseUploadUrl string, baseDownloadUrl string, enableHb bool, encrypts bool, passphrase string, cipherType string) (*client, error) {
+// Client connects to the server, where streams are multiplexed over config.NumSessions sessions when the server supports them.
+// Otherwise, config.StreamPoolSize streams are connected in advance to open streams without waiting for the server.
+func Client(config *Config) (*client, error) {
 	client := &client{
-		httpClient:      httpClient,
-		headers:         headers,
-		baseUploadUrl:   baseUploadUrl,
-		baseDownloadUrl: baseDownloadUrl,
-		enableHb:        enableHb,
-		encrypts:        encrypts,
-		passphrase:      passphrase,
-		cipherType:      cipherType,
+		httpClient:      config.HttpClient,
+		headers:         config.Headers,
+		baseUploadUrl:   config.BaseUploadUrl,
+		baseDownloadUrl: config.BaseDownloadUrl,
+		enableHb:        config.EnableHb,
+		enableResume:    config.EnableResume,
+		encrypts:        config.Encrypts,
+		passphrase:      config.Passphrase,
+		cipherType:      config.CipherType,
+		pbkdf2:          config.Pbkdf2,
+		publicKeyAuth:   config.PublicKeyAuth,
+		numSessions:     config.NumSessions,
+		streamPoolSize:  config.StreamPoolSize,
+		capabilities:    config.Capabilities,
 	}
 	return client, client.checkServerVersionAndConfig()
 }
@@ -251,8 +446,8 @@ func (c *client) checkServerVersionAndConfig() error {
 			continue
 		}
 		serverVersion := binary.BigEndian.Uint32(versionBytes)
-		if serverVersion != pmuxVersion {
-			return IncompatiblePmuxVersion
+		if serverVersion < minPmuxVersion || serverVersion > pmuxVersion {
+			return errors.Wrapf(IncompatiblePmuxVersion, "server pmux version %d", serverVersion)
 		}
 		serverConfigJsonBytes, err := io.ReadAll(postRes.Body)
 		if err != nil {
@@ -264,19 +459,34 @@ func (c *client) checkServerVersionAndConfig() error {
 		if json.Unmarshal(serverConfigJsonBytes, &serverConfig) != nil {
 			return IncompatibleServerConfigError
 		}
-		if serverConfig.Hb != c.enableHb {
-			return DifferentHbSettingError
+		if err := c.negotiate(&serverConfig); err != nil {
+			return err
+		}
+		// NOTE: OpenPGP does not flush a message until its end, so it cannot encrypt a long-lived session
+		if serverConfig.Mux && c.numSessions > 0 && !(c.encrypts && c.cipherType == piping_util.CipherTypeOpenpgp) {
+			c.sessions = newSessionPool(c.numSessions, c.connectSession)
+			return nil
+		}
+		// NOTE: Older servers connect the target when a stream is connected, not when it is opened
+		if c.streamPoolSize > 0 && serverConfig.Pool {
+			c.streamPoolCh = make(chan acceptResult)
+			for i := 0; i < c.streamPoolSize; i++ {
+				go c.fillStreamPool()
+			}
 		}
 		return nil
 	}
 }
 
-func (c *client) sendSubPath() (string, error) {
+func (c *client) sendSubPath(mux bool, pooled bool) (string, error) {
 	subPath, err := util.RandomHexString()
 	if err != nil {
 		return "", err
 	}
-	sync := syncJson{SubPath: subPath}
+	sync := syncJson{SubPath: subPath, Fin: c.fin, Mux: mux, Pooled: pooled, Compression: c.compression}
+	if mux {
+		sync.Window = c.windowSize
+	}
 	jsonBytes, err := json.Marshal(sync)
 	if err != nil {
 		return "", err
@@ -293,11 +503,75 @@ func (c *client) sendSubPath() (string, error) {
 }
 
 func (c *client) Open() (io.ReadWriteCloser, error) {
+	if c.sessions != nil {
+		return c.sessions.open()
+	}
+	if c.streamPoolCh != nil {
+		result := <-c.streamPoolCh
+		if result.err != nil {
+			return nil, result.err
+		}
+		if _, err := result.stream.Write([]byte{streamOpenFrame}); err != nil {
+			result.stream.Close()
+			return nil, err
+		}
+		return result.stream, nil
+	}
+	return c.connectStreamSubPath(false)
+}
+
+// fillStreamPool keeps one stream connected in advance until Open() takes it
+// NOTE: The server host accepts the stream when it is opened by the open frame
+func (c *client) fillStreamPool() {
+	b := backoff.NewExponentialBackoff()
+	for {
+		stream, err := c.connectStreamSubPath(true)
+		if err != nil {
+			// NOTE: The error is returned only to a waiting Open(), not to later ones
+			select {
+			case c.streamPoolCh <- acceptResult{err: err}:
+			default:
+			}
+			// backoff
+			time.Sleep(b.NextDuration())
+			continue
+		}
+		b.Reset()
+		select {
+		case c.streamPoolCh <- acceptResult{stream: stream}:
+		case <-time.After(streamPoolMaxIdle):
+			stream.Close()
+		}
+	}
+}
+
+func (c *client) connectStreamSubPath(pooled bool) (io.ReadWriteCloser, error) {
+	duplex, err := c.connectSubPath(false, pooled)
+	if err != nil {
+		return nil, err
+	}
+	if !c.fin {
+		return &streamWithoutFin{duplex}, nil
+	}
+	return duplex, nil
+}
+
+func (c *client) connectSession() (*session, error) {
+	duplex, err := c.connectSubPath(true, false)
+	if err != nil {
+		return nil, err
+	}
+	return newSession(duplex, c.windowSize), nil
+}
+
+// connectSubPath sends a new sub-path to the server and connects to it
+func (c *client) connectSubPath(mux bool, pooled bool) (io.ReadWriteCloser, error) {
 	b := backoff.NewExponentialBackoff()
 	var subPath string
+	retries := 0
 	for {
 		var err error
-		subPath, err = c.sendSubPath()
+		subPath, err = c.sendSubPath(mux, pooled)
 		if err == nil {
 			break
 		}
@@ -306,7 +580,10 @@ func (c *client) Open() (io.ReadWriteCloser, error) {
 			b.Reset()
 			continue
 		}
-		fmt.Fprintln(os.Stderr, "get sync error", err)
+		if retries == maxSubPathRetries {
+			return nil, errors.Wrapf(err, "failed to send pmux sub-path after %d retries", retries)
+		}
+		retries++
 		time.Sleep(b.NextDuration())
 	}
 	uploadUrl, err := util.UrlJoin(c.baseUploadUrl, subPath)
@@ -317,25 +594,88 @@ func (c *client) Open() (io.ReadWriteCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	var duplex io.ReadWriteCloser
-	duplex, err = early_piping_duplex.DuplexConnect(c.httpClient, c.headers, uploadUrl, downloadUrl)
+	duplex, err := connectStream(c.httpClient, c.headers, uploadUrl, downloadUrl, c.enableHb, c.enableResume)
 	if err != nil {
 		return nil, err
 	}
-	if c.enableHb {
-		duplex = hb_duplex.Duplex(duplex)
+	duplex, err = secureDuplex(duplex, c.publicKeyAuth, c.encrypts, c.passphrase, c.cipherType, c.pbkdf2)
+	if err != nil {
+		return nil, err
+	}
+	return compressDuplex(duplex, c.compression)
+}
+
+// secureDuplex authenticates and encrypts the duplex of a stream or a session
+func secureDuplex(duplex io.ReadWriteCloser, publicKeyAuth *pubkey_duplex.Config, encrypts bool, passphrase string, cipherType string, pbkdf2 *Pbkdf2) (io.ReadWriteCloser, error) {
+	var err error
+	if publicKeyAuth != nil {
+		duplex, err = pubkey_duplex.Duplex(duplex, duplex, publicKeyAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !encrypts {
+		return duplex, nil
 	}
-	if c.encrypts {
-		switch c.cipherType {
-		case piping_util.CipherTypeAesCtr:
-			// Encrypt with AES-CTR
-			duplex, err = aes_ctr_duplex.Duplex(duplex, duplex, []byte(c.passphrase))
-		case piping_util.CipherTypeOpenpgp:
-			duplex, err = openpgp_duplex.SymmetricallyEncryptDuplexWithOpenPGP(duplex, duplex, []byte(c.passphrase))
-		// NOTE: pmux does not support openssl-compatible encryption
-		default:
-			return nil, errors.Errorf("unexpected cipher type: %s", c.cipherType)
+	switch cipherType {
+	case piping_util.CipherTypeAesCtr:
+		// Encrypt with AES-CTR
+		duplex, err = aes_ctr_duplex.Duplex(duplex, duplex, []byte(passphrase))
+	case piping_util.CipherTypeOpensslAes128Ctr:
+		if pbkdf2 == nil {
+			return nil, errors.Errorf("pbkdf2 is required for %s", cipherType)
 		}
+		duplex, err = openssl_aes_ctr_duplex.Duplex(duplex, duplex, []byte(passphrase), pbkdf2.Iter, 128/8, pbkdf2.Hash)
+	case piping_util.CipherTypeOpensslAes256Ctr:
+		if pbkdf2 == nil {
+			return nil, errors.Errorf("pbkdf2 is required for %s", cipherType)
+		}
+		duplex, err = openssl_aes_ctr_duplex.Duplex(duplex, duplex, []byte(passphrase), pbkdf2.Iter, 256/8, pbkdf2.Hash)
+	case piping_util.CipherTypeOpenpgp:
+		duplex, err = openpgp_duplex.SymmetricallyEncryptDuplexWithOpenPGP(duplex, duplex, []byte(passphrase))
+	case piping_util.CipherTypeAes256Gcm:
+		pbkdf2Iter, h := aeadPbkdf2(pbkdf2)
+		duplex, err = aead_duplex.Duplex(duplex, duplex, []byte(passphrase), pbkdf2Iter, h, aead_duplex.Aes256Gcm)
+	case piping_util.CipherTypeChacha20Poly1305:
+		pbkdf2Iter, h := aeadPbkdf2(pbkdf2)
+		duplex, err = aead_duplex.Duplex(duplex, duplex, []byte(passphrase), pbkdf2Iter, h, aead_duplex.Chacha20Poly1305)
+	case piping_util.CipherTypeCpaceAes256Gcm:
+		duplex, err = cpace_duplex.Duplex(duplex, duplex, []byte(passphrase), aead_duplex.Aes256Gcm)
+	case piping_util.CipherTypeCpaceChacha20Poly1305:
+		duplex, err = cpace_duplex.Duplex(duplex, duplex, []byte(passphrase), aead_duplex.Chacha20Poly1305)
+	default:
+		return nil, errors.Errorf("unexpected cipher type: %s", cipherType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return duplex, nil
+}
+
+// connectStream connects to the sub-paths of a stream
+// NOTE: Heartbeat is inside the resumable duplex to keep each HTTP request alive
+func connectStream(httpClient *http.Client, headers []piping_util.KeyValue, uploadUrl string, downloadUrl string, enableHb bool, enableResume bool) (io.ReadWriteCloser, error) {
+	connect := func(uploadUrl string, downloadUrl string) (io.ReadWriteCloser, error) {
+		duplex, err := early_piping_duplex.DuplexConnect(httpClient, headers, uploadUrl, downloadUrl)
+		if err != nil {
+			return nil, err
+		}
+		if enableHb {
+			return hb_duplex.Duplex(duplex), nil
+		}
+		return duplex, nil
+	}
+	if !enableResume {
+		return connect(uploadUrl, downloadUrl)
+	}
+	duplex, err := piping_util.ResumableDuplexConnect(uploadUrl, downloadUrl, connect)
+	if err != nil {
+		return nil, err
 	}
-	return duplex, err
+	return duplex, nil
+}
+
+// streamWithoutFin hides CloseWrite() because the peer does not understand fin
+type streamWithoutFin struct {
+	io.ReadWriteCloser
 }
@@ -0,0 +1,210 @@
+package pmux
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/nwtgck/go-piping-tunnel/piping_util"
+	"github.com/nwtgck/go-piping-tunnel/pipingtest"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newPipingServer(t *testing.T) (string, string, *http.Client) {
+	pipingServer := pipingtest.NewServer()
+	t.Cleanup(func() {
+		// NOTE: The server and the client keep requests to the Piping Server, which are closed here
+		pipingServer.Listener.Close()
+		pipingServer.CloseClientConnections()
+		pipingServer.Close()
+	})
+	return pipingServer.URL + "/pmux-cs", pipingServer.URL + "/pmux-sc", pipingServer.Client()
+}
+
+func TestServerAcceptsConcurrently(t *testing.T) {
+	clientToServerUrl, serverToClientUrl, httpClient := newPipingServer(t)
+	// NOTE: AES-CTR blocks connecting a sub-path until the peer sends its IV
+	server := Server(&Config{HttpClient: httpClient, BaseUploadUrl: serverToClientUrl, BaseDownloadUrl: clientToServerUrl, Encrypts: true, Passphrase: "mypass", CipherType: piping_util.CipherTypeAesCtr, AcceptConcurrency: 2})
+	client, err := Client(&Config{HttpClient: httpClient, BaseUploadUrl: clientToServerUrl, BaseDownloadUrl: serverToClientUrl, Encrypts: true, Passphrase: "mypass", CipherType: piping_util.CipherTypeAesCtr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client never connects this sub-path
+	if _, err := client.sendSubPath(false, false); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		stream, err := client.Open()
+		if err != nil {
+			return
+		}
+		stream.Write([]byte("hello"))
+	}()
+	acceptedCh := make(chan io.ReadWriteCloser)
+	go func() {
+		stream, err := server.Accept()
+		if err == nil {
+			acceptedCh <- stream
+		}
+	}()
+	select {
+	case stream := <-acceptedCh:
+		defer stream.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("unexpected body: %q", buf)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("accepting is blocked by the unconnected sub-path")
+	}
+}
+
+func TestCapabilityMismatch(t *testing.T) {
+	clientToServerUrl, serverToClientUrl, httpClient := newPipingServer(t)
+	Server(&Config{HttpClient: httpClient, BaseUploadUrl: serverToClientUrl, BaseDownloadUrl: clientToServerUrl, EnableHb: true, Encrypts: true, Passphrase: "mypass", CipherType: piping_util.CipherTypeAes256Gcm, AcceptConcurrency: 1})
+	_, err := Client(&Config{HttpClient: httpClient, BaseUploadUrl: clientToServerUrl, BaseDownloadUrl: serverToClientUrl, Encrypts: true, Passphrase: "mypass", CipherType: piping_util.CipherTypeAes256Gcm})
+	if err == nil || err.Error() != "incompatible pmux hb: server supports [true], client supports [false]" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = Client(&Config{HttpClient: httpClient, BaseUploadUrl: clientToServerUrl, BaseDownloadUrl: serverToClientUrl, EnableHb: true, Encrypts: true, Passphrase: "mypass", CipherType: piping_util.CipherTypeChacha20Poly1305})
+	if err == nil || err.Error() != "incompatible pmux cipher: server supports [aes-256-gcm], client supports [chacha20-poly1305]" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = Client(&Config{HttpClient: httpClient, BaseUploadUrl: clientToServerUrl, BaseDownloadUrl: serverToClientUrl, EnableHb: true, Encrypts: true, Passphrase: "mypass", CipherType: piping_util.CipherTypeAes256Gcm, Capabilities: Capabilities{Routes: true}})
+	if err == nil || err.Error() != "incompatible pmux routes: server supports [false], client supports [true]" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestPbkdf2Mismatch(t *testing.T) {
+	clientToServerUrl, serverToClientUrl, httpClient := newPipingServer(t)
+	Server(&Config{HttpClient: httpClient, BaseUploadUrl: serverToClientUrl, BaseDownloadUrl: clientToServerUrl, EnableHb: true, Encrypts: true, Passphrase: "mypass", CipherType: piping_util.CipherTypeOpensslAes256Ctr, Pbkdf2: &Pbkdf2{Iter: 1000, Hash: sha256.New, HashName: "sha256"}, AcceptConcurrency: 1})
+	_, err := Client(&Config{HttpClient: httpClient, BaseUploadUrl: clientToServerUrl, BaseDownloadUrl: serverToClientUrl, EnableHb: true, Encrypts: true, Passphrase: "mypass", CipherType: piping_util.CipherTypeOpensslAes256Ctr, Pbkdf2: &Pbkdf2{Iter: 100000, Hash: sha256.New, HashName: "sha256"}})
+	expected := `incompatible pmux cipher: server supports [openssl-aes-256-ctr (pbkdf2: {"iter":1000,"hash":"sha256"})], client supports [openssl-aes-256-ctr (pbkdf2: {"iter":100000,"hash":"sha256"})]`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestNegotiatedCompressionAndWindow(t *testing.T) {
+	for _, numSessions := range []int{0, 1} {
+		clientToServerUrl, serverToClientUrl, httpClient := newPipingServer(t)
+		server := Server(&Config{HttpClient: httpClient, BaseUploadUrl: serverToClientUrl, BaseDownloadUrl: clientToServerUrl, AcceptConcurrency: 1, Capabilities: Capabilities{Compressions: []string{CompressionDeflate}, WindowSize: 64 * 1024}})
+		client, err := Client(&Config{HttpClient: httpClient, BaseUploadUrl: clientToServerUrl, BaseDownloadUrl: serverToClientUrl, NumSessions: numSessions, Capabilities: Capabilities{Compressions: []string{"unknown", CompressionDeflate}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.compression != CompressionDeflate || client.windowSize != 64*1024 {
+			t.Fatalf("unexpected negotiation: compression=%s, window=%d", client.compression, client.windowSize)
+		}
+		content := bytes.Repeat([]byte("hello, world\n"), 100000)
+		go func() {
+			stream, err := client.Open()
+			if err != nil {
+				return
+			}
+			stream.Write(content)
+		}()
+		stream, err := server.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, len(content))
+		if _, err := io.ReadFull(stream, body); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(body, content) {
+			t.Fatalf("unexpected body with %d sessions", numSessions)
+		}
+		stream.Close()
+	}
+}
+
+func TestStreamPoolWaitsForOpen(t *testing.T) {
+	clientToServerUrl, serverToClientUrl, httpClient := newPipingServer(t)
+	server := Server(&Config{HttpClient: httpClient, BaseUploadUrl: serverToClientUrl, BaseDownloadUrl: clientToServerUrl, AcceptConcurrency: 1})
+	client, err := Client(&Config{HttpClient: httpClient, BaseUploadUrl: clientToServerUrl, BaseDownloadUrl: serverToClientUrl, StreamPoolSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptedCh := make(chan io.ReadWriteCloser)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			acceptedCh <- stream
+		}
+	}()
+	// NOTE: More pooled streams than the accept concurrency are connected
+	select {
+	case <-acceptedCh:
+		t.Fatal("a pooled stream should not be accepted before it is opened")
+	case <-time.After(2 * time.Second):
+	}
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case accepted := <-acceptedCh:
+		defer accepted.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(accepted, buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != "hello" {
+			t.Fatalf("unexpected body: %q", buf)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the opened stream was not accepted")
+	}
+}
+
+func TestOpenFailsAfterRetries(t *testing.T) {
+	pipingServer := pipingtest.NewServer()
+	t.Cleanup(pipingServer.Close)
+	clientToServerUrl, serverToClientUrl := pipingServer.URL+"/pmux-cs", pipingServer.URL+"/pmux-sc"
+	Server(&Config{HttpClient: pipingServer.Client(), BaseUploadUrl: serverToClientUrl, BaseDownloadUrl: clientToServerUrl, AcceptConcurrency: 1})
+	client, err := Client(&Config{HttpClient: pipingServer.Client(), BaseUploadUrl: clientToServerUrl, BaseDownloadUrl: serverToClientUrl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Piping Server is down
+	pipingServer.Listener.Close()
+	pipingServer.CloseClientConnections()
+	errCh := make(chan error)
+	go func() {
+		_, err := client.Open()
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("Open() should fail")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Open() retries forever")
+	}
+}
+
+func TestTooLargeWindow(t *testing.T) {
+	clientToServerUrl, serverToClientUrl, httpClient := newPipingServer(t)
+	server := Server(&Config{HttpClient: httpClient, BaseUploadUrl: serverToClientUrl, BaseDownloadUrl: clientToServerUrl, AcceptConcurrency: 1, Capabilities: Capabilities{WindowSize: 64 * 1024}})
+	for _, window := range []uint32{0, 64*1024 + 1} {
+		_, err := server.connectSubPath(&syncJson{SubPath: "sub", Mux: true, Window: window})
+		if err == nil || !strings.HasPrefix(err.Error(), "too large pmux window: ") {
+			t.Fatalf("unexpected error with window %d: %v", window, err)
+		}
+	}
+}
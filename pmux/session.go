@@ -0,0 +1,389 @@
+package pmux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+)
+
+// NOTE: A session multiplexes streams over one long-lived duplex instead of sub-paths for each stream.
+// A frame is its type (1 byte), the stream ID (4 bytes), the length of the payload (4 bytes) and the payload.
+const (
+	// Open a stream, which is writable without waiting for the peer
+	sessionFrameSyn byte = iota + 1
+	sessionFrameData
+	// Payload is an increment of the window in 4 bytes
+	sessionFrameWindowUpdate
+	// End of writing of the stream
+	sessionFrameFin
+	// Abort the stream
+	sessionFrameRst
+)
+
+const sessionFrameHeaderLen = 9
+
+// Default window of each stream, which is the maximum bytes sent before the peer reads them
+const sessionInitialWindowSize uint32 = 256 * 1024
+const sessionMaxDataLen = 16 * 1024
+
+var StreamResetError = errors.New("pmux stream reset by peer")
+var SessionClosedError = errors.New("pmux session closed")
+
+type session struct {
+	duplex       io.ReadWriteCloser
+	writeMutex   *sync.Mutex
+	streamsMutex *sync.Mutex
+	streams      map[uint32]*sessionStream
+	nextStreamId uint32
+	acceptCh     chan *sessionStream
+	closeOnce    *sync.Once
+	closedCh     chan struct{}
+	// Window of each stream, which both sides agree on
+	windowSize uint32
+}
+
+func newSession(duplex io.ReadWriteCloser, windowSize uint32) *session {
+	s := &session{
+		duplex:       duplex,
+		windowSize:   windowSize,
+		writeMutex:   new(sync.Mutex),
+		streamsMutex: new(sync.Mutex),
+		streams:      map[uint32]*sessionStream{},
+		nextStreamId: 1,
+		acceptCh:     make(chan *sessionStream),
+		closeOnce:    new(sync.Once),
+		closedCh:     make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+func (s *session) writeFrame(frameType byte, streamId uint32, payload []byte) error {
+	frame := make([]byte, sessionFrameHeaderLen+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], streamId)
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	copy(frame[sessionFrameHeaderLen:], payload)
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_, err := s.duplex.Write(frame)
+	if err != nil {
+		s.closeWithError(err)
+	}
+	return err
+}
+
+// open opens a stream, which is used only by client
+func (s *session) open() (*sessionStream, error) {
+	s.streamsMutex.Lock()
+	select {
+	case <-s.closedCh:
+		s.streamsMutex.Unlock()
+		return nil, SessionClosedError
+	default:
+	}
+	stream := newSessionStream(s, s.nextStreamId)
+	s.nextStreamId++
+	s.streams[stream.id] = stream
+	s.streamsMutex.Unlock()
+	if err := s.writeFrame(sessionFrameSyn, stream.id, nil); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// accept returns a stream opened by the peer, which is used only by server
+func (s *session) accept() (*sessionStream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.closedCh:
+		return nil, SessionClosedError
+	}
+}
+
+func (s *session) numStreams() int {
+	s.streamsMutex.Lock()
+	defer s.streamsMutex.Unlock()
+	return len(s.streams)
+}
+
+func (s *session) isClosed() bool {
+	select {
+	case <-s.closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *session) removeStream(id uint32) {
+	s.streamsMutex.Lock()
+	delete(s.streams, id)
+	s.streamsMutex.Unlock()
+}
+
+func (s *session) readLoop() {
+	header := make([]byte, sessionFrameHeaderLen)
+	for {
+		if _, err := io.ReadFull(s.duplex, header); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		frameType := header[0]
+		streamId := binary.BigEndian.Uint32(header[1:])
+		length := binary.BigEndian.Uint32(header[5:])
+		if length > sessionMaxDataLen {
+			s.closeWithError(errors.Errorf("too large pmux frame: %d bytes", length))
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.duplex, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if err := s.handleFrame(frameType, streamId, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *session) handleFrame(frameType byte, streamId uint32, payload []byte) error {
+	if frameType == sessionFrameSyn {
+		s.streamsMutex.Lock()
+		if _, ok := s.streams[streamId]; ok {
+			s.streamsMutex.Unlock()
+			return errors.Errorf("duplicate pmux stream ID: %d", streamId)
+		}
+		stream := newSessionStream(s, streamId)
+		s.streams[streamId] = stream
+		s.streamsMutex.Unlock()
+		// NOTE: Reading frames of other streams should not wait for accepting
+		go func() {
+			select {
+			case s.acceptCh <- stream:
+			case <-s.closedCh:
+			}
+		}()
+		return nil
+	}
+	s.streamsMutex.Lock()
+	stream, ok := s.streams[streamId]
+	s.streamsMutex.Unlock()
+	// NOTE: Frames of closed streams are ignored
+	if !ok {
+		return nil
+	}
+	switch frameType {
+	case sessionFrameData:
+		return stream.receiveData(payload)
+	case sessionFrameWindowUpdate:
+		if len(payload) != 4 {
+			return errors.Errorf("invalid pmux window update")
+		}
+		stream.increaseSendWindow(binary.BigEndian.Uint32(payload))
+	case sessionFrameFin:
+		stream.receiveFin()
+	case sessionFrameRst:
+		stream.fail(StreamResetError)
+		s.removeStream(streamId)
+	default:
+		return errors.Errorf("unexpected pmux frame type: %d", frameType)
+	}
+	return nil
+}
+
+// closeWithError closes the session and fails all the streams with err
+func (s *session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		close(s.closedCh)
+		s.duplex.Close()
+		s.streamsMutex.Lock()
+		streams := s.streams
+		s.streams = map[uint32]*sessionStream{}
+		s.streamsMutex.Unlock()
+		for _, stream := range streams {
+			stream.fail(err)
+		}
+	})
+}
+
+func (s *session) Close() error {
+	s.closeWithError(SessionClosedError)
+	return nil
+}
+
+type sessionStream struct {
+	id      uint32
+	session *session
+	mutex   *sync.Mutex
+	// NOTE: cond notifies changes of readBuf, sendWindow and states
+	cond       *sync.Cond
+	readBuf    *bytes.Buffer
+	recvWindow uint32
+	// Bytes read but not notified to the peer by window update
+	consumed    uint32
+	sendWindow  uint32
+	finReceived bool
+	finSent     bool
+	closed      bool
+	err         error
+}
+
+func newSessionStream(s *session, id uint32) *sessionStream {
+	mutex := new(sync.Mutex)
+	return &sessionStream{
+		id:         id,
+		session:    s,
+		mutex:      mutex,
+		cond:       sync.NewCond(mutex),
+		readBuf:    new(bytes.Buffer),
+		recvWindow: s.windowSize,
+		sendWindow: s.windowSize,
+	}
+}
+
+func (st *sessionStream) receiveData(payload []byte) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if uint32(len(payload)) > st.recvWindow {
+		return errors.Errorf("pmux stream %d exceeded its window", st.id)
+	}
+	st.recvWindow -= uint32(len(payload))
+	// NOTE: Data after closing is discarded, but the window is still consumed
+	if st.closed || st.err != nil {
+		return nil
+	}
+	st.readBuf.Write(payload)
+	st.cond.Broadcast()
+	return nil
+}
+
+func (st *sessionStream) increaseSendWindow(increment uint32) {
+	st.mutex.Lock()
+	st.sendWindow += increment
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+}
+
+func (st *sessionStream) receiveFin() {
+	st.mutex.Lock()
+	st.finReceived = true
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+}
+
+func (st *sessionStream) fail(err error) {
+	st.mutex.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+}
+
+func (st *sessionStream) Read(p []byte) (int, error) {
+	st.mutex.Lock()
+	for st.readBuf.Len() == 0 && !st.finReceived && st.err == nil && !st.closed {
+		st.cond.Wait()
+	}
+	// NOTE: Received data is read even after the stream fails
+	if st.readBuf.Len() == 0 {
+		defer st.mutex.Unlock()
+		if st.closed {
+			return 0, io.ErrClosedPipe
+		}
+		if st.finReceived {
+			return 0, io.EOF
+		}
+		return 0, st.err
+	}
+	n, _ := st.readBuf.Read(p)
+	st.consumed += uint32(n)
+	var increment uint32
+	if st.consumed >= st.session.windowSize/2 && !st.finReceived {
+		increment = st.consumed
+		st.recvWindow += increment
+		st.consumed = 0
+	}
+	st.mutex.Unlock()
+	if increment != 0 {
+		windowUpdate := make([]byte, 4)
+		binary.BigEndian.PutUint32(windowUpdate, increment)
+		st.session.writeFrame(sessionFrameWindowUpdate, st.id, windowUpdate)
+	}
+	return n, nil
+}
+
+func (st *sessionStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mutex.Lock()
+		for st.sendWindow == 0 && st.err == nil && !st.finSent && !st.closed {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			err := st.err
+			st.mutex.Unlock()
+			return written, err
+		}
+		if st.finSent || st.closed {
+			st.mutex.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := len(p) - written
+		if n > sessionMaxDataLen {
+			n = sessionMaxDataLen
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mutex.Unlock()
+		if err := st.session.writeFrame(sessionFrameData, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite sends fin to notify the peer of the end of writing
+func (st *sessionStream) CloseWrite() error {
+	st.mutex.Lock()
+	if st.finSent || st.closed || st.err != nil {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+	return st.session.writeFrame(sessionFrameFin, st.id, nil)
+}
+
+// Close sends fin if not sent, and resets the stream if the peer is still writing
+func (st *sessionStream) Close() error {
+	st.mutex.Lock()
+	if st.closed {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendsFin := !st.finSent && st.err == nil
+	sendsRst := !st.finReceived && st.err == nil
+	st.finSent = true
+	st.cond.Broadcast()
+	st.mutex.Unlock()
+	st.session.removeStream(st.id)
+	var err error
+	if sendsFin {
+		err = st.session.writeFrame(sessionFrameFin, st.id, nil)
+	}
+	if sendsRst {
+		err = st.session.writeFrame(sessionFrameRst, st.id, nil)
+	}
+	return err
+}
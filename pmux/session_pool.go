@@ -0,0 +1,95 @@
+package pmux
+
+import (
+	"io"
+	"sync"
+)
+
+// sessionPool opens streams on the least loaded session, connecting sessions up to size in the background
+type sessionPool struct {
+	size     int
+	connect  func() (*session, error)
+	mutex    *sync.Mutex
+	cond     *sync.Cond
+	sessions []*session
+	// Number of sessions being connected
+	connecting int
+	// NOTE: failures counts failed connections to return the error to waiting open()
+	failures uint64
+	lastErr  error
+}
+
+func newSessionPool(size int, connect func() (*session, error)) *sessionPool {
+	mutex := new(sync.Mutex)
+	return &sessionPool{
+		size:    size,
+		connect: connect,
+		mutex:   mutex,
+		cond:    sync.NewCond(mutex),
+	}
+}
+
+func (p *sessionPool) open() (io.ReadWriteCloser, error) {
+	p.mutex.Lock()
+	failures := p.failures
+	for {
+		p.removeClosedSessions()
+		if len(p.sessions)+p.connecting < p.size {
+			p.connecting++
+			go p.connectSession()
+		}
+		if len(p.sessions) != 0 {
+			s := p.leastLoadedSession()
+			p.mutex.Unlock()
+			stream, err := s.open()
+			if err == nil {
+				return stream, nil
+			}
+			// NOTE: The closed session is removed in the next loop
+			p.mutex.Lock()
+			continue
+		}
+		if p.failures != failures {
+			err := p.lastErr
+			p.mutex.Unlock()
+			return nil, err
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *sessionPool) connectSession() {
+	s, err := p.connect()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.connecting--
+	if err != nil {
+		p.failures++
+		p.lastErr = err
+	} else {
+		p.sessions = append(p.sessions, s)
+	}
+	p.cond.Broadcast()
+}
+
+func (p *sessionPool) removeClosedSessions() {
+	sessions := p.sessions[:0]
+	for _, s := range p.sessions {
+		if !s.isClosed() {
+			sessions = append(sessions, s)
+		}
+	}
+	p.sessions = sessions
+}
+
+func (p *sessionPool) leastLoadedSession() *session {
+	leastLoaded := p.sessions[0]
+	leastNumStreams := leastLoaded.numStreams()
+	for _, s := range p.sessions[1:] {
+		if n := s.numStreams(); n < leastNumStreams {
+			leastLoaded = s
+			leastNumStreams = n
+		}
+	}
+	return leastLoaded
+}
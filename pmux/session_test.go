@@ -0,0 +1,175 @@
+package pmux
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T) (*session, *session) {
+	clientConn, serverConn := net.Pipe()
+	clientSession := newSession(clientConn, sessionInitialWindowSize)
+	serverSession := newSession(serverConn, sessionInitialWindowSize)
+	t.Cleanup(func() {
+		clientSession.Close()
+		serverSession.Close()
+	})
+	return clientSession, serverSession
+}
+
+func openAndAccept(t *testing.T, clientSession *session, serverSession *session) (*sessionStream, *sessionStream) {
+	clientStream, err := clientSession.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverStream, err := serverSession.accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientStream, serverStream
+}
+
+func TestSessionStreams(t *testing.T) {
+	clientSession, serverSession := newSessionPair(t)
+	go func() {
+		for {
+			stream, err := serverSession.accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(stream, stream)
+				stream.CloseWrite()
+			}()
+		}
+	}()
+	errCh := make(chan error)
+	for i := 0; i < 10; i++ {
+		content := bytes.Repeat([]byte{byte(i)}, 100000)
+		go func() {
+			stream, err := clientSession.open()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer stream.Close()
+			go func() {
+				stream.Write(content)
+				stream.CloseWrite()
+			}()
+			body, err := io.ReadAll(stream)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if !bytes.Equal(body, content) {
+				errCh <- errors.Errorf("unexpected body of %d bytes", len(body))
+				return
+			}
+			errCh <- nil
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSessionFlowControl(t *testing.T) {
+	clientSession, serverSession := newSessionPair(t)
+	clientStream, serverStream := openAndAccept(t, clientSession, serverSession)
+	content := bytes.Repeat([]byte("0123456789"), int(sessionInitialWindowSize)/10*3)
+	writtenCh := make(chan int)
+	go func() {
+		n, _ := clientStream.Write(content)
+		writtenCh <- n
+	}()
+	// The writer should be blocked by the window while the peer does not read
+	select {
+	case n := <-writtenCh:
+		t.Fatalf("written %d bytes over the window", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// A slow stream does not block the other streams
+	otherClientStream, otherServerStream := openAndAccept(t, clientSession, serverSession)
+	go otherClientStream.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(otherServerStream, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected body: %q", buf)
+	}
+	body := make([]byte, len(content))
+	if _, err := io.ReadFull(serverStream, body); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatal("unexpected body")
+	}
+	if n := <-writtenCh; n != len(content) {
+		t.Fatalf("unexpected written bytes: %d", n)
+	}
+}
+
+func TestSessionHalfClose(t *testing.T) {
+	clientSession, serverSession := newSessionPair(t)
+	clientStream, serverStream := openAndAccept(t, clientSession, serverSession)
+	go func() {
+		clientStream.Write([]byte("hello"))
+		clientStream.CloseWrite()
+	}()
+	body, err := io.ReadAll(serverStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	// The other direction is still writable
+	go func() {
+		serverStream.Write([]byte("world"))
+		serverStream.Close()
+	}()
+	body, err = io.ReadAll(clientStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "world" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+}
+
+func TestSessionReset(t *testing.T) {
+	clientSession, serverSession := newSessionPair(t)
+	clientStream, serverStream := openAndAccept(t, clientSession, serverSession)
+	serverStream.Close()
+	// The writer blocked by the window should get the reset
+	_, err := clientStream.Write(make([]byte, sessionInitialWindowSize*2))
+	if !errors.Is(err, StreamResetError) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The session is still available
+	clientStream, serverStream = openAndAccept(t, clientSession, serverSession)
+	go clientStream.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(serverStream, buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	clientSession, serverSession := newSessionPair(t)
+	clientStream, _ := openAndAccept(t, clientSession, serverSession)
+	serverSession.Close()
+	if _, err := clientStream.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read should fail after the session is closed")
+	}
+	if _, err := clientSession.open(); err != SessionClosedError {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package pubkey_duplex
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/nwtgck/go-piping-tunnel/aead_duplex"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+)
+
+// Public-key authenticated handshake in SIGMA-I style:
+//   1. Both sides exchange ephemeral X25519 public keys
+//   2. Both sides send their SSH public keys and signatures over the ephemeral keys, encrypted with handshake keys
+//   3. Session keys are derived from the ephemeral shared secret and both identities
+// NOTE: Both sides play the same role, so the handshake is symmetric
+
+const keyLen = 32
+const maxIdentityLen = 64 * 1024
+
+var UnauthorizedPeerError = errors.New("not authorized")
+var SameEphemeralKeyError = errors.New("peer sent the same ephemeral key: the stream may have been reflected")
+var TooLongIdentityError = errors.New("too long identity message")
+
+type Config struct {
+	Signer         ssh.Signer
+	AuthorizedKeys []ssh.PublicKey
+	// NOTE: called after authentication, can be nil
+	OnPeerAuthenticated func(peerKey ssh.PublicKey)
+}
+
+// ReadIdentity reads an OpenSSH private key file
+func ReadIdentity(path string) (ssh.Signer, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		passphrase, err := util.InputPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		return ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
+	}
+	return signer, err
+}
+
+// ReadAuthorizedKeys reads public keys in the format of authorized_keys such as ~/.ssh/id_ed25519.pub
+func ReadAuthorizedKeys(path string) ([]ssh.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		// Skip empty lines and comments
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid public key in %s", path)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (c *Config) isAuthorized(key ssh.PublicKey) bool {
+	marshaled := key.Marshal()
+	for _, authorizedKey := range c.AuthorizedKeys {
+		if bytes.Equal(authorizedKey.Marshal(), marshaled) {
+			return true
+		}
+	}
+	return false
+}
+
+// Duplex runs the handshake with the peer and makes an AEAD duplex with forward-secret session keys
+func Duplex(baseWriter io.WriteCloser, baseReader io.ReadCloser, config *Config) (io.ReadWriteCloser, error) {
+	ephemeralPrivate, err := util.GenerateRandomBytes(curve25519.ScalarSize)
+	if err != nil {
+		return nil, err
+	}
+	ownEphemeral, err := curve25519.X25519(ephemeralPrivate, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	// Send the ephemeral public key
+	if _, err := baseWriter.Write(ownEphemeral); err != nil {
+		return nil, err
+	}
+	// Read the ephemeral public key of the peer
+	peerEphemeral := make([]byte, curve25519.PointSize)
+	if _, err := io.ReadFull(baseReader, peerEphemeral); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(ownEphemeral, peerEphemeral) {
+		return nil, SameEphemeralKeyError
+	}
+	// NOTE: X25519 returns an error for a low-order point
+	shared, err := curve25519.X25519(ephemeralPrivate, peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	c := aead_duplex.Chacha20Poly1305
+
+	// Send the identity encrypted with the handshake key
+	ownPublicKey := config.Signer.PublicKey().Marshal()
+	sig, err := config.Signer.Sign(rand.Reader, signedData(ownEphemeral, peerEphemeral))
+	if err != nil {
+		return nil, err
+	}
+	identity := appendWithLength(appendWithLength(nil, ownPublicKey), ssh.Marshal(sig))
+	sendHandshakeKey, err := deriveKey(shared, "handshake", ownEphemeral, peerEphemeral, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := c.NewAead(sendHandshakeKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := sealer.Seal(nil, make([]byte, sealer.NonceSize()), identity, nil)
+	if _, err := baseWriter.Write(appendWithLength(nil, sealed)); err != nil {
+		return nil, err
+	}
+
+	// Read and verify the identity of the peer
+	peerSealed, err := readWithLength(baseReader)
+	if err != nil {
+		return nil, err
+	}
+	receiveHandshakeKey, err := deriveKey(shared, "handshake", peerEphemeral, ownEphemeral, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := c.NewAead(receiveHandshakeKey)
+	if err != nil {
+		return nil, err
+	}
+	peerIdentity, err := opener.Open(nil, make([]byte, opener.NonceSize()), peerSealed, nil)
+	if err != nil {
+		return nil, aead_duplex.AuthenticationFailedError
+	}
+	identityReader := bytes.NewReader(peerIdentity)
+	peerPublicKeyBytes, err := readWithLength(identityReader)
+	if err != nil {
+		return nil, err
+	}
+	peerSigBytes, err := readWithLength(identityReader)
+	if err != nil {
+		return nil, err
+	}
+	peerPublicKey, err := ssh.ParsePublicKey(peerPublicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !config.isAuthorized(peerPublicKey) {
+		return nil, errors.Wrapf(UnauthorizedPeerError, "peer public key %s", ssh.FingerprintSHA256(peerPublicKey))
+	}
+	var peerSig ssh.Signature
+	if err := ssh.Unmarshal(peerSigBytes, &peerSig); err != nil {
+		return nil, err
+	}
+	if err := peerPublicKey.Verify(signedData(peerEphemeral, ownEphemeral), &peerSig); err != nil {
+		return nil, errors.Wrap(err, "invalid signature of peer")
+	}
+	if config.OnPeerAuthenticated != nil {
+		config.OnPeerAuthenticated(peerPublicKey)
+	}
+
+	sendKey, err := deriveKey(shared, "session", ownEphemeral, peerEphemeral, ownPublicKey, peerPublicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	receiveKey, err := deriveKey(shared, "session", peerEphemeral, ownEphemeral, peerPublicKeyBytes, ownPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead_duplex.DuplexWithKeys(baseWriter, baseReader, sendKey, receiveKey, c)
+}
+
+func signedData(signerEphemeral []byte, verifierEphemeral []byte) []byte {
+	data := append([]byte("piping-tunnel pubkey sign "), signerEphemeral...)
+	return append(data, verifierEphemeral...)
+}
+
+func deriveKey(shared []byte, label string, senderEphemeral []byte, receiverEphemeral []byte, senderPublicKey []byte, receiverPublicKey []byte) ([]byte, error) {
+	info := []byte("piping-tunnel pubkey " + label)
+	for _, item := range [][]byte{senderEphemeral, receiverEphemeral, senderPublicKey, receiverPublicKey} {
+		info = appendWithLength(info, item)
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func appendWithLength(buf []byte, item []byte) []byte {
+	var lengthBytes [4]byte
+	binary.BigEndian.PutUint32(lengthBytes[:], uint32(len(item)))
+	return append(append(buf, lengthBytes[:]...), item...)
+}
+
+func readWithLength(r io.Reader) ([]byte, error) {
+	var lengthBytes [4]byte
+	if _, err := io.ReadFull(r, lengthBytes[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBytes[:])
+	if length > maxIdentityLen {
+		return nil, TooLongIdentityError
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
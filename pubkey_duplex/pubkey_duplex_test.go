@@ -0,0 +1,119 @@
+package pubkey_duplex
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"testing"
+)
+
+func generateSigner(t *testing.T) ssh.Signer {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+type result struct {
+	duplex io.ReadWriteCloser
+	err    error
+}
+
+func handshake(t *testing.T, config1 *Config, config2 *Config) (result, result) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		for _, f := range []*os.File{r1, w1, r2, w2} {
+			f.Close()
+		}
+	})
+	ch := make(chan result)
+	go func() {
+		d, err := Duplex(w2, r1, config2)
+		ch <- result{d, err}
+	}()
+	d, err := Duplex(w1, r2, config1)
+	return result{d, err}, <-ch
+}
+
+func TestDuplex(t *testing.T) {
+	signer1 := generateSigner(t)
+	signer2 := generateSigner(t)
+	var authenticatedKey ssh.PublicKey
+	res1, res2 := handshake(
+		t,
+		&Config{Signer: signer1, AuthorizedKeys: []ssh.PublicKey{signer2.PublicKey()}, OnPeerAuthenticated: func(peerKey ssh.PublicKey) {
+			authenticatedKey = peerKey
+		}},
+		&Config{Signer: signer2, AuthorizedKeys: []ssh.PublicKey{signer1.PublicKey()}},
+	)
+	if res1.err != nil {
+		t.Fatal(res1.err)
+	}
+	if res2.err != nil {
+		t.Fatal(res2.err)
+	}
+	if ssh.FingerprintSHA256(authenticatedKey) != ssh.FingerprintSHA256(signer2.PublicKey()) {
+		t.Fatalf("unexpected peer key: %s", ssh.FingerprintSHA256(authenticatedKey))
+	}
+	go func() {
+		res1.duplex.Write([]byte("hello"))
+		res1.duplex.Close()
+	}()
+	body, err := io.ReadAll(res2.duplex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestUnauthorizedPeer(t *testing.T) {
+	signer1 := generateSigner(t)
+	signer2 := generateSigner(t)
+	res1, res2 := handshake(
+		t,
+		&Config{Signer: signer1, AuthorizedKeys: []ssh.PublicKey{generateSigner(t).PublicKey()}},
+		&Config{Signer: signer2, AuthorizedKeys: []ssh.PublicKey{signer1.PublicKey()}},
+	)
+	if errors.Cause(res1.err) != UnauthorizedPeerError {
+		t.Fatalf("expected unauthorized error but found: %v", res1.err)
+	}
+	if res2.err != nil {
+		t.Fatal(res2.err)
+	}
+}
+
+func TestReadAuthorizedKeys(t *testing.T) {
+	signer1 := generateSigner(t)
+	signer2 := generateSigner(t)
+	path := t.TempDir() + "/authorized_keys"
+	content := append(ssh.MarshalAuthorizedKey(signer1.PublicKey()), []byte("\n# comment\n\n")...)
+	content = append(content, ssh.MarshalAuthorizedKey(signer2.PublicKey())...)
+	content = append(content, []byte("# trailing comment\n")...)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ReadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("unexpected number of keys: %d", len(keys))
+	}
+}
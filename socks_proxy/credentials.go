@@ -0,0 +1,55 @@
+package socks_proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// NOTE: SOCKS4 has no password authentication
+const socks4Version byte = 4
+
+// Credentials is for username/password authentication of RFC 1929
+type Credentials map[string]string
+
+func (c Credentials) Valid(user string, password string) bool {
+	expected, ok := c[user]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+// ParseCredentials parses credentials in the form of "<USER>:<PASSWORD>" (nil for no authentication)
+func ParseCredentials(userStrs []string) (Credentials, error) {
+	if len(userStrs) == 0 {
+		return nil, nil
+	}
+	credentials := Credentials{}
+	for _, str := range userStrs {
+		splitted := strings.SplitN(str, ":", 2)
+		// NOTE: RFC 1929 limits the lengths to 255 bytes
+		if len(splitted) != 2 || splitted[0] == "" || len(splitted[0]) > 255 || splitted[1] == "" || len(splitted[1]) > 255 {
+			return nil, errors.Errorf("invalid format: e.g. alice:mypassword")
+		}
+		credentials[splitted[0]] = splitted[1]
+	}
+	return credentials, nil
+}
+
+// ReadUserFile reads lines of "<USER>:<PASSWORD>", where lines starting with "#" are comments
+func ReadUserFile(r io.Reader) ([]string, error) {
+	var userStrs []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// NOTE: A password may contain spaces and "#", so the line is not trimmed
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		userStrs = append(userStrs, line)
+	}
+	return userStrs, scanner.Err()
+}
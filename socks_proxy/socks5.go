@@ -0,0 +1,140 @@
+package socks_proxy
+
+import (
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"github.com/nwtgck/go-socks"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const socks5Version byte = 5
+
+// (base: https://datatracker.ietf.org/doc/html/rfc1928#section-6)
+const (
+	socks5SucceededReply           byte = 0
+	socks5ServerFailureReply       byte = 1
+	socks5RuleFailureReply         byte = 2
+	socks5NetworkUnreachableReply  byte = 3
+	socks5HostUnreachableReply     byte = 4
+	socks5ConnectionRefusedReply   byte = 5
+	socks5CommandNotSupportedReply byte = 7
+)
+
+const socks5NoAcceptableMethod byte = 0xff
+
+// serveSocks5 serves SOCKS5 after the version byte, where go-socks authenticates the client
+func (s *Server) serveSocks5(conn net.Conn) error {
+	if err := s.authenticate(conn); err != nil {
+		return err
+	}
+	req, err := socks.NewRequest(conn)
+	if err != nil {
+		return err
+	}
+	switch req.Command {
+	case socks.ConnectCommand:
+		return s.handleConnect(conn, req)
+	case udpAssociateCommand:
+		return s.handleUdpAssociate(conn)
+	case socks.AssociateCommand:
+		writeReply(conn, socks5CommandNotSupportedReply, nil)
+		return errors.Errorf("UDP ASSOCIATE needs --socks-udp in client host")
+	}
+	writeReply(conn, socks5CommandNotSupportedReply, nil)
+	return errors.Errorf("unsupported SOCKS command: %d", req.Command)
+}
+
+func (s *Server) authenticate(conn net.Conn) error {
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	var authenticator socks.Authenticator = socks.NoAuthAuthenticator{}
+	if s.config.Credentials != nil {
+		authenticator = socks.UserPassAuthenticator{Credentials: s.config.Credentials}
+	}
+	for _, method := range methods {
+		if method == authenticator.GetCode() {
+			_, err := authenticator.Authenticate(conn, conn)
+			return err
+		}
+	}
+	conn.Write([]byte{socks5Version, socks5NoAcceptableMethod})
+	return socks.NoSupportedAuth
+}
+
+// writeReply writes a reply of SOCKS5, where addr may be nil
+func writeReply(w io.Writer, reply byte, addr net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	b := []byte{socks5Version, reply, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, 1), ip4...)
+	} else {
+		b = append(append(b, 4), ip.To16()...)
+	}
+	_, err := w.Write(append(b, byte(port>>8), byte(port)))
+	return err
+}
+
+func (s *Server) handleConnect(conn net.Conn, req *socks.Request) error {
+	dest := req.DestAddr
+	ip := dest.IP
+	if dest.FQDN != "" {
+		addr, err := net.ResolveIPAddr("ip", dest.FQDN)
+		if err != nil {
+			writeReply(conn, socks5HostUnreachableReply, nil)
+			return err
+		}
+		ip = addr.IP
+	}
+	// NOTE: The checked IP is dialed
+	if !s.config.Rules.Permits(dest.FQDN, ip, dest.Port) {
+		writeReply(conn, socks5RuleFailureReply, nil)
+		return errors.Errorf("connect to %s blocked by rules", dest)
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(dest.Port)))
+	if err != nil {
+		reply := socks5HostUnreachableReply
+		if strings.Contains(err.Error(), "refused") {
+			reply = socks5ConnectionRefusedReply
+		} else if strings.Contains(err.Error(), "network is unreachable") {
+			reply = socks5NetworkUnreachableReply
+		}
+		writeReply(conn, reply, nil)
+		return err
+	}
+	defer target.Close()
+	if err := writeReply(conn, socks5SucceededReply, target.LocalAddr()); err != nil {
+		return err
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(target, conn)
+		util.CloseWriteOrClose(target)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, target)
+		util.CloseWriteOrClose(conn)
+		errCh <- err
+	}()
+	err1 := <-errCh
+	err2 := <-errCh
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
@@ -0,0 +1,100 @@
+package socks_proxy
+
+import (
+	"bytes"
+	"context"
+	"github.com/nwtgck/go-piping-tunnel/allowlist"
+	"github.com/nwtgck/go-socks"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// UdpStreamMagic starts the stream carrying UDP datagrams of SOCKS, followed by the token of the UDP association
+// NOTE: The first byte is neither SOCKS4 nor SOCKS5 version
+const UdpStreamMagic = "PTUDP"
+
+type Config struct {
+	// Credentials requires username/password authentication (nil for no authentication)
+	Credentials Credentials
+	// Rules limits destinations (nil permits all)
+	Rules *allowlist.Rules
+	// UdpIdleTimeout is the idle time to forget a UDP flow of UDP ASSOCIATE (0 for no timeout)
+	UdpIdleTimeout time.Duration
+}
+
+type Server struct {
+	config *Config
+	mutex  *sync.Mutex
+	// Active UDP associations by their tokens, which are only given to authenticated clients
+	udpAssociations map[string]*udpAssociation
+}
+
+// New creates a SOCKS server serving streams from client host
+func New(config *Config) *Server {
+	return &Server{
+		config:          config,
+		mutex:           new(sync.Mutex),
+		udpAssociations: map[string]*udpAssociation{},
+	}
+}
+
+// ServeConn serves SOCKS or UDP datagrams of SOCKS from client host with --socks-udp
+func (s *Server) ServeConn(conn net.Conn) error {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		conn.Close()
+		return err
+	}
+	switch first[0] {
+	case socks5Version:
+		defer conn.Close()
+		return s.serveSocks5(conn)
+	case socks4Version:
+		if s.config.Credentials != nil {
+			conn.Close()
+			return errors.Errorf("SOCKS4 without authentication is denied")
+		}
+		return s.serveSocks4(&readerConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(first), conn)})
+	case UdpStreamMagic[0]:
+		return s.serveUdpStream(conn)
+	}
+	conn.Close()
+	return errors.Errorf("unsupported SOCKS version: %d", first[0])
+}
+
+// readerConn reads the bytes which have already been read before the rest of the connection
+type readerConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (s *Server) serveSocks4(conn net.Conn) error {
+	socksServer, err := socks.New(&socks.Config{Rules: &destinationRuleSet{rules: s.config.Rules}})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return socksServer.ServeConn(conn)
+}
+
+// destinationRuleSet applies Config.Rules to requests of go-socks
+type destinationRuleSet struct {
+	rules *allowlist.Rules
+}
+
+// NOTE: go-socks resolves FQDN before Allow(), and the checked IP is dialed
+func (r *destinationRuleSet) Allow(ctx context.Context, req *socks.Request) (context.Context, bool) {
+	dest := req.DestAddr
+	return ctx, r.rules.Permits(dest.FQDN, dest.IP, dest.Port)
+}
+
+func (s *Server) permitsUdp(addr *net.UDPAddr) bool {
+	return s.config.Rules.Permits("", addr.IP, addr.Port)
+}
@@ -0,0 +1,257 @@
+package socks_proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/nwtgck/go-piping-tunnel/udp_tunnel"
+	"github.com/nwtgck/go-socks"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"time"
+)
+
+// udpAssociateCommand is UDP ASSOCIATE relayed by client host, which replaces the command of the request.
+// Its reply has the token of the association in hex as BND.ADDR, and client host replies to the client with its own UDP socket.
+const udpAssociateCommand byte = 0x83
+
+const udpAssociationTokenLen = 16
+
+type udpAssociation struct {
+	// NOTE: closed when the TCP connection of the association ends
+	done chan struct{}
+}
+
+// handleUdpAssociate keeps the association until the client closes the connection (RFC 1928)
+// NOTE: Destinations of UDP ASSOCIATE are checked for each datagram
+func (s *Server) handleUdpAssociate(conn net.Conn) error {
+	token := make([]byte, udpAssociationTokenLen)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		writeReply(conn, socks5ServerFailureReply, nil)
+		return err
+	}
+	tokenHex := hex.EncodeToString(token)
+	association := &udpAssociation{done: make(chan struct{})}
+	s.mutex.Lock()
+	s.udpAssociations[tokenHex] = association
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.udpAssociations, tokenHex)
+		s.mutex.Unlock()
+		close(association.done)
+	}()
+	reply := append([]byte{socks5Version, socks5SucceededReply, 0, 3, byte(len(tokenHex))}, tokenHex...)
+	if _, err := conn.Write(append(reply, 0, 0)); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, conn)
+	return err
+}
+
+// takeUdpAssociation returns the association of the token only once (nil when not found)
+func (s *Server) takeUdpAssociation(tokenHex string) *udpAssociation {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	association, ok := s.udpAssociations[tokenHex]
+	if !ok {
+		return nil
+	}
+	delete(s.udpAssociations, tokenHex)
+	return association
+}
+
+// serveUdpStream relays datagrams of the association until its TCP connection ends
+func (s *Server) serveUdpStream(stream io.ReadWriteCloser) error {
+	defer stream.Close()
+	// NOTE: The first byte has already been read
+	header := make([]byte, len(UdpStreamMagic)-1+udpAssociationTokenLen)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return err
+	}
+	if string(header[:len(UdpStreamMagic)-1]) != UdpStreamMagic[1:] {
+		return errors.Errorf("invalid SOCKS UDP stream")
+	}
+	association := s.takeUdpAssociation(hex.EncodeToString(header[len(UdpStreamMagic)-1:]))
+	if association == nil {
+		return errors.Errorf("unknown SOCKS UDP association")
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-association.done:
+			stream.Close()
+		case <-finished:
+		}
+	}()
+	return udp_tunnel.SocksServer(stream, s.permitsUdp, s.config.UdpIdleTimeout)
+}
+
+// clientUdpAssociation is UDP ASSOCIATE relayed by client host
+type clientUdpAssociation struct {
+	pc     net.PacketConn
+	stream io.ReadWriteCloser
+}
+
+func (a *clientUdpAssociation) Close() error {
+	a.pc.Close()
+	return a.stream.Close()
+}
+
+// associatedPacketConn drops datagrams which are not from the client of the association
+type associatedPacketConn struct {
+	net.PacketConn
+	ip net.IP
+	// NOTE: 0 until the first datagram when the client does not tell its port
+	port int
+}
+
+func (c *associatedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || !udpAddr.IP.Equal(c.ip) || (c.port != 0 && udpAddr.Port != c.port) {
+			continue
+		}
+		c.port = udpAddr.Port
+		return n, addr, nil
+	}
+}
+
+// RelayHandshake relays the SOCKS5 handshake from conn of a client to stream to the socks command.
+// When the request is UDP ASSOCIATE, it listens on a UDP port of the address which the client connected to,
+// and relays datagrams from the client over a stream opened by open until the returned io.Closer is closed (nil otherwise).
+// The rest of conn and stream should be relayed after it returns.
+func RelayHandshake(conn net.Conn, stream io.ReadWriter, open func() (io.ReadWriteCloser, error), udpIdleTimeout time.Duration) (io.Closer, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		_, err := stream.Write(header[:1])
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, header[1:]); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	if _, err := stream.Write(append(header, methods...)); err != nil {
+		return nil, err
+	}
+	methodReply := make([]byte, 2)
+	if _, err := io.ReadFull(stream, methodReply); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(methodReply); err != nil {
+		return nil, err
+	}
+	switch methodReply[1] {
+	case socks.NoAuth:
+	case socks.UserPassAuth:
+		if ok, err := relayUserPassAuth(conn, stream); !ok || err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	var requestBuf bytes.Buffer
+	req, err := socks.NewRequest(io.TeeReader(conn, &requestBuf))
+	request := requestBuf.Bytes()
+	localAddr, localOk := conn.LocalAddr().(*net.TCPAddr)
+	remoteAddr, remoteOk := conn.RemoteAddr().(*net.TCPAddr)
+	if err != nil || req.Command != socks.AssociateCommand || !localOk || !remoteOk {
+		_, err := stream.Write(request)
+		return nil, err
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		writeReply(conn, socks5ServerFailureReply, nil)
+		return nil, err
+	}
+	association, err := relayUdpAssociate(conn, stream, open, request, &net.UDPAddr{IP: remoteAddr.IP, Port: req.DestAddr.Port}, pc)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	if association == nil {
+		pc.Close()
+		return nil, nil
+	}
+	go udp_tunnel.Client(association.pc, association.stream, udpIdleTimeout)
+	return association, nil
+}
+
+// relayUserPassAuth relays username/password authentication of RFC 1929 and returns true when succeeded
+func relayUserPassAuth(conn net.Conn, stream io.ReadWriter) (bool, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return false, err
+	}
+	user := make([]byte, header[1]+1)
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return false, err
+	}
+	password := make([]byte, user[len(user)-1])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return false, err
+	}
+	if _, err := stream.Write(append(append(header, user...), password...)); err != nil {
+		return false, err
+	}
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(stream, status); err != nil {
+		return false, err
+	}
+	if _, err := conn.Write(status); err != nil {
+		return false, err
+	}
+	return status[1] == 0, nil
+}
+
+// relayUdpAssociate requests the association and replies to the client with pc (nil when not succeeded)
+// NOTE: The port of clientAddr is 0 when the client does not know the port to send datagrams from
+func relayUdpAssociate(conn net.Conn, stream io.ReadWriter, open func() (io.ReadWriteCloser, error), request []byte, clientAddr *net.UDPAddr, pc net.PacketConn) (*clientUdpAssociation, error) {
+	request[1] = udpAssociateCommand
+	if _, err := stream.Write(request); err != nil {
+		return nil, err
+	}
+	// NOTE: A reply has the same layout as a request
+	reply, err := socks.NewRequest(stream)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Command != socks5SucceededReply {
+		return nil, writeReply(conn, reply.Command, nil)
+	}
+	token, err := hex.DecodeString(reply.DestAddr.FQDN)
+	if err != nil || len(token) != udpAssociationTokenLen {
+		writeReply(conn, socks5ServerFailureReply, nil)
+		return nil, errors.Errorf("invalid token of SOCKS UDP association")
+	}
+	udpStream, err := open()
+	if err != nil {
+		writeReply(conn, socks5ServerFailureReply, nil)
+		return nil, err
+	}
+	if _, err := udpStream.Write(append([]byte(UdpStreamMagic), token...)); err != nil {
+		udpStream.Close()
+		writeReply(conn, socks5ServerFailureReply, nil)
+		return nil, err
+	}
+	if err := writeReply(conn, socks5SucceededReply, pc.LocalAddr()); err != nil {
+		udpStream.Close()
+		return nil, err
+	}
+	return &clientUdpAssociation{
+		pc:     &associatedPacketConn{PacketConn: pc, ip: clientAddr.IP, port: clientAddr.Port},
+		stream: udpStream,
+	}, nil
+}
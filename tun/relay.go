@@ -0,0 +1,134 @@
+package tun
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"sync"
+)
+
+// NOTE: A packet is sent in a frame of its length (2 bytes) and the packet
+const maxPacketLen = 65535
+
+// The number of packets from the device held while no stream is connected
+const packetQueueLen = 64
+
+func WritePacket(w io.Writer, packet []byte) error {
+	if len(packet) > maxPacketLen {
+		return errors.Errorf("too large packet: %d bytes", len(packet))
+	}
+	frame := make([]byte, 2+len(packet))
+	binary.BigEndian.PutUint16(frame, uint16(len(packet)))
+	copy(frame[2:], packet)
+	_, err := w.Write(frame)
+	return err
+}
+
+func ReadPacket(r io.Reader, buf []byte) (int, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	length := int(binary.BigEndian.Uint16(header))
+	if length > len(buf) {
+		return 0, errors.Errorf("too large packet: %d bytes", length)
+	}
+	return io.ReadFull(r, buf[:length])
+}
+
+// Relay relays packets between a device such as TUN and the current stream
+type Relay struct {
+	device   io.ReadWriter
+	mtu      int
+	packetCh chan []byte
+	// NOTE: device read error
+	errCh  chan error
+	mutex  *sync.Mutex
+	stream io.Closer
+}
+
+// NewRelay starts reading packets from device, where a read should return one packet
+// Packets larger than mtu are dropped.
+func NewRelay(device io.ReadWriter, mtu int) *Relay {
+	r := &Relay{
+		device:   device,
+		mtu:      mtu,
+		packetCh: make(chan []byte, packetQueueLen),
+		errCh:    make(chan error, 1),
+		mutex:    new(sync.Mutex),
+	}
+	go r.readDevice()
+	return r
+}
+
+func (r *Relay) readDevice() {
+	buf := make([]byte, maxPacketLen)
+	for {
+		n, err := r.device.Read(buf)
+		if err != nil {
+			r.errCh <- err
+			return
+		}
+		if n > r.mtu {
+			continue
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		select {
+		case r.packetCh <- packet:
+		default:
+			// NOTE: Drop the packet like a congested link
+		}
+	}
+}
+
+// Serve relays packets over stream until the stream or the device fails
+// NOTE: The previous stream is closed because packets should go through one stream
+func (r *Relay) Serve(stream io.ReadWriteCloser) error {
+	r.mutex.Lock()
+	if r.stream != nil {
+		r.stream.Close()
+	}
+	r.stream = stream
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		if r.stream == stream {
+			r.stream = nil
+		}
+		r.mutex.Unlock()
+		stream.Close()
+	}()
+	streamErrCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, maxPacketLen)
+		for {
+			n, err := ReadPacket(stream, buf)
+			if err != nil {
+				streamErrCh <- err
+				return
+			}
+			if n > r.mtu {
+				continue
+			}
+			if _, err := r.device.Write(buf[:n]); err != nil {
+				streamErrCh <- err
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case packet := <-r.packetCh:
+			if err := WritePacket(stream, packet); err != nil {
+				return err
+			}
+		case err := <-streamErrCh:
+			return err
+		case err := <-r.errCh:
+			// NOTE: Keep the error for other Serve()
+			r.errCh <- err
+			return err
+		}
+	}
+}
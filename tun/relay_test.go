@@ -0,0 +1,102 @@
+package tun
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// packetDevice is a device where a read or a write is one packet like TUN
+type packetDevice struct {
+	inCh  chan []byte
+	outCh chan []byte
+}
+
+func newPacketDevice() *packetDevice {
+	return &packetDevice{inCh: make(chan []byte, 16), outCh: make(chan []byte, 16)}
+}
+
+func (d *packetDevice) Read(p []byte) (int, error) {
+	packet, ok := <-d.inCh
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, packet), nil
+}
+
+func (d *packetDevice) Write(p []byte) (int, error) {
+	packet := make([]byte, len(p))
+	copy(packet, p)
+	d.outCh <- packet
+	return len(p), nil
+}
+
+func receivePacket(t *testing.T, d *packetDevice) []byte {
+	select {
+	case packet := <-d.outCh:
+		return packet
+	case <-time.After(5 * time.Second):
+		t.Fatal("packet not received")
+		return nil
+	}
+}
+
+func TestRelay(t *testing.T) {
+	device1 := newPacketDevice()
+	device2 := newPacketDevice()
+	relay1 := NewRelay(device1, 1400)
+	relay2 := NewRelay(device2, 1400)
+	stream1, stream2 := net.Pipe()
+	go relay1.Serve(stream1)
+	go relay2.Serve(stream2)
+
+	device1.inCh <- []byte("packet1")
+	device1.inCh <- bytes.Repeat([]byte{1}, 1401)
+	device1.inCh <- bytes.Repeat([]byte{2}, 1400)
+	if packet := receivePacket(t, device2); string(packet) != "packet1" {
+		t.Fatalf("unexpected packet: %s", packet)
+	}
+	// The packet larger than MTU is dropped
+	if packet := receivePacket(t, device2); !bytes.Equal(packet, bytes.Repeat([]byte{2}, 1400)) {
+		t.Fatalf("unexpected packet of %d bytes", len(packet))
+	}
+	device2.inCh <- []byte("packet2")
+	if packet := receivePacket(t, device1); string(packet) != "packet2" {
+		t.Fatalf("unexpected packet: %s", packet)
+	}
+}
+
+func TestRelayReplacesStream(t *testing.T) {
+	device := newPacketDevice()
+	relay := NewRelay(device, 1400)
+	buf := make([]byte, maxPacketLen)
+	oldStream1, oldStream2 := net.Pipe()
+	oldErrCh := make(chan error, 1)
+	go func() { oldErrCh <- relay.Serve(oldStream1) }()
+	device.inCh <- []byte("packet1")
+	n, err := ReadPacket(oldStream2, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "packet1" {
+		t.Fatalf("unexpected packet: %s", buf[:n])
+	}
+
+	stream1, stream2 := net.Pipe()
+	go relay.Serve(stream1)
+	select {
+	case <-oldErrCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the old stream should be closed")
+	}
+	device.inCh <- []byte("packet2")
+	n, err = ReadPacket(stream2, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "packet2" {
+		t.Fatalf("unexpected packet: %s", buf[:n])
+	}
+}
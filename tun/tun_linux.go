@@ -0,0 +1,82 @@
+//go:build linux
+// +build linux
+
+package tun
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// (base: linux/if_tun.h)
+const (
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffNoPi   = 0x1000
+)
+
+type ifReq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// Device is a TUN device, where a read or a write is one IP packet
+type Device struct {
+	*os.File
+	name string
+}
+
+// Open creates a TUN device, whose name is assigned by the kernel when name is empty
+func Open(name string) (*Device, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, errors.Errorf("too long device name '%s'", name)
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open /dev/net/tun")
+	}
+	var req ifReq
+	copy(req.name[:], name)
+	req.flags = iffTun | iffNoPi
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, errors.Wrap(errno, "failed to create TUN device")
+	}
+	// NOTE: A non-blocking fd uses the runtime poller, so that Close() interrupts Read()
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &Device{
+		File: os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: string(req.name[:bytes.IndexByte(req.name[:], 0)]),
+	}, nil
+}
+
+func (d *Device) Name() string {
+	return d.name
+}
+
+// Configure assigns the address in CIDR notation and the MTU, brings the device up and adds routes by ip command
+func (d *Device) Configure(address string, mtu int, routes []string) error {
+	commands := [][]string{
+		{"addr", "add", address, "dev", d.name},
+		{"link", "set", "dev", d.name, "mtu", strconv.Itoa(mtu), "up"},
+	}
+	for _, route := range routes {
+		commands = append(commands, []string{"route", "add", route, "dev", d.name})
+	}
+	for _, args := range commands {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return errors.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
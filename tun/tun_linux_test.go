@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package tun
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func addNetns(t *testing.T, name string) {
+	if output, err := exec.Command("ip", "netns", "add", name).CombinedOutput(); err != nil {
+		t.Skipf("network namespace is not available: %s", output)
+	}
+	t.Cleanup(func() { exec.Command("ip", "netns", "delete", name).Run() })
+}
+
+// openInNetns opens a TUN device and moves it to the network namespace
+// NOTE: The file descriptor keeps working after moving the device
+func openInNetns(t *testing.T, netns string, address string) *Device {
+	device, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { device.Close() })
+	for _, args := range [][]string{
+		{"link", "set", "dev", device.Name(), "netns", netns},
+		{"-n", netns, "addr", "add", address, "dev", device.Name()},
+		{"-n", netns, "link", "set", "dev", device.Name(), "mtu", "1400", "up"},
+	} {
+		if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %s", err, output)
+		}
+	}
+	return device
+}
+
+// TestHelperProcess echoes or sends a UDP datagram in a network namespace for TestDeviceInNetns
+func TestHelperProcess(t *testing.T) {
+	address := os.Getenv("TUN_TEST_UDP_ADDRESS")
+	switch os.Getenv("TUN_TEST_HELPER") {
+	case "echo":
+		pc, err := net.ListenPacket("udp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	case "send":
+		conn, err := net.Dial("udp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		buf := make([]byte, 1500)
+		// NOTE: Retry until the echo server starts
+		for i := 0; i < 20; i++ {
+			conn.Write([]byte("hello"))
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			n, err := conn.Read(buf)
+			if err == nil && string(buf[:n]) == "hello" {
+				return
+			}
+		}
+		t.Fatal("echo not received")
+	}
+}
+
+func helperCommand(netns string, helper string, address string) *exec.Cmd {
+	c := exec.Command("ip", "netns", "exec", netns, os.Args[0], "-test.run=^TestHelperProcess$")
+	c.Env = append(os.Environ(), "TUN_TEST_HELPER="+helper, "TUN_TEST_UDP_ADDRESS="+address)
+	return c
+}
+
+func TestDeviceInNetns(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("root is required")
+	}
+	netns1 := fmt.Sprintf("piping-tunnel-test1-%d", os.Getpid())
+	netns2 := fmt.Sprintf("piping-tunnel-test2-%d", os.Getpid())
+	addNetns(t, netns1)
+	addNetns(t, netns2)
+	device1 := openInNetns(t, netns1, "10.200.0.1/30")
+	device2 := openInNetns(t, netns2, "10.200.0.2/30")
+	stream1, stream2 := net.Pipe()
+	go NewRelay(device1, 1400).Serve(stream1)
+	go NewRelay(device2, 1400).Serve(stream2)
+	echoCmd := helperCommand(netns2, "echo", "10.200.0.2:9999")
+	if err := echoCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		echoCmd.Process.Kill()
+		echoCmd.Wait()
+	})
+	if output, err := helperCommand(netns1, "send", "10.200.0.2:9999").CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package tun
+
+import (
+	"github.com/pkg/errors"
+	"os"
+)
+
+type Device struct {
+	*os.File
+	name string
+}
+
+func Open(name string) (*Device, error) {
+	return nil, errors.Errorf("TUN device is only supported on Linux")
+}
+
+func (d *Device) Name() string {
+	return d.name
+}
+
+func (d *Device) Configure(address string, mtu int, routes []string) error {
+	return errors.Errorf("TUN device is only supported on Linux")
+}
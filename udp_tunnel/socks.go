@@ -0,0 +1,126 @@
+package udp_tunnel
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socksAddrTypeIpv4 byte = 1
+	socksAddrTypeFqdn      = 3
+	socksAddrTypeIpv6      = 4
+)
+
+// NOTE: RSV (2 bytes) + FRAG (1 byte) + ATYP (1 byte) + IPv6 address (16 bytes) + port (2 bytes)
+const maxSocksUdpHeaderLen = 22
+
+var SocksUdpFragmentError = errors.New("SOCKS UDP fragmentation is not supported")
+
+// ParseSocksUdpDatagram parses a UDP request datagram of SOCKS5 (RFC 1928) into the destination and the data
+func ParseSocksUdpDatagram(datagram []byte) (string, []byte, error) {
+	if len(datagram) < 4 {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	if datagram[2] != 0 {
+		return "", nil, SocksUdpFragmentError
+	}
+	var host string
+	rest := datagram[4:]
+	switch datagram[3] {
+	case socksAddrTypeIpv4:
+		if len(rest) < net.IPv4len {
+			return "", nil, io.ErrUnexpectedEOF
+		}
+		host = net.IP(rest[:net.IPv4len]).String()
+		rest = rest[net.IPv4len:]
+	case socksAddrTypeIpv6:
+		if len(rest) < net.IPv6len {
+			return "", nil, io.ErrUnexpectedEOF
+		}
+		host = net.IP(rest[:net.IPv6len]).String()
+		rest = rest[net.IPv6len:]
+	case socksAddrTypeFqdn:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return "", nil, io.ErrUnexpectedEOF
+		}
+		host = string(rest[1 : 1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+	default:
+		return "", nil, errors.Errorf("unknown SOCKS address type: %d", datagram[3])
+	}
+	if len(rest) < 2 {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	port := binary.BigEndian.Uint16(rest[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), rest[2:], nil
+}
+
+// AppendSocksUdpHeader appends the header of a UDP datagram of SOCKS5 (RFC 1928) from addr
+func AppendSocksUdpHeader(b []byte, addr *net.UDPAddr) []byte {
+	b = append(b, 0, 0, 0)
+	if ip := addr.IP.To4(); ip != nil {
+		b = append(b, socksAddrTypeIpv4)
+		b = append(b, ip...)
+	} else {
+		b = append(b, socksAddrTypeIpv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+type socksEndpoint struct {
+	pc     net.PacketConn
+	permit func(addr *net.UDPAddr) bool
+	buf    []byte
+}
+
+func (e *socksEndpoint) send(datagram []byte) error {
+	dst, data, err := ParseSocksUdpDatagram(datagram)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", dst)
+	if err != nil {
+		return err
+	}
+	if !e.permit(addr) {
+		return errors.Errorf("UDP to %s is not permitted", addr)
+	}
+	_, err = e.pc.WriteTo(data, addr)
+	return err
+}
+
+func (e *socksEndpoint) receive(buf []byte) (int, error) {
+	for {
+		n, addr, err := e.pc.ReadFrom(e.buf)
+		if err != nil {
+			return 0, err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || !e.permit(udpAddr) {
+			continue
+		}
+		header := AppendSocksUdpHeader(buf[:0], udpAddr)
+		return len(header) + copy(buf[len(header):], e.buf[:n]), nil
+	}
+}
+
+func (e *socksEndpoint) Close() error {
+	return e.pc.Close()
+}
+
+// SocksServer relays UDP request datagrams of SOCKS5 in each flow over duplex to their destinations and sends replies back as the flow.
+// Datagrams from and to addresses rejected by permit are dropped.
+func SocksServer(duplex io.ReadWriteCloser, permit func(addr *net.UDPAddr) bool, idleTimeout time.Duration) error {
+	return serve(duplex, func() (flowEndpoint, error) {
+		pc, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+		return &socksEndpoint{pc: pc, permit: permit, buf: make([]byte, maxDatagramLen-maxSocksUdpHeaderLen)}, nil
+	}, idleTimeout)
+}
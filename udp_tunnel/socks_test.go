@@ -0,0 +1,43 @@
+package udp_tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSocksUdpDatagram(t *testing.T) {
+	cases := []struct {
+		datagram []byte
+		dst      string
+	}{
+		{datagram: []byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53, 'h', 'i'}, dst: "127.0.0.1:53"},
+		{datagram: append([]byte{0, 0, 0, 3, 9}, "localhost\x01\xbbhi"...), dst: "localhost:443"},
+		{datagram: append(append([]byte{0, 0, 0, 4}, net.IPv6loopback...), 0x14, 0xe9, 'h', 'i'), dst: "[::1]:5353"},
+	}
+	for _, c := range cases {
+		dst, data, err := ParseSocksUdpDatagram(c.datagram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dst != c.dst || string(data) != "hi" {
+			t.Fatalf("unexpected result: %s, %s", dst, data)
+		}
+	}
+	if _, _, err := ParseSocksUdpDatagram([]byte{0, 0, 1, 1, 127, 0, 0, 1, 0, 53}); err != SocksUdpFragmentError {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := ParseSocksUdpDatagram([]byte{0, 0, 0, 1, 127, 0}); err == nil {
+		t.Fatal("should be error")
+	}
+}
+
+func TestAppendSocksUdpHeader(t *testing.T) {
+	header := AppendSocksUdpHeader(nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53})
+	dst, data, err := ParseSocksUdpDatagram(append(header, "hi"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst != "127.0.0.1:53" || string(data) != "hi" {
+		t.Fatalf("unexpected result: %s, %s", dst, data)
+	}
+}
@@ -0,0 +1,297 @@
+package udp_tunnel
+
+import (
+	"encoding/binary"
+	"github.com/nwtgck/go-piping-tunnel/util"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// NOTE: A frame is flow ID (4 bytes) + datagram length (2 bytes) + datagram
+const (
+	frameHeaderLen = 6
+	maxDatagramLen = 65535
+)
+
+func writeFrame(w io.Writer, flowId uint32, datagram []byte) error {
+	frame := make([]byte, frameHeaderLen+len(datagram))
+	binary.BigEndian.PutUint32(frame[0:4], flowId)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(datagram)))
+	copy(frame[frameHeaderLen:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// buf should have maxDatagramLen bytes
+func readFrame(r io.Reader, buf []byte) (uint32, int, error) {
+	header := make([]byte, frameHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, err
+	}
+	flowId := binary.BigEndian.Uint32(header[0:4])
+	n := int(binary.BigEndian.Uint16(header[4:6]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	return flowId, n, nil
+}
+
+// sweepIdle calls removeIdle periodically until stop is closed
+func sweepIdle(idleTimeout time.Duration, stop <-chan struct{}, removeIdle func()) {
+	// NOTE: Flows never expire when idleTimeout is zero
+	if idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			removeIdle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+type clientFlow struct {
+	id         uint32
+	addr       net.Addr
+	lastActive time.Time
+}
+
+type clientFlows struct {
+	mutex  *sync.Mutex
+	byAddr map[string]*clientFlow
+	byId   map[uint32]*clientFlow
+	nextId uint32
+}
+
+func (f *clientFlows) id(addr net.Addr) uint32 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	flow, ok := f.byAddr[addr.String()]
+	if !ok {
+		flow = &clientFlow{id: f.nextId, addr: addr}
+		f.nextId++
+		f.byAddr[addr.String()] = flow
+		f.byId[flow.id] = flow
+	}
+	flow.lastActive = time.Now()
+	return flow.id
+}
+
+func (f *clientFlows) addr(flowId uint32) net.Addr {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	flow, ok := f.byId[flowId]
+	if !ok {
+		return nil
+	}
+	flow.lastActive = time.Now()
+	return flow.addr
+}
+
+func (f *clientFlows) removeIdle(idleTimeout time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for id, flow := range f.byId {
+		if time.Since(flow.lastActive) > idleTimeout {
+			delete(f.byId, id)
+			delete(f.byAddr, flow.addr.String())
+		}
+	}
+}
+
+// Client relays datagrams from each peer of pc over duplex as a separate flow and sends replies back to the peer.
+// It returns when pc or duplex fails and closes duplex.
+func Client(pc net.PacketConn, duplex io.ReadWriteCloser, idleTimeout time.Duration) error {
+	flows := &clientFlows{mutex: new(sync.Mutex), byAddr: map[string]*clientFlow{}, byId: map[uint32]*clientFlow{}}
+	// NOTE: The deadline may be set by the previous call
+	if err := pc.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go sweepIdle(idleTimeout, stop, func() { flows.removeIdle(idleTimeout) })
+
+	readErrCh := make(chan error, 1)
+	go func() {
+		buf := make([]byte, maxDatagramLen)
+		for {
+			flowId, n, err := readFrame(duplex, buf)
+			if err != nil {
+				// Unblock pc.ReadFrom()
+				pc.SetReadDeadline(time.Now())
+				readErrCh <- err
+				return
+			}
+			addr := flows.addr(flowId)
+			// NOTE: The flow has already expired
+			if addr == nil {
+				continue
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	var err error
+	buf := make([]byte, maxDatagramLen)
+	for {
+		var n int
+		var addr net.Addr
+		n, addr, err = pc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if err = writeFrame(duplex, flows.id(addr), buf[:n]); err != nil {
+			break
+		}
+	}
+	duplex.Close()
+	readErr := <-readErrCh
+	if util.IsTimeoutErr(err) {
+		return readErr
+	}
+	return err
+}
+
+// flowEndpoint is the UDP side of a flow in server side
+type flowEndpoint interface {
+	// send sends a datagram from the duplex
+	send(datagram []byte) error
+	// receive receives a datagram to send back over the duplex
+	receive(buf []byte) (int, error)
+	Close() error
+}
+
+type connEndpoint struct {
+	net.Conn
+}
+
+func (e connEndpoint) send(datagram []byte) error {
+	_, err := e.Write(datagram)
+	return err
+}
+
+func (e connEndpoint) receive(buf []byte) (int, error) {
+	return e.Read(buf)
+}
+
+type serverFlow struct {
+	endpoint   flowEndpoint
+	lastActive time.Time
+}
+
+type server struct {
+	duplex      io.ReadWriteCloser
+	dial        func() (flowEndpoint, error)
+	writeMutex  *sync.Mutex
+	flowsMutex  *sync.Mutex
+	flows       map[uint32]*serverFlow
+	idleTimeout time.Duration
+}
+
+// Server relays datagrams of each flow over duplex to a UDP connection made by dial and sends replies back as the flow.
+// It returns when duplex fails and closes all the UDP connections.
+func Server(duplex io.ReadWriteCloser, dial func() (net.Conn, error), idleTimeout time.Duration) error {
+	return serve(duplex, func() (flowEndpoint, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		return connEndpoint{conn}, nil
+	}, idleTimeout)
+}
+
+func serve(duplex io.ReadWriteCloser, dial func() (flowEndpoint, error), idleTimeout time.Duration) error {
+	s := &server{
+		duplex:      duplex,
+		dial:        dial,
+		writeMutex:  new(sync.Mutex),
+		flowsMutex:  new(sync.Mutex),
+		flows:       map[uint32]*serverFlow{},
+		idleTimeout: idleTimeout,
+	}
+	defer s.closeFlows()
+	stop := make(chan struct{})
+	defer close(stop)
+	go sweepIdle(idleTimeout, stop, s.removeIdle)
+
+	buf := make([]byte, maxDatagramLen)
+	for {
+		flowId, n, err := readFrame(duplex, buf)
+		if err != nil {
+			return err
+		}
+		endpoint, err := s.flowEndpoint(flowId)
+		// NOTE: The datagram is dropped like a lost packet
+		if err != nil {
+			continue
+		}
+		endpoint.send(buf[:n])
+	}
+}
+
+func (s *server) flowEndpoint(flowId uint32) (flowEndpoint, error) {
+	s.flowsMutex.Lock()
+	defer s.flowsMutex.Unlock()
+	if flow, ok := s.flows[flowId]; ok {
+		flow.lastActive = time.Now()
+		return flow.endpoint, nil
+	}
+	endpoint, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	flow := &serverFlow{endpoint: endpoint, lastActive: time.Now()}
+	s.flows[flowId] = flow
+	go s.relayReplies(flowId, flow)
+	return endpoint, nil
+}
+
+func (s *server) relayReplies(flowId uint32, flow *serverFlow) {
+	buf := make([]byte, maxDatagramLen)
+	for {
+		n, err := flow.endpoint.receive(buf)
+		if err != nil {
+			return
+		}
+		s.flowsMutex.Lock()
+		flow.lastActive = time.Now()
+		s.flowsMutex.Unlock()
+		s.writeMutex.Lock()
+		err = writeFrame(s.duplex, flowId, buf[:n])
+		s.writeMutex.Unlock()
+		if err != nil {
+			// NOTE: Closing makes serve() return
+			s.duplex.Close()
+			return
+		}
+	}
+}
+
+func (s *server) removeIdle() {
+	s.flowsMutex.Lock()
+	defer s.flowsMutex.Unlock()
+	for id, flow := range s.flows {
+		if time.Since(flow.lastActive) > s.idleTimeout {
+			flow.endpoint.Close()
+			delete(s.flows, id)
+		}
+	}
+}
+
+func (s *server) closeFlows() {
+	s.flowsMutex.Lock()
+	defer s.flowsMutex.Unlock()
+	for id, flow := range s.flows {
+		flow.endpoint.Close()
+		delete(s.flows, id)
+	}
+}
@@ -0,0 +1,125 @@
+package udp_tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeDuplex is a duplex with io.Pipe()
+type pipeDuplex struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func newPipeDuplexPair() (*pipeDuplex, *pipeDuplex) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return &pipeDuplex{Reader: r1, WriteCloser: w2}, &pipeDuplex{Reader: r2, WriteCloser: w1}
+}
+
+func startUdpEchoServer(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramLen)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+func assertUdpEcho(t *testing.T, conn net.Conn, msg string) {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != msg {
+		t.Fatalf("unexpected reply: %s", buf[:n])
+	}
+}
+
+func TestClientServer(t *testing.T) {
+	echoServer := startUdpEchoServer(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	clientDuplex, serverDuplex := newPipeDuplexPair()
+	go Client(pc, clientDuplex, time.Minute)
+	serverErrCh := make(chan error, 1)
+	go func() {
+		serverErrCh <- Server(serverDuplex, func() (net.Conn, error) {
+			return net.Dial("udp", echoServer.LocalAddr().String())
+		}, time.Minute)
+	}()
+
+	// Each peer receives its own replies
+	conn1, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn1.Close()
+	conn2, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	for i := 0; i < 3; i++ {
+		assertUdpEcho(t, conn1, "hello from conn1")
+		assertUdpEcho(t, conn2, "hello from conn2")
+	}
+
+	// Server returns after the client side ends
+	clientDuplex.Close()
+	select {
+	case <-serverErrCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not return")
+	}
+}
+
+func TestServerRemovesIdleFlows(t *testing.T) {
+	echoServer := startUdpEchoServer(t)
+	clientDuplex, serverDuplex := newPipeDuplexPair()
+	defer clientDuplex.Close()
+	dialCount := 0
+	go Server(serverDuplex, func() (net.Conn, error) {
+		dialCount++
+		return net.Dial("udp", echoServer.LocalAddr().String())
+	}, 100*time.Millisecond)
+
+	buf := make([]byte, maxDatagramLen)
+	for i := 0; i < 2; i++ {
+		if err := writeFrame(clientDuplex, 1, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		flowId, n, err := readFrame(clientDuplex, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flowId != 1 || string(buf[:n]) != "hello" {
+			t.Fatalf("unexpected frame: %d, %s", flowId, buf[:n])
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	// NOTE: The flow is dialed again after expiring
+	if dialCount != 2 {
+		t.Fatalf("dialed %d times", dialCount)
+	}
+}
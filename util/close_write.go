@@ -0,0 +1,23 @@
+package util
+
+import "io"
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of w if w supports half-close
+func CloseWrite(w io.Writer) error {
+	if c, ok := w.(closeWriter); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// CloseWriteOrClose shuts down the writing side of w, or closes w when w does not support half-close
+func CloseWriteOrClose(w io.WriteCloser) error {
+	if c, ok := w.(closeWriter); ok {
+		return c.CloseWrite()
+	}
+	return w.Close()
+}
@@ -22,6 +22,10 @@ func (d *duplexConn) Write(p []byte) (int, error) {
 	return d.duplex.Write(p)
 }
 
+func (d *duplexConn) CloseWrite() error {
+	return CloseWrite(d.duplex)
+}
+
 func (d *duplexConn) Close() error {
 	return d.duplex.Close()
 }
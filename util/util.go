@@ -114,7 +114,7 @@ func InputPassphrase() (string, error) {
 		return "", err
 	}
 	defer tty.Close()
-	quitCh := make(chan os.Signal)
+	quitCh := make(chan os.Signal, 1)
 	doneCh := make(chan struct{})
 	defer func() {
 		// End this input-function normally